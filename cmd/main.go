@@ -11,6 +11,7 @@ import (
 	"log/slog"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -22,50 +23,162 @@ const (
 	configFileName = "ditto-config.json"
 
 	// Environment variable names
-	configPathEnv          = "DITTO_CONFIG_PATH"
-	repoURLEnv             = "DITTO_REPO_URL"
-	repoURLsEnv            = "DITTO_REPO_URLS"
-	archURLsEnv            = "DITTO_ARCH_URLS"
-	distEnv                = "DITTO_DIST"
-	distsEnv               = "DITTO_DISTS"
-	componentsEnv          = "DITTO_COMPONENTS"
-	archsEnv               = "DITTO_ARCHS"
-	languagesEnv           = "DITTO_LANGUAGES"
-	downloadPathEnv        = "DITTO_DOWNLOAD_PATH"
-	workersEnv             = "DITTO_WORKERS"
-	debugEnv               = "DITTO_DEBUG"
-	verifyModeEnv          = "DITTO_VERIFY_MODE"
-	allowMissingIndicesEnv = "DITTO_ALLOW_MISSING_INDICES"
+	configPathEnv           = "DITTO_CONFIG_PATH"
+	repoURLEnv              = "DITTO_REPO_URL"
+	repoURLsEnv             = "DITTO_REPO_URLS"
+	archURLsEnv             = "DITTO_ARCH_URLS"
+	distEnv                 = "DITTO_DIST"
+	distsEnv                = "DITTO_DISTS"
+	componentsEnv           = "DITTO_COMPONENTS"
+	archsEnv                = "DITTO_ARCHS"
+	languagesEnv            = "DITTO_LANGUAGES"
+	downloadPathEnv         = "DITTO_DOWNLOAD_PATH"
+	workersEnv              = "DITTO_WORKERS"
+	debugEnv                = "DITTO_DEBUG"
+	verifyModeEnv           = "DITTO_VERIFY_MODE"
+	allowMissingIndicesEnv  = "DITTO_ALLOW_MISSING_INDICES"
+	keyringsEnv             = "DITTO_KEYRINGS"
+	keyFingerprintsEnv      = "DITTO_KEY_FINGERPRINTS"
+	sourcesEnv              = "DITTO_SOURCES"
+	contentsEnv             = "DITTO_CONTENTS"
+	debianInstallerEnv      = "DITTO_DEBIAN_INSTALLER"
+	installerImagesEnv      = "DITTO_INSTALLER_IMAGES"
+	flatEnv                 = "DITTO_FLAT"
+	includePackagesEnv      = "DITTO_INCLUDE_PACKAGES"
+	excludePackagesEnv      = "DITTO_EXCLUDE_PACKAGES"
+	sectionsEnv             = "DITTO_SECTIONS"
+	prioritiesEnv           = "DITTO_PRIORITIES"
+	seedPackagesEnv         = "DITTO_SEED_PACKAGES"
+	dependencyFieldsEnv     = "DITTO_DEPENDENCY_FIELDS"
+	regenerateIndicesEnv    = "DITTO_REGENERATE_INDICES"
+	signingKeyEnv           = "DITTO_SIGNING_KEY"
+	signingKeyPassphraseEnv = "DITTO_SIGNING_KEY_PASSPHRASE"
+	signingKeySecretFileEnv = "DITTO_SIGNING_KEY_PASSPHRASE_FILE"
+	keepVersionsEnv         = "DITTO_KEEP_VERSIONS"
+	maxRetriesEnv           = "DITTO_MAX_RETRIES"
+	retryBackoffEnv         = "DITTO_RETRY_BACKOFF"
+	maxRetryBackoffEnv      = "DITTO_MAX_RETRY_BACKOFF"
+	httpConnectTimeoutEnv   = "DITTO_HTTP_CONNECT_TIMEOUT"
+	httpReadTimeoutEnv      = "DITTO_HTTP_READ_TIMEOUT"
+	httpTimeoutEnv          = "DITTO_HTTP_TIMEOUT"
+	httpProxyEnv            = "DITTO_HTTP_PROXY"
+	httpCABundleEnv         = "DITTO_HTTP_CA_BUNDLE"
+	httpClientCertEnv       = "DITTO_HTTP_CLIENT_CERT"
+	httpClientKeyEnv        = "DITTO_HTTP_CLIENT_KEY"
+	httpUserAgentEnv        = "DITTO_HTTP_USER_AGENT"
+	httpAuthConfEnv         = "DITTO_HTTP_AUTH_CONF"
+	httpRateLimitEnv        = "DITTO_HTTP_RATE_LIMIT"
+	httpHostRateLimitsEnv   = "DITTO_HTTP_HOST_RATE_LIMITS"
+	httpValidatorCacheEnv   = "DITTO_HTTP_VALIDATOR_CACHE"
+	mirrorFailuresEnv       = "DITTO_MIRROR_FAILURE_THRESHOLD"
+	mirrorCooldownEnv       = "DITTO_MIRROR_COOLDOWN"
+	adaptiveMirrorOrderEnv  = "DITTO_ADAPTIVE_MIRROR_ORDER"
+	connectionsPerHostEnv   = "DITTO_MAX_CONNECTIONS_PER_HOST"
+	hostMaxConnectionsEnv   = "DITTO_HOST_MAX_CONNECTIONS"
 
 	// Flag names and descriptions
-	configPath                         = "config"
-	configPathDescription              = "Path to config file (default: ./ditto-config.json)"
-	repoURLFlag                        = "repo-url"
-	repoURLFlagDescription             = "Repository URL (deprecated, use repo-urls)"
-	repoURLsFlag                       = "repo-urls"
-	repoURLsFlagDescription            = "Repository URLs (comma-separated mirrors serving identical Release files)"
-	archURLsFlag                       = "arch-urls"
-	archURLsFlagDescription            = "Per-architecture mirror preferences (comma-separated arch=url pairs)"
-	distFlag                           = "dist"
-	distFlagDescription                = "Distribution (deprecated, use dists)"
-	distsFlag                          = "dists"
-	distsFlagDescription               = "Distributions (comma-separated)"
-	componentsFlag                     = "components"
-	componentsFlagDescription          = "Components (comma-separated)"
-	archsFlag                          = "archs"
-	archsFlagDescription               = "Architectures (comma-separated)"
-	languagesFlag                      = "languages"
-	languagesFlagDescription           = "Languages (comma-separated)"
-	downloadPathFlag                   = "download-path"
-	downloadPathFlagDescription        = "Download path"
-	workersFlag                        = "workers"
-	workersFlagDescription             = "Number of workers"
-	verifyModeFlag                     = "verify-mode"
-	verifyModeFlagDescription          = "File verification mode: checksum (default) or size"
-	allowMissingIndicesFlag            = "allow-missing-indices"
-	allowMissingIndicesFlagDescription = "Warn instead of failing when a Packages index file cannot be fetched"
-	debugFlag                          = "debug"
-	debugFlagDescription               = "Enable debug logging"
+	configPath                          = "config"
+	configPathDescription               = "Path to config file (default: ./ditto-config.json)"
+	repoURLFlag                         = "repo-url"
+	repoURLFlagDescription              = "Repository URL (deprecated, use repo-urls)"
+	repoURLsFlag                        = "repo-urls"
+	repoURLsFlagDescription             = "Repository URLs (comma-separated mirrors serving identical Release files)"
+	archURLsFlag                        = "arch-urls"
+	archURLsFlagDescription             = "Per-architecture mirror preferences (comma-separated arch=url pairs)"
+	distFlag                            = "dist"
+	distFlagDescription                 = "Distribution (deprecated, use dists)"
+	distsFlag                           = "dists"
+	distsFlagDescription                = "Distributions (comma-separated)"
+	componentsFlag                      = "components"
+	componentsFlagDescription           = "Components (comma-separated)"
+	archsFlag                           = "archs"
+	archsFlagDescription                = "Architectures (comma-separated)"
+	languagesFlag                       = "languages"
+	languagesFlagDescription            = "Languages (comma-separated)"
+	downloadPathFlag                    = "download-path"
+	downloadPathFlagDescription         = "Download path"
+	workersFlag                         = "workers"
+	workersFlagDescription              = "Number of workers"
+	verifyModeFlag                      = "verify-mode"
+	verifyModeFlagDescription           = "File verification mode: checksum (default) or size"
+	allowMissingIndicesFlag             = "allow-missing-indices"
+	allowMissingIndicesFlagDescription  = "Warn instead of failing when a Packages index file cannot be fetched"
+	keyringsFlag                        = "keyrings"
+	keyringsFlagDescription             = "OpenPGP keyring files used to verify Release signatures (comma-separated)"
+	keyFingerprintsFlag                 = "key-fingerprints"
+	keyFingerprintsFlagDescription      = "Accepted signing key fingerprints (comma-separated)"
+	sourcesFlag                         = "sources"
+	sourcesFlagDescription              = "Also mirror source packages (Sources indices, .dsc files and tarballs)"
+	contentsFlag                        = "contents"
+	contentsFlagDescription             = "Also mirror Contents-<arch> indices (for apt-file)"
+	debianInstallerFlag                 = "debian-installer"
+	debianInstallerFlagDescription      = "Also mirror debian-installer udeb indices and .udeb packages"
+	debugFlag                           = "debug"
+	debugFlagDescription                = "Enable debug logging"
+	flatFlag                            = "flat"
+	flatFlagDescription                 = "Mirror a flat repository; dists are paths relative to the repository URL (e.g. ./)"
+	installerImagesFlag                 = "installer-images"
+	installerImagesFlagDescription      = "Also mirror installer image trees, verified against their SHA256SUMS"
+	includePackagesFlag                 = "include-packages"
+	includePackagesFlagDescription      = "Only mirror binary packages whose name matches one of these patterns (comma-separated globs or /regex/)"
+	excludePackagesFlag                 = "exclude-packages"
+	excludePackagesFlagDescription      = "Skip binary packages whose name matches one of these patterns (comma-separated globs or /regex/)"
+	sectionsFlag                        = "sections"
+	sectionsFlagDescription             = "Only mirror binary packages in these sections (comma-separated globs or /regex/)"
+	prioritiesFlag                      = "priorities"
+	prioritiesFlagDescription           = "Only mirror binary packages with these priorities (comma-separated globs or /regex/)"
+	seedPackagesFlag                    = "seed-packages"
+	seedPackagesFlagDescription         = "Only mirror these packages and their dependency closure (comma-separated)"
+	dependencyFieldsFlag                = "dependency-fields"
+	dependencyFieldsFlagDescription     = "Relationship fields followed when resolving seed-packages (comma-separated, default Pre-Depends,Depends)"
+	regenerateIndicesFlag               = "regenerate-indices"
+	regenerateIndicesFlagDescription    = "Regenerate Packages indices and Release files to list only mirrored packages"
+	signingKeyFlag                      = "signing-key"
+	signingKeyFlagDescription           = "Path to the OpenPGP private key used to sign regenerated Release files"
+	signingKeySecretFileFlag            = "signing-key-passphrase-file"
+	signingKeySecretFileFlagDescription = "File holding the passphrase of the signing key, if it is encrypted"
+	keepVersionsFlag                    = "keep-versions"
+	keepVersionsFlagDescription         = "Keep only the newest N versions of each package and architecture (0 keeps all)"
+	maxRetriesFlag                      = "max-retries"
+	maxRetriesFlagDescription           = "Retries for downloads failing with transient errors (default 3, negative disables)"
+	retryBackoffFlag                    = "retry-backoff"
+	retryBackoffFlagDescription         = "Delay before the first retry, doubled on each retry (default 1s)"
+	maxRetryBackoffFlag                 = "max-retry-backoff"
+	maxRetryBackoffFlagDescription      = "Maximum delay between retries (default 30s)"
+	httpConnectTimeoutFlag              = "http-connect-timeout"
+	httpConnectTimeoutFlagDescription   = "Timeout for connecting to a server, TLS handshake included (default 30s)"
+	httpReadTimeoutFlag                 = "http-read-timeout"
+	httpReadTimeoutFlagDescription      = "Timeout for a response or a stalled transfer to make progress (default 60s)"
+	httpTimeoutFlag                     = "http-timeout"
+	httpTimeoutFlagDescription          = "Overall timeout of a single download (default: none)"
+	httpProxyFlag                       = "http-proxy"
+	httpProxyFlagDescription            = "Proxy URL for all requests, overriding HTTP_PROXY/HTTPS_PROXY"
+	httpCABundleFlag                    = "http-ca-bundle"
+	httpCABundleFlagDescription         = "PEM file of extra CA certificates to trust"
+	httpClientCertFlag                  = "http-client-cert"
+	httpClientCertFlagDescription       = "PEM client certificate for TLS client authentication"
+	httpClientKeyFlag                   = "http-client-key"
+	httpClientKeyFlagDescription        = "PEM private key of the client certificate"
+	httpUserAgentFlag                   = "http-user-agent"
+	httpUserAgentFlagDescription        = "User-Agent header sent with every request (default: ditto-repo)"
+	httpAuthConfFlag                    = "http-auth-conf"
+	httpAuthConfFlagDescription         = "apt auth.conf files or auth.conf.d directories to read credentials from (comma-separated)"
+	httpRateLimitFlag                   = "http-rate-limit"
+	httpRateLimitFlagDescription        = "Combined download rate limit of all workers in bytes per second, e.g. 10M (default: unlimited). Time-of-day schedules (rate-limit-schedule) can only be set in the config file"
+	httpHostRateLimitsFlag              = "http-host-rate-limits"
+	httpHostRateLimitsFlagDescription   = "Per-host download rate limits (comma-separated host=rate pairs, e.g. ports.ubuntu.com=2M)"
+	httpValidatorCacheFlag              = "http-validator-cache"
+	httpValidatorCacheFlagDescription   = "File keeping the ETag/Last-Modified of Release files for conditional requests (default: a file in the user cache directory)"
+	mirrorFailuresFlag                  = "mirror-failure-threshold"
+	mirrorFailuresFlagDescription       = "Consecutive transient failures after which a mirror is tried last for mirror-cooldown (default 3, negative disables)"
+	mirrorCooldownFlag                  = "mirror-cooldown"
+	mirrorCooldownFlagDescription       = "How long a failing mirror is tried last (default 1m)"
+	adaptiveMirrorOrderFlag             = "adaptive-mirror-order"
+	adaptiveMirrorOrderFlagDescription  = "Try mirrors in order of measured latency, throughput and success rate"
+	connectionsPerHostFlag              = "max-connections-per-host"
+	connectionsPerHostFlagDescription   = "Maximum concurrent downloads from any one upstream host (default 0, unlimited)"
+	hostMaxConnectionsFlag              = "host-max-connections"
+	hostMaxConnectionsFlagDescription   = "Per-host maximum concurrent downloads (comma-separated host=count pairs, e.g. mirror.internal=2)"
 )
 
 //go:embed config.default.json
@@ -92,23 +205,98 @@ func parseArchURLs(s string) map[string]string {
 	return result
 }
 
+// parseHostRateLimits parses a comma-separated list of "host=rate" pairs into a map suitable
+// for HTTPConfig.HostRateLimits (e.g. "ports.ubuntu.com=2M,ppa.launchpadcontent.net=512K").
+func parseHostRateLimits(s string) (map[string]repo.ByteRate, error) {
+	result := make(map[string]repo.ByteRate)
+	for _, pair := range strings.Split(s, ",") {
+		host, rate, found := strings.Cut(pair, "=")
+		host = strings.TrimSpace(host)
+		if !found || host == "" {
+			return nil, fmt.Errorf("invalid host rate limit %q", pair)
+		}
+		v, err := repo.ParseByteRate(rate)
+		if err != nil {
+			return nil, err
+		}
+		result[host] = v
+	}
+	return result, nil
+}
+
+// parseHostMaxConnections parses a comma-separated list of "host=count" pairs into a map
+// suitable for DittoConfig.HostMaxConnections (e.g. "mirror.internal=2,ports.ubuntu.com=4").
+func parseHostMaxConnections(s string) (map[string]int, error) {
+	result := make(map[string]int)
+	for _, pair := range strings.Split(s, ",") {
+		host, count, found := strings.Cut(pair, "=")
+		host = strings.TrimSpace(host)
+		if !found || host == "" {
+			return nil, fmt.Errorf("invalid host connection limit %q", pair)
+		}
+		v, err := strconv.Atoi(strings.TrimSpace(count))
+		if err != nil {
+			return nil, fmt.Errorf("invalid host connection limit %q: %w", pair, err)
+		}
+		result[host] = v
+	}
+	return result, nil
+}
+
 func main() {
 	// Define CLI flags
 	var (
-		flagConfigPath          = flag.String(configPath, "", configPathDescription)
-		flagRepoURL             = flag.String(repoURLFlag, "", repoURLFlagDescription)
-		flagRepoURLs            = flag.String(repoURLsFlag, "", repoURLsFlagDescription)
-		flagArchURLs            = flag.String(archURLsFlag, "", archURLsFlagDescription)
-		flagDist                = flag.String(distFlag, "", distFlagDescription)
-		flagDists               = flag.String(distsFlag, "", distsFlagDescription)
-		flagComponents          = flag.String(componentsFlag, "", componentsFlagDescription)
-		flagArchs               = flag.String(archsFlag, "", archsFlagDescription)
-		flagLanguages           = flag.String(languagesFlag, "", languagesFlagDescription)
-		flagDownloadPath        = flag.String(downloadPathFlag, "", downloadPathFlagDescription)
-		flagWorkers             = flag.Int(workersFlag, 0, workersFlagDescription)
-		flagVerifyMode          = flag.String(verifyModeFlag, "", verifyModeFlagDescription)
-		flagAllowMissingIndices = flag.Bool(allowMissingIndicesFlag, false, allowMissingIndicesFlagDescription)
-		flagDebug               = flag.Bool(debugFlag, false, debugFlagDescription)
+		flagConfigPath           = flag.String(configPath, "", configPathDescription)
+		flagRepoURL              = flag.String(repoURLFlag, "", repoURLFlagDescription)
+		flagRepoURLs             = flag.String(repoURLsFlag, "", repoURLsFlagDescription)
+		flagArchURLs             = flag.String(archURLsFlag, "", archURLsFlagDescription)
+		flagDist                 = flag.String(distFlag, "", distFlagDescription)
+		flagDists                = flag.String(distsFlag, "", distsFlagDescription)
+		flagComponents           = flag.String(componentsFlag, "", componentsFlagDescription)
+		flagArchs                = flag.String(archsFlag, "", archsFlagDescription)
+		flagLanguages            = flag.String(languagesFlag, "", languagesFlagDescription)
+		flagDownloadPath         = flag.String(downloadPathFlag, "", downloadPathFlagDescription)
+		flagWorkers              = flag.Int(workersFlag, 0, workersFlagDescription)
+		flagVerifyMode           = flag.String(verifyModeFlag, "", verifyModeFlagDescription)
+		flagAllowMissingIndices  = flag.Bool(allowMissingIndicesFlag, false, allowMissingIndicesFlagDescription)
+		flagKeyrings             = flag.String(keyringsFlag, "", keyringsFlagDescription)
+		flagKeyFingerprints      = flag.String(keyFingerprintsFlag, "", keyFingerprintsFlagDescription)
+		flagSources              = flag.Bool(sourcesFlag, false, sourcesFlagDescription)
+		flagContents             = flag.Bool(contentsFlag, false, contentsFlagDescription)
+		flagDebianInstaller      = flag.Bool(debianInstallerFlag, false, debianInstallerFlagDescription)
+		flagInstallerImages      = flag.Bool(installerImagesFlag, false, installerImagesFlagDescription)
+		flagFlat                 = flag.Bool(flatFlag, false, flatFlagDescription)
+		flagIncludePackages      = flag.String(includePackagesFlag, "", includePackagesFlagDescription)
+		flagExcludePackages      = flag.String(excludePackagesFlag, "", excludePackagesFlagDescription)
+		flagSections             = flag.String(sectionsFlag, "", sectionsFlagDescription)
+		flagPriorities           = flag.String(prioritiesFlag, "", prioritiesFlagDescription)
+		flagSeedPackages         = flag.String(seedPackagesFlag, "", seedPackagesFlagDescription)
+		flagDependencyFields     = flag.String(dependencyFieldsFlag, "", dependencyFieldsFlagDescription)
+		flagRegenerateIndices    = flag.Bool(regenerateIndicesFlag, false, regenerateIndicesFlagDescription)
+		flagSigningKey           = flag.String(signingKeyFlag, "", signingKeyFlagDescription)
+		flagSigningKeySecretFile = flag.String(signingKeySecretFileFlag, "", signingKeySecretFileFlagDescription)
+		flagKeepVersions         = flag.Int(keepVersionsFlag, 0, keepVersionsFlagDescription)
+		flagMaxRetries           = flag.Int(maxRetriesFlag, 0, maxRetriesFlagDescription)
+		flagRetryBackoff         = flag.Duration(retryBackoffFlag, 0, retryBackoffFlagDescription)
+		flagMaxRetryBackoff      = flag.Duration(maxRetryBackoffFlag, 0, maxRetryBackoffFlagDescription)
+		flagHTTPConnectTimeout   = flag.Duration(httpConnectTimeoutFlag, 0, httpConnectTimeoutFlagDescription)
+		flagHTTPReadTimeout      = flag.Duration(httpReadTimeoutFlag, 0, httpReadTimeoutFlagDescription)
+		flagHTTPTimeout          = flag.Duration(httpTimeoutFlag, 0, httpTimeoutFlagDescription)
+		flagHTTPProxy            = flag.String(httpProxyFlag, "", httpProxyFlagDescription)
+		flagHTTPCABundle         = flag.String(httpCABundleFlag, "", httpCABundleFlagDescription)
+		flagHTTPClientCert       = flag.String(httpClientCertFlag, "", httpClientCertFlagDescription)
+		flagHTTPClientKey        = flag.String(httpClientKeyFlag, "", httpClientKeyFlagDescription)
+		flagHTTPUserAgent        = flag.String(httpUserAgentFlag, "", httpUserAgentFlagDescription)
+		flagHTTPAuthConf         = flag.String(httpAuthConfFlag, "", httpAuthConfFlagDescription)
+		flagHTTPRateLimit        = flag.String(httpRateLimitFlag, "", httpRateLimitFlagDescription)
+		flagHTTPHostRateLimits   = flag.String(httpHostRateLimitsFlag, "", httpHostRateLimitsFlagDescription)
+		flagHTTPValidatorCache   = flag.String(httpValidatorCacheFlag, "", httpValidatorCacheFlagDescription)
+		flagMirrorFailures       = flag.Int(mirrorFailuresFlag, 0, mirrorFailuresFlagDescription)
+		flagMirrorCooldown       = flag.Duration(mirrorCooldownFlag, 0, mirrorCooldownFlagDescription)
+		flagAdaptiveMirrorOrder  = flag.Bool(adaptiveMirrorOrderFlag, false, adaptiveMirrorOrderFlagDescription)
+		flagConnectionsPerHost   = flag.Int(connectionsPerHostFlag, 0, connectionsPerHostFlagDescription)
+		flagHostMaxConnections   = flag.String(hostMaxConnectionsFlag, "", hostMaxConnectionsFlagDescription)
+		flagDebug                = flag.Bool(debugFlag, false, debugFlagDescription)
 	)
 	flag.Parse()
 
@@ -183,6 +371,163 @@ func main() {
 	if allowMissingVal == "true" || allowMissingVal == "yes" || allowMissingVal == "1" {
 		config.AllowMissingIndices = true
 	}
+	if keyrings := os.Getenv(keyringsEnv); keyrings != "" {
+		config.Keyrings = strings.Split(keyrings, ",")
+	}
+	if keyFingerprints := os.Getenv(keyFingerprintsEnv); keyFingerprints != "" {
+		config.KeyFingerprints = strings.Split(keyFingerprints, ",")
+	}
+	sourcesVal := strings.ToLower(os.Getenv(sourcesEnv))
+	if sourcesVal == "true" || sourcesVal == "yes" || sourcesVal == "1" {
+		config.Sources = true
+	}
+	contentsVal := strings.ToLower(os.Getenv(contentsEnv))
+	if contentsVal == "true" || contentsVal == "yes" || contentsVal == "1" {
+		config.Contents = true
+	}
+	debianInstallerVal := strings.ToLower(os.Getenv(debianInstallerEnv))
+	if debianInstallerVal == "true" || debianInstallerVal == "yes" || debianInstallerVal == "1" {
+		config.DebianInstaller = true
+	}
+	installerImagesVal := strings.ToLower(os.Getenv(installerImagesEnv))
+	if installerImagesVal == "true" || installerImagesVal == "yes" || installerImagesVal == "1" {
+		config.InstallerImages = true
+	}
+	flatVal := strings.ToLower(os.Getenv(flatEnv))
+	if flatVal == "true" || flatVal == "yes" || flatVal == "1" {
+		config.Flat = true
+	}
+	if includePackages := os.Getenv(includePackagesEnv); includePackages != "" {
+		config.IncludePackages = strings.Split(includePackages, ",")
+	}
+	if excludePackages := os.Getenv(excludePackagesEnv); excludePackages != "" {
+		config.ExcludePackages = strings.Split(excludePackages, ",")
+	}
+	if sections := os.Getenv(sectionsEnv); sections != "" {
+		config.Sections = strings.Split(sections, ",")
+	}
+	if priorities := os.Getenv(prioritiesEnv); priorities != "" {
+		config.Priorities = strings.Split(priorities, ",")
+	}
+	if seedPackages := os.Getenv(seedPackagesEnv); seedPackages != "" {
+		config.SeedPackages = strings.Split(seedPackages, ",")
+	}
+	if dependencyFields := os.Getenv(dependencyFieldsEnv); dependencyFields != "" {
+		config.DependencyFields = strings.Split(dependencyFields, ",")
+	}
+	regenerateIndicesVal := strings.ToLower(os.Getenv(regenerateIndicesEnv))
+	if regenerateIndicesVal == "true" || regenerateIndicesVal == "yes" || regenerateIndicesVal == "1" {
+		config.RegenerateIndices = true
+	}
+	if signingKey := os.Getenv(signingKeyEnv); signingKey != "" {
+		config.SigningKey = signingKey
+	}
+	if signingKeyPassphrase := os.Getenv(signingKeyPassphraseEnv); signingKeyPassphrase != "" {
+		config.SigningKeyPassphrase = signingKeyPassphrase
+	}
+	if signingKeySecretFile := os.Getenv(signingKeySecretFileEnv); signingKeySecretFile != "" {
+		config.SigningKeyPassphraseFile = signingKeySecretFile
+	}
+	if keepVersions := os.Getenv(keepVersionsEnv); keepVersions != "" {
+		var v int
+		if _, err := fmt.Sscanf(keepVersions, "%d", &v); err == nil {
+			config.KeepVersions = v
+		}
+	}
+	if maxRetries := os.Getenv(maxRetriesEnv); maxRetries != "" {
+		var v int
+		if _, err := fmt.Sscanf(maxRetries, "%d", &v); err == nil {
+			config.MaxRetries = v
+		}
+	}
+	if retryBackoff := os.Getenv(retryBackoffEnv); retryBackoff != "" {
+		if v, err := time.ParseDuration(retryBackoff); err == nil {
+			config.RetryBackoff = repo.Duration(v)
+		}
+	}
+	if maxRetryBackoff := os.Getenv(maxRetryBackoffEnv); maxRetryBackoff != "" {
+		if v, err := time.ParseDuration(maxRetryBackoff); err == nil {
+			config.MaxRetryBackoff = repo.Duration(v)
+		}
+	}
+	if httpConnectTimeout := os.Getenv(httpConnectTimeoutEnv); httpConnectTimeout != "" {
+		if v, err := time.ParseDuration(httpConnectTimeout); err == nil {
+			config.HTTP.ConnectTimeout = repo.Duration(v)
+		}
+	}
+	if httpReadTimeout := os.Getenv(httpReadTimeoutEnv); httpReadTimeout != "" {
+		if v, err := time.ParseDuration(httpReadTimeout); err == nil {
+			config.HTTP.ReadTimeout = repo.Duration(v)
+		}
+	}
+	if httpTimeout := os.Getenv(httpTimeoutEnv); httpTimeout != "" {
+		if v, err := time.ParseDuration(httpTimeout); err == nil {
+			config.HTTP.Timeout = repo.Duration(v)
+		}
+	}
+	if httpProxy := os.Getenv(httpProxyEnv); httpProxy != "" {
+		config.HTTP.Proxy = httpProxy
+	}
+	if httpCABundle := os.Getenv(httpCABundleEnv); httpCABundle != "" {
+		config.HTTP.CABundle = httpCABundle
+	}
+	if httpClientCert := os.Getenv(httpClientCertEnv); httpClientCert != "" {
+		config.HTTP.ClientCert = httpClientCert
+	}
+	if httpClientKey := os.Getenv(httpClientKeyEnv); httpClientKey != "" {
+		config.HTTP.ClientKey = httpClientKey
+	}
+	if httpUserAgent := os.Getenv(httpUserAgentEnv); httpUserAgent != "" {
+		config.HTTP.UserAgent = httpUserAgent
+	}
+	if httpAuthConf := os.Getenv(httpAuthConfEnv); httpAuthConf != "" {
+		config.HTTP.AuthConf = strings.Split(httpAuthConf, ",")
+	}
+	if httpRateLimit := os.Getenv(httpRateLimitEnv); httpRateLimit != "" {
+		rate, err := repo.ParseByteRate(httpRateLimit)
+		if err != nil {
+			log.Fatalf("Invalid %s: %v", httpRateLimitEnv, err)
+		}
+		config.HTTP.RateLimit = rate
+	}
+	if httpHostRateLimits := os.Getenv(httpHostRateLimitsEnv); httpHostRateLimits != "" {
+		limits, err := parseHostRateLimits(httpHostRateLimits)
+		if err != nil {
+			log.Fatalf("Invalid %s: %v", httpHostRateLimitsEnv, err)
+		}
+		config.HTTP.HostRateLimits = limits
+	}
+	if httpValidatorCache := os.Getenv(httpValidatorCacheEnv); httpValidatorCache != "" {
+		config.HTTP.ValidatorCache = httpValidatorCache
+	}
+	if mirrorFailureThreshold := os.Getenv(mirrorFailuresEnv); mirrorFailureThreshold != "" {
+		var v int
+		if _, err := fmt.Sscanf(mirrorFailureThreshold, "%d", &v); err == nil {
+			config.MirrorFailureThreshold = v
+		}
+	}
+	if mirrorCooldown := os.Getenv(mirrorCooldownEnv); mirrorCooldown != "" {
+		if v, err := time.ParseDuration(mirrorCooldown); err == nil {
+			config.MirrorCooldown = repo.Duration(v)
+		}
+	}
+	adaptiveMirrorOrderVal := strings.ToLower(os.Getenv(adaptiveMirrorOrderEnv))
+	if adaptiveMirrorOrderVal == "true" || adaptiveMirrorOrderVal == "yes" || adaptiveMirrorOrderVal == "1" {
+		config.AdaptiveMirrorOrder = true
+	}
+	if maxConnectionsPerHost := os.Getenv(connectionsPerHostEnv); maxConnectionsPerHost != "" {
+		var v int
+		if _, err := fmt.Sscanf(maxConnectionsPerHost, "%d", &v); err == nil {
+			config.MaxConnectionsPerHost = v
+		}
+	}
+	if hostMaxConnections := os.Getenv(hostMaxConnectionsEnv); hostMaxConnections != "" {
+		limits, err := parseHostMaxConnections(hostMaxConnections)
+		if err != nil {
+			log.Fatalf("Invalid %s: %v", hostMaxConnectionsEnv, err)
+		}
+		config.HostMaxConnections = limits
+	}
 
 	// Override config with CLI flags if set
 	if *flagRepoURL != "" {
@@ -221,6 +566,129 @@ func main() {
 	if *flagAllowMissingIndices {
 		config.AllowMissingIndices = true
 	}
+	if *flagKeyrings != "" {
+		config.Keyrings = strings.Split(*flagKeyrings, ",")
+	}
+	if *flagKeyFingerprints != "" {
+		config.KeyFingerprints = strings.Split(*flagKeyFingerprints, ",")
+	}
+	if *flagSources {
+		config.Sources = true
+	}
+	if *flagContents {
+		config.Contents = true
+	}
+	if *flagDebianInstaller {
+		config.DebianInstaller = true
+	}
+	if *flagInstallerImages {
+		config.InstallerImages = true
+	}
+	if *flagFlat {
+		config.Flat = true
+	}
+	if *flagIncludePackages != "" {
+		config.IncludePackages = strings.Split(*flagIncludePackages, ",")
+	}
+	if *flagExcludePackages != "" {
+		config.ExcludePackages = strings.Split(*flagExcludePackages, ",")
+	}
+	if *flagSections != "" {
+		config.Sections = strings.Split(*flagSections, ",")
+	}
+	if *flagPriorities != "" {
+		config.Priorities = strings.Split(*flagPriorities, ",")
+	}
+	if *flagSeedPackages != "" {
+		config.SeedPackages = strings.Split(*flagSeedPackages, ",")
+	}
+	if *flagDependencyFields != "" {
+		config.DependencyFields = strings.Split(*flagDependencyFields, ",")
+	}
+	if *flagRegenerateIndices {
+		config.RegenerateIndices = true
+	}
+	if *flagSigningKey != "" {
+		config.SigningKey = *flagSigningKey
+	}
+	if *flagSigningKeySecretFile != "" {
+		config.SigningKeyPassphraseFile = *flagSigningKeySecretFile
+	}
+	if *flagKeepVersions != 0 {
+		config.KeepVersions = *flagKeepVersions
+	}
+	if *flagMaxRetries != 0 {
+		config.MaxRetries = *flagMaxRetries
+	}
+	if *flagRetryBackoff > 0 {
+		config.RetryBackoff = repo.Duration(*flagRetryBackoff)
+	}
+	if *flagMaxRetryBackoff > 0 {
+		config.MaxRetryBackoff = repo.Duration(*flagMaxRetryBackoff)
+	}
+	if *flagHTTPConnectTimeout > 0 {
+		config.HTTP.ConnectTimeout = repo.Duration(*flagHTTPConnectTimeout)
+	}
+	if *flagHTTPReadTimeout > 0 {
+		config.HTTP.ReadTimeout = repo.Duration(*flagHTTPReadTimeout)
+	}
+	if *flagHTTPTimeout > 0 {
+		config.HTTP.Timeout = repo.Duration(*flagHTTPTimeout)
+	}
+	if *flagHTTPProxy != "" {
+		config.HTTP.Proxy = *flagHTTPProxy
+	}
+	if *flagHTTPCABundle != "" {
+		config.HTTP.CABundle = *flagHTTPCABundle
+	}
+	if *flagHTTPClientCert != "" {
+		config.HTTP.ClientCert = *flagHTTPClientCert
+	}
+	if *flagHTTPClientKey != "" {
+		config.HTTP.ClientKey = *flagHTTPClientKey
+	}
+	if *flagHTTPUserAgent != "" {
+		config.HTTP.UserAgent = *flagHTTPUserAgent
+	}
+	if *flagHTTPAuthConf != "" {
+		config.HTTP.AuthConf = strings.Split(*flagHTTPAuthConf, ",")
+	}
+	if *flagHTTPRateLimit != "" {
+		rate, err := repo.ParseByteRate(*flagHTTPRateLimit)
+		if err != nil {
+			log.Fatalf("Invalid --%s: %v", httpRateLimitFlag, err)
+		}
+		config.HTTP.RateLimit = rate
+	}
+	if *flagHTTPHostRateLimits != "" {
+		limits, err := parseHostRateLimits(*flagHTTPHostRateLimits)
+		if err != nil {
+			log.Fatalf("Invalid --%s: %v", httpHostRateLimitsFlag, err)
+		}
+		config.HTTP.HostRateLimits = limits
+	}
+	if *flagHTTPValidatorCache != "" {
+		config.HTTP.ValidatorCache = *flagHTTPValidatorCache
+	}
+	if *flagMirrorFailures != 0 {
+		config.MirrorFailureThreshold = *flagMirrorFailures
+	}
+	if *flagMirrorCooldown > 0 {
+		config.MirrorCooldown = repo.Duration(*flagMirrorCooldown)
+	}
+	if *flagAdaptiveMirrorOrder {
+		config.AdaptiveMirrorOrder = true
+	}
+	if *flagConnectionsPerHost != 0 {
+		config.MaxConnectionsPerHost = *flagConnectionsPerHost
+	}
+	if *flagHostMaxConnections != "" {
+		limits, err := parseHostMaxConnections(*flagHostMaxConnections)
+		if err != nil {
+			log.Fatalf("Invalid --%s: %v", hostMaxConnectionsFlag, err)
+		}
+		config.HostMaxConnections = limits
+	}
 
 	debugVal := strings.ToLower(os.Getenv(debugEnv))
 	enableDebug := *flagDebug || (debugVal == "true" || debugVal == "yes" || debugVal == "1")
@@ -262,6 +730,13 @@ func main() {
 	}
 	log.Printf("Final: %d packages verified, %d packages downloaded, %d total packages (Last: %s)",
 		lastProgress.PackagesVerified, lastProgress.PackagesDownloaded, lastProgress.TotalPackages, lastProgress.CurrentFile)
+	if reporter, ok := d.(repo.MirrorStatsReporter); ok {
+		for _, stats := range reporter.MirrorStats() {
+			log.Printf("Mirror %s: %d downloads, %d transient failures, %d MiB, latency %s, throughput %.1f MiB/s",
+				stats.URL, stats.Successes, stats.Failures, stats.BytesDownloaded>>20,
+				stats.Latency.Round(time.Millisecond), stats.Throughput/(1<<20))
+		}
+	}
 
 	// The error channel yields the terminal result once mirroring has finished.
 	if err := <-errChan; err != nil {
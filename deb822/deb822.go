@@ -0,0 +1,314 @@
+// Package deb822 parses and writes the RFC 822-style control format used by Debian repository
+// metadata: Release and InRelease files, Packages and Sources indices, and similar.
+//
+// A document is a sequence of stanzas (paragraphs) separated by blank lines. Each stanza is
+// an ordered list of fields. A field value may continue over several lines; continuation
+// lines start with a space or a tab. Values are returned with the first line as written
+// after the colon and each continuation line on its own line, minus the single leading
+// space or tab that marks it as a continuation. Helpers interpret values as folded text
+// (Folded), line lists (Lines) or checksum lists (ParseChecksums).
+//
+// Input wrapped in a clearsigned PGP message (such as InRelease) is accepted and its signed
+// text is parsed. The signature itself is not checked.
+//
+// Stanzas are written back (Write, Stanza.WriteTo) in the same form, so a parsed document
+// can be filtered or edited and serialised again.
+package deb822
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Field is a single name/value pair of a stanza.
+type Field struct {
+	Name  string
+	Value string
+}
+
+// Stanza is a single paragraph of fields, in the order they appear in the input.
+type Stanza struct {
+	Fields []Field
+}
+
+// Lookup returns the value of the named field and whether it is present. Field names are
+// matched case-insensitively, as in the Debian policy.
+func (s Stanza) Lookup(name string) (string, bool) {
+	for _, f := range s.Fields {
+		if strings.EqualFold(f.Name, name) {
+			return f.Value, true
+		}
+	}
+	return "", false
+}
+
+// Get returns the value of the named field, or the empty string if it is not present.
+func (s Stanza) Get(name string) string {
+	v, _ := s.Lookup(name)
+	return v
+}
+
+// Set sets the value of the named field, replacing the first existing field of that name
+// (matched case-insensitively) in place, or appending a new field otherwise.
+func (s *Stanza) Set(name, value string) {
+	for i := range s.Fields {
+		if strings.EqualFold(s.Fields[i].Name, name) {
+			s.Fields[i].Value = value
+			return
+		}
+	}
+	s.Fields = append(s.Fields, Field{Name: name, Value: value})
+}
+
+// Del removes every field with the given name, matched case-insensitively.
+func (s *Stanza) Del(name string) {
+	s.Fields = slices.DeleteFunc(s.Fields, func(f Field) bool {
+		return strings.EqualFold(f.Name, name)
+	})
+}
+
+// WriteTo writes the stanza's fields to w, one per line with continuation lines indented
+// by a single space. No blank line is written after the stanza.
+func (s Stanza) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+	for _, f := range s.Fields {
+		first, rest, multiline := strings.Cut(f.Value, "\n")
+		b.WriteString(f.Name)
+		b.WriteString(":")
+		if first != "" {
+			b.WriteString(" ")
+			b.WriteString(first)
+		}
+		b.WriteString("\n")
+		if multiline {
+			for _, line := range strings.Split(rest, "\n") {
+				b.WriteString(" ")
+				b.WriteString(line)
+				b.WriteString("\n")
+			}
+		}
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// Write writes stanzas to w, separated by blank lines.
+func Write(w io.Writer, stanzas []Stanza) error {
+	for i, s := range stanzas {
+		if i > 0 {
+			if _, err := io.WriteString(w, "\n"); err != nil {
+				return err
+			}
+		}
+		if _, err := s.WriteTo(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const (
+	pgpSignedHeader    = "-----BEGIN PGP SIGNED MESSAGE-----"
+	pgpSignatureHeader = "-----BEGIN PGP SIGNATURE-----"
+)
+
+// Reader reads stanzas one by one from an input stream.
+type Reader struct {
+	// OnInvalidLine, when set, makes the Reader tolerant: a malformed line (neither a
+	// field nor a continuation of one) is passed to it as an error and skipped, instead
+	// of making Next fail.
+	OnInvalidLine func(err error)
+
+	r     *bufio.Reader
+	line  int  // number of the last line read, for error messages
+	armor bool // inside the signed text of a clearsigned message
+	done  bool // the signed text or the input has ended
+}
+
+// NewReader returns a Reader that parses stanzas from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// Next returns the next stanza. It returns io.EOF when there are no more stanzas.
+func (r *Reader) Next() (Stanza, error) {
+	var s Stanza
+	for {
+		line, ok, err := r.readLine()
+		if err != nil {
+			return Stanza{}, err
+		}
+		if !ok {
+			break
+		}
+
+		switch {
+		case strings.TrimSpace(line) == "":
+			// A blank line ends the stanza; leading blank lines are skipped.
+			if len(s.Fields) > 0 {
+				return s, nil
+			}
+		case line[0] == '#':
+			// Comment lines are allowed in control files and ignored.
+		case line[0] == ' ' || line[0] == '\t':
+			if len(s.Fields) == 0 {
+				if err := r.invalidLine("continuation line without a field"); err != nil {
+					return Stanza{}, err
+				}
+				continue
+			}
+			last := &s.Fields[len(s.Fields)-1]
+			last.Value += "\n" + strings.TrimRight(line[1:], " \t")
+		default:
+			name, value, found := strings.Cut(line, ":")
+			if !found || name == "" || strings.ContainsAny(name, " \t") {
+				if err := r.invalidLine("invalid field line %q", line); err != nil {
+					return Stanza{}, err
+				}
+				continue
+			}
+			s.Fields = append(s.Fields, Field{Name: name, Value: strings.TrimSpace(value)})
+		}
+	}
+
+	if len(s.Fields) == 0 {
+		return Stanza{}, io.EOF
+	}
+	return s, nil
+}
+
+// readLine returns the next line of stanza text without its line ending, unwrapping a
+// clearsigned message. ok is false at the end of the (signed) text.
+func (r *Reader) readLine() (string, bool, error) {
+	if r.done {
+		return "", false, nil
+	}
+	line, ok, err := r.readRawLine()
+	if err != nil || !ok {
+		r.done = true
+		return "", false, err
+	}
+
+	if r.line == 1 && line == pgpSignedHeader {
+		// Skip the armor headers (e.g. "Hash: SHA512") up to the first blank line.
+		for line != "" {
+			if line, ok, err = r.readRawLine(); err != nil {
+				return "", false, err
+			} else if !ok {
+				return "", false, r.errorf("truncated PGP signed message")
+			}
+		}
+		r.armor = true
+		return r.readLine()
+	}
+
+	if r.armor {
+		if line == pgpSignatureHeader {
+			r.done = true
+			return "", false, nil
+		}
+		// Dash-escaped lines ("- -----...") have their escape removed.
+		line = strings.TrimPrefix(line, "- ")
+	}
+	return line, true, nil
+}
+
+// readRawLine reads one line without its line ending and without any PGP handling. ok is
+// false at the end of the input.
+func (r *Reader) readRawLine() (string, bool, error) {
+	line, err := r.r.ReadString('\n')
+	if err != nil {
+		if !errors.Is(err, io.EOF) {
+			return "", false, err
+		}
+		if line == "" {
+			return "", false, nil
+		}
+	}
+	r.line++
+	return strings.TrimRight(line, "\r\n"), true, nil
+}
+
+// invalidLine reports a malformed line: it returns the error, or passes it to
+// OnInvalidLine and returns nil when that is set.
+func (r *Reader) invalidLine(format string, args ...any) error {
+	err := r.errorf(format, args...)
+	if r.OnInvalidLine == nil {
+		return err
+	}
+	r.OnInvalidLine(err)
+	return nil
+}
+
+func (r *Reader) errorf(format string, args ...any) error {
+	return fmt.Errorf("deb822: line %d: %s", r.line, fmt.Sprintf(format, args...))
+}
+
+// ParseAll reads every stanza from r.
+func ParseAll(r io.Reader) ([]Stanza, error) {
+	dr := NewReader(r)
+	var stanzas []Stanza
+	for {
+		s, err := dr.Next()
+		if errors.Is(err, io.EOF) {
+			return stanzas, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		stanzas = append(stanzas, s)
+	}
+}
+
+// Lines splits a multi-line value into its non-empty lines, with surrounding whitespace
+// removed. It is suited to line-based lists such as the file lists of a Release file.
+func Lines(value string) []string {
+	var lines []string
+	for _, l := range strings.Split(value, "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			lines = append(lines, l)
+		}
+	}
+	return lines
+}
+
+// Folded joins the lines of a folded value (such as a long Depends or Uploaders field) into
+// a single line, separating them with one space.
+func Folded(value string) string {
+	return strings.Join(Lines(value), " ")
+}
+
+// Checksum is one entry of a checksum list such as the SHA256 field of a Release file or
+// the Checksums-Sha256 field of a Sources stanza.
+type Checksum struct {
+	Hash string
+	Size int64
+	Name string
+}
+
+// ParseChecksums parses a checksum list value, one "<hash> <size> <name>" entry per line.
+// Invalid lines are skipped: the valid entries are returned along with an error describing
+// every invalid line, so that callers can either reject the list or log and use the rest.
+func ParseChecksums(value string) ([]Checksum, error) {
+	var sums []Checksum
+	var errs []error
+	for _, l := range Lines(value) {
+		parts := strings.Fields(l)
+		if len(parts) != 3 {
+			errs = append(errs, fmt.Errorf("deb822: invalid checksum line %q", l))
+			continue
+		}
+		size, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("deb822: invalid size in checksum line %q", l))
+			continue
+		}
+		sums = append(sums, Checksum{Hash: parts[0], Size: size, Name: parts[2]})
+	}
+	return sums, errors.Join(errs...)
+}
@@ -0,0 +1,196 @@
+package deb822
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const packagesFixture = `Package: hello
+Version: 2.10-2
+Depends: libc6 (>= 2.14),
+ libfoo1
+Description: example package based on GNU hello
+ The GNU hello program produces a familiar, friendly greeting.
+ .
+   verbatim line
+Filename: pool/main/h/hello/hello_2.10-2_amd64.deb
+SHA256: 35b1508eeee9c1dfba798c4c04304ef0f266990f936a51f165571edf53325cbc
+
+# a comment between stanzas
+
+Package: hello-traditional
+Filename: pool/main/h/hello/hello-traditional_2.10-2_amd64.deb
+`
+
+func TestParseAll(t *testing.T) {
+	stanzas, err := ParseAll(strings.NewReader(packagesFixture))
+	if err != nil {
+		t.Fatalf("ParseAll failed: %v", err)
+	}
+	if len(stanzas) != 2 {
+		t.Fatalf("got %d stanzas, want 2", len(stanzas))
+	}
+
+	hello := stanzas[0]
+	if got := hello.Get("package"); got != "hello" {
+		t.Errorf("case-insensitive Get(package) = %q, want hello", got)
+	}
+	if got, want := hello.Get("Depends"), "libc6 (>= 2.14),\nlibfoo1"; got != want {
+		t.Errorf("Depends = %q, want %q", got, want)
+	}
+	if got, want := Folded(hello.Get("Depends")), "libc6 (>= 2.14), libfoo1"; got != want {
+		t.Errorf("Folded(Depends) = %q, want %q", got, want)
+	}
+	wantDesc := "example package based on GNU hello\nThe GNU hello program produces a familiar, friendly greeting.\n.\n  verbatim line"
+	if got := hello.Get("Description"); got != wantDesc {
+		t.Errorf("Description = %q, want %q", got, wantDesc)
+	}
+	if _, ok := hello.Lookup("Section"); ok {
+		t.Error("Lookup(Section) reported a missing field as present")
+	}
+
+	if got := stanzas[1].Get("Filename"); got != "pool/main/h/hello/hello-traditional_2.10-2_amd64.deb" {
+		t.Errorf("last stanza without trailing blank line: Filename = %q", got)
+	}
+}
+
+func TestParseAll_ClearSigned(t *testing.T) {
+	input := `-----BEGIN PGP SIGNED MESSAGE-----
+Hash: SHA512
+
+Origin: Ubuntu
+Suite: noble
+SHA256:
+ e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855        0 main/binary-amd64/Packages
+ d2a7a5a5b2c8f6e9c3c1e1b2a0c1b2d3e4f5a6b7c8d9e0f1a2b3c4d5e6f7a8b9     1234 main/binary-amd64/Packages.gz
+- -----not-a-header: dash-escaped
+-----BEGIN PGP SIGNATURE-----
+
+iQIzBAEBCgAdFiEE
+-----END PGP SIGNATURE-----
+`
+	stanzas, err := ParseAll(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("ParseAll failed: %v", err)
+	}
+	if len(stanzas) != 1 {
+		t.Fatalf("got %d stanzas, want 1: %+v", len(stanzas), stanzas)
+	}
+	if got := stanzas[0].Get("Suite"); got != "noble" {
+		t.Errorf("Suite = %q, want noble", got)
+	}
+	if _, ok := stanzas[0].Lookup("-----not-a-header"); !ok {
+		t.Error("dash-escaped line was not unescaped")
+	}
+
+	sums, err := ParseChecksums(stanzas[0].Get("SHA256"))
+	if err != nil {
+		t.Fatalf("ParseChecksums failed: %v", err)
+	}
+	want := []Checksum{
+		{Hash: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", Size: 0, Name: "main/binary-amd64/Packages"},
+		{Hash: "d2a7a5a5b2c8f6e9c3c1e1b2a0c1b2d3e4f5a6b7c8d9e0f1a2b3c4d5e6f7a8b9", Size: 1234, Name: "main/binary-amd64/Packages.gz"},
+	}
+	if !reflect.DeepEqual(sums, want) {
+		t.Errorf("ParseChecksums = %+v, want %+v", sums, want)
+	}
+}
+
+func TestParseAll_Errors(t *testing.T) {
+	tests := map[string]string{
+		"continuation first": " orphan\n",
+		"missing colon":      "Package hello\n",
+		"space in name":      "Pack age: hello\n",
+		"truncated armor":    "-----BEGIN PGP SIGNED MESSAGE-----\nHash: SHA512\n",
+	}
+	for name, input := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ParseAll(strings.NewReader(input)); err == nil {
+				t.Error("expected an error, got nil")
+			}
+		})
+	}
+}
+
+func TestParseChecksums_Invalid(t *testing.T) {
+	for _, value := range []string{"abc 12", "abc twelve name"} {
+		if _, err := ParseChecksums(value); err == nil {
+			t.Errorf("ParseChecksums(%q): expected an error", value)
+		}
+	}
+}
+
+func TestReader_OnInvalidLine(t *testing.T) {
+	var invalid []error
+	r := NewReader(strings.NewReader(" orphan\nPackage: hello\nnot a field\nVersion: 1.0\n\nPack age: bye\nPackage: bye\n"))
+	r.OnInvalidLine = func(err error) { invalid = append(invalid, err) }
+
+	var names []string
+	for {
+		s, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+		names = append(names, s.Get("Package")+"="+s.Get("Version"))
+	}
+	if !reflect.DeepEqual(names, []string{"hello=1.0", "bye="}) {
+		t.Errorf("stanzas = %v", names)
+	}
+	if len(invalid) != 3 {
+		t.Errorf("invalid lines reported = %v, want 3", invalid)
+	}
+}
+
+func TestParseChecksums_Partial(t *testing.T) {
+	sums, err := ParseChecksums("abc 12\nabc 12 good\nabc twelve name")
+	if err == nil {
+		t.Error("expected an error for the invalid lines")
+	}
+	if want := []Checksum{{Hash: "abc", Size: 12, Name: "good"}}; !reflect.DeepEqual(sums, want) {
+		t.Errorf("ParseChecksums = %+v, want %+v", sums, want)
+	}
+}
+
+func TestWrite_RoundTrip(t *testing.T) {
+	stanzas, err := ParseAll(strings.NewReader(packagesFixture))
+	if err != nil {
+		t.Fatalf("ParseAll failed: %v", err)
+	}
+
+	var buf strings.Builder
+	if err := Write(&buf, stanzas); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	again, err := ParseAll(strings.NewReader(buf.String()))
+	if err != nil {
+		t.Fatalf("cannot parse written output: %v\n%s", err, buf.String())
+	}
+	if !reflect.DeepEqual(again, stanzas) {
+		t.Errorf("round trip changed the stanzas:\n%s", buf.String())
+	}
+	if !strings.Contains(buf.String(), "Depends: libc6 (>= 2.14),\n libfoo1\n") {
+		t.Errorf("continuation lines not written as expected:\n%s", buf.String())
+	}
+}
+
+func TestStanza_SetDel(t *testing.T) {
+	s := Stanza{Fields: []Field{{Name: "Origin", Value: "Ubuntu"}, {Name: "MD5Sum", Value: "\nabc 1 x"}, {Name: "Date", Value: "old"}}}
+	s.Set("date", "new")
+	s.Set("SHA256", "\ndef 1 x")
+	s.Del("md5sum")
+
+	var buf strings.Builder
+	if _, err := s.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := "Origin: Ubuntu\nDate: new\nSHA256:\n def 1 x\n"
+	if buf.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
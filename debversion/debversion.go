@@ -0,0 +1,196 @@
+// Package debversion parses and compares Debian package version numbers, following the
+// rules implemented by dpkg (dpkg --compare-versions).
+//
+// A version has the form [epoch:]upstream_version[-debian_revision]. Versions are ordered
+// by epoch first, then by upstream version, then by revision. The last two are compared
+// piecewise: runs of non-digits are compared character by character, with letters sorting
+// before other characters and "~" sorting before everything, even the end of the string;
+// runs of digits are compared numerically.
+package debversion
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is a parsed Debian version number.
+type Version struct {
+	Epoch    uint64
+	Upstream string
+	Revision string // empty when the version has no Debian revision
+}
+
+// Parse parses s as a Debian version number, rejecting the same malformed versions as dpkg:
+// empty versions or components, embedded spaces, non-numeric epochs, upstream versions that
+// do not start with a digit, and characters not allowed in a version.
+func Parse(s string) (Version, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return Version{}, errors.New("version string is empty")
+	}
+	if strings.ContainsAny(s, " \t") {
+		return Version{}, fmt.Errorf("version %q has embedded spaces", s)
+	}
+
+	v := split(s)
+	if epoch, _, ok := strings.Cut(s, ":"); ok {
+		n, err := strconv.ParseUint(epoch, 10, 32)
+		if err != nil {
+			return Version{}, fmt.Errorf("epoch in version %q is not a number", s)
+		}
+		v.Epoch = n
+	}
+	if v.Upstream == "" {
+		return Version{}, fmt.Errorf("version %q has an empty upstream version", s)
+	}
+	if strings.HasSuffix(s, "-") {
+		return Version{}, fmt.Errorf("version %q has an empty revision", s)
+	}
+	if !isDigit(v.Upstream[0]) {
+		return Version{}, fmt.Errorf("version %q does not start with a digit", s)
+	}
+	if i := strings.IndexFunc(v.Upstream, func(r rune) bool { return !validChar(r, ".-+~:") }); i >= 0 {
+		return Version{}, fmt.Errorf("invalid character %q in version %q", v.Upstream[i], s)
+	}
+	if i := strings.IndexFunc(v.Revision, func(r rune) bool { return !validChar(r, ".+~") }); i >= 0 {
+		return Version{}, fmt.Errorf("invalid character %q in revision of version %q", v.Revision[i], s)
+	}
+	return v, nil
+}
+
+// split divides s into its components without validating them. An epoch that is not a
+// number is treated as part of the upstream version.
+func split(s string) Version {
+	var v Version
+	if epoch, rest, ok := strings.Cut(s, ":"); ok {
+		if n, err := strconv.ParseUint(epoch, 10, 32); err == nil {
+			v.Epoch = n
+			s = rest
+		}
+	}
+	if i := strings.LastIndexByte(s, '-'); i >= 0 {
+		v.Upstream, v.Revision = s[:i], s[i+1:]
+	} else {
+		v.Upstream = s
+	}
+	return v
+}
+
+// String returns the version in its canonical form, omitting a zero epoch.
+func (v Version) String() string {
+	s := v.Upstream
+	if v.Epoch != 0 {
+		s = strconv.FormatUint(v.Epoch, 10) + ":" + s
+	}
+	if v.Revision != "" {
+		s += "-" + v.Revision
+	}
+	return s
+}
+
+// Compare returns -1, 0 or +1 depending on whether v sorts before, the same as, or after o.
+func (v Version) Compare(o Version) int {
+	switch {
+	case v.Epoch < o.Epoch:
+		return -1
+	case v.Epoch > o.Epoch:
+		return 1
+	}
+	if c := compareFragment(v.Upstream, o.Upstream); c != 0 {
+		return c
+	}
+	return compareFragment(v.Revision, o.Revision)
+}
+
+// Compare compares the version strings a and b like Version.Compare. The strings are not
+// validated: malformed versions are ordered by the same rules on a best-effort basis, so
+// Compare never fails.
+func Compare(a, b string) int {
+	return split(strings.TrimSpace(a)).Compare(split(strings.TrimSpace(b)))
+}
+
+// compareFragment compares two upstream versions or two revisions, as dpkg's verrevcmp.
+func compareFragment(a, b string) int {
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		// Compare the non-digit prefixes character by character.
+		for (i < len(a) && !isDigit(a[i])) || (j < len(b) && !isDigit(b[j])) {
+			ac, bc := order(a, i), order(b, j)
+			if ac != bc {
+				return sign(ac - bc)
+			}
+			i++
+			j++
+		}
+
+		// Compare the digit runs numerically: skip leading zeros, then the longer run is
+		// the larger number, and runs of the same length compare by their first difference.
+		for i < len(a) && a[i] == '0' {
+			i++
+		}
+		for j < len(b) && b[j] == '0' {
+			j++
+		}
+		firstDiff := 0
+		for i < len(a) && isDigit(a[i]) && j < len(b) && isDigit(b[j]) {
+			if firstDiff == 0 {
+				firstDiff = int(a[i]) - int(b[j])
+			}
+			i++
+			j++
+		}
+		if i < len(a) && isDigit(a[i]) {
+			return 1
+		}
+		if j < len(b) && isDigit(b[j]) {
+			return -1
+		}
+		if firstDiff != 0 {
+			return sign(firstDiff)
+		}
+	}
+	return 0
+}
+
+// order returns the sort weight of s[i] within a non-digit run: the end of the string (and
+// digits) weigh 0, "~" sorts before that, letters after it and other characters last.
+func order(s string, i int) int {
+	if i >= len(s) {
+		return 0
+	}
+	c := s[i]
+	switch {
+	case isDigit(c):
+		return 0
+	case isAlpha(c):
+		return int(c)
+	case c == '~':
+		return -1
+	default:
+		return int(c) + 256
+	}
+}
+
+func validChar(r rune, extra string) bool {
+	return r < 0x80 && (isDigit(byte(r)) || isAlpha(byte(r))) || strings.ContainsRune(extra, r)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isAlpha(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,76 @@
+package debversion
+
+import "testing"
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.0", "1.1", -1},
+		{"1.10", "1.9", 1},
+		{"1.001", "1.1", 0},
+		{"1.0", "1.0.0", -1},
+		{"1.0", "1.0-0", 0},
+		{"0:1.0", "1.0", 0},
+		{"1:0.1", "2.0", 1},
+		{"1.0~rc1", "1.0", -1},
+		{"1.0~~", "1.0~~a", -1},
+		{"1.0~~a", "1.0~", -1},
+		{"1.0~", "1.0", -1},
+		{"1.0a", "1.0", 1},
+		{"1.0a", "1.0+", -1}, // letters sort before other characters
+		{"1.0+b1", "1.0", 1},
+		{"1.0-1", "1.0-2", -1},
+		{"1.0-1ubuntu1", "1.0-1", 1},
+		{"2.30-1ubuntu0.1", "2.30-1ubuntu0.10", -1},
+		{"1.2-3-4", "1.2-3-10", -1}, // the revision follows the last hyphen
+		{"7.6p2-4", "7.6-0", 1},
+		{"1.18.36", "1.18.36~bpo8+1", 1},
+		{"4.4.0-21.37", "4.4.0-21.37~14.04.1", 1},
+	}
+	for _, tt := range tests {
+		if got := Compare(tt.a, tt.b); got != tt.want {
+			t.Errorf("Compare(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := Compare(tt.b, tt.a); got != -tt.want {
+			t.Errorf("Compare(%q, %q) = %d, want %d", tt.b, tt.a, got, -tt.want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	v, err := Parse("2:1.2-3-4ubuntu1")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	want := Version{Epoch: 2, Upstream: "1.2-3", Revision: "4ubuntu1"}
+	if v != want {
+		t.Errorf("Parse = %+v, want %+v", v, want)
+	}
+	if got := v.String(); got != "2:1.2-3-4ubuntu1" {
+		t.Errorf("String = %q", got)
+	}
+	if got, _ := Parse("0:1.0"); got.String() != "1.0" {
+		t.Errorf("String of zero epoch = %q, want 1.0", got.String())
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"1.0 2",
+		"a:1.0",
+		"-1:1.0",
+		"1:",
+		"1.0-",
+		"abc",
+		"1.0!",
+		"1.0-1_2",
+	} {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("Parse(%q): expected an error", s)
+		}
+	}
+}
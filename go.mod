@@ -1,3 +1,16 @@
 module github.com/canonical/ditto-repo
 
 go 1.22.2
+
+require (
+	github.com/ProtonMail/go-crypto v1.1.6
+	github.com/klauspost/compress v1.18.0
+	github.com/pierrec/lz4/v4 v4.1.22
+	github.com/ulikunitz/xz v0.5.15
+)
+
+require (
+	github.com/cloudflare/circl v1.3.7 // indirect
+	golang.org/x/crypto v0.17.0 // indirect
+	golang.org/x/sys v0.16.0 // indirect
+)
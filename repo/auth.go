@@ -0,0 +1,241 @@
+package repo
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Credential authenticates the requests sent to one upstream repository.
+type Credential struct {
+	// Machine selects the requests the credential applies to, as in apt's auth.conf: a
+	// host, optionally followed by a port and a path prefix ("esm.ubuntu.com/apps/ubuntu"),
+	// and optionally preceded by a scheme ("http://repo.internal"). Without a scheme only
+	// https requests match, so secrets are never sent in clear text unless the entry
+	// explicitly allows it.
+	Machine string `json:"machine"`
+	// Login and Password are sent with HTTP basic authentication.
+	Login    string `json:"login"`
+	Password string `json:"password"`
+	// Token is sent as a bearer token instead of basic authentication.
+	Token string `json:"token"`
+	// PasswordEnv and TokenEnv name environment variables holding the password or token,
+	// to keep secrets out of the configuration file.
+	PasswordEnv string `json:"password-env"`
+	TokenEnv    string `json:"token-env"`
+}
+
+// credentialEntry is a Credential with its Machine parsed for matching.
+type credentialEntry struct {
+	scheme string // empty matches https only
+	host   string
+	port   string // empty matches any port
+	path   string // path prefix, empty matches any path
+
+	login, password, token string
+}
+
+// newCredentialEntry parses c, resolving secrets held in environment variables.
+func newCredentialEntry(c Credential) (credentialEntry, error) {
+	e := credentialEntry{login: c.Login, password: c.Password, token: c.Token}
+	if c.PasswordEnv != "" {
+		e.password = os.Getenv(c.PasswordEnv)
+	}
+	if c.TokenEnv != "" {
+		e.token = os.Getenv(c.TokenEnv)
+	}
+
+	machine := c.Machine
+	if scheme, rest, ok := strings.Cut(machine, "://"); ok {
+		e.scheme, machine = strings.ToLower(scheme), rest
+	}
+	hostPort, p, _ := strings.Cut(machine, "/")
+	if p != "" {
+		e.path = "/" + strings.TrimSuffix(p, "/")
+	}
+	if host, port, err := net.SplitHostPort(hostPort); err == nil {
+		e.host, e.port = host, port
+	} else {
+		e.host = strings.Trim(hostPort, "[]")
+	}
+	e.host = strings.ToLower(e.host)
+	if e.host == "" {
+		return credentialEntry{}, fmt.Errorf("invalid credential machine %q", c.Machine)
+	}
+	return e, nil
+}
+
+// matches reports whether the entry applies to a request for u.
+func (e credentialEntry) matches(u *url.URL) bool {
+	scheme := strings.ToLower(u.Scheme)
+	if (e.scheme != "" && e.scheme != scheme) || (e.scheme == "" && scheme != "https") {
+		return false
+	}
+	if !strings.EqualFold(u.Hostname(), e.host) {
+		return false
+	}
+	if e.port != "" {
+		port := u.Port()
+		if port == "" {
+			port = map[string]string{"http": "80", "https": "443"}[scheme]
+		}
+		if port != e.port {
+			return false
+		}
+	}
+	if e.path != "" {
+		p := u.Path
+		if p != e.path && !strings.HasPrefix(p, e.path+"/") {
+			return false
+		}
+	}
+	return true
+}
+
+// apply sets the Authorization header of req from the entry.
+func (e credentialEntry) apply(req *http.Request) {
+	if e.token != "" {
+		req.Header.Set("Authorization", "Bearer "+e.token)
+		return
+	}
+	req.SetBasicAuth(e.login, e.password)
+}
+
+// loadCredentials returns the entries of the configured Credentials followed by those of
+// every AuthConf file. Earlier entries win when several match a request.
+func loadCredentials(fsys FileSystem, config HTTPConfig) ([]credentialEntry, error) {
+	var entries []credentialEntry
+	for _, c := range config.Credentials {
+		e, err := newCredentialEntry(c)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	for _, p := range config.AuthConf {
+		files, err := authConfFiles(fsys, p)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			data, err := fsys.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("cannot read auth.conf file: %w", err)
+			}
+			creds, err := parseAuthConf(data)
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse %s: %w", file, err)
+			}
+			for _, c := range creds {
+				e, err := newCredentialEntry(c)
+				if err != nil {
+					return nil, fmt.Errorf("cannot parse %s: %w", file, err)
+				}
+				entries = append(entries, e)
+			}
+		}
+	}
+	return entries, nil
+}
+
+// authConfFiles returns p itself when it is a file or, when it is a directory such as
+// /etc/apt/auth.conf.d, the *.conf files directly inside it in lexical order (as apt
+// reads them).
+func authConfFiles(fsys FileSystem, p string) ([]string, error) {
+	info, err := fsys.Stat(p)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read auth.conf file: %w", err)
+	}
+	if !info.IsDir() {
+		return []string{p}, nil
+	}
+
+	var files []string
+	err = fsys.WalkDir(p, func(walkPath string, de fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !de.IsDir() && filepath.Dir(walkPath) == filepath.Clean(p) && strings.HasSuffix(walkPath, ".conf") {
+			files = append(files, walkPath)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot read auth.conf directory: %w", err)
+	}
+	slices.SortFunc(files, func(a, b string) int { return strings.Compare(path.Base(a), path.Base(b)) })
+	return files, nil
+}
+
+// parseAuthConf parses an apt auth.conf file: a netrc-like list of "machine", "login" and
+// "password" tokens, each followed by its value, which may be spread over several lines.
+// Lines starting with "#" are comments.
+func parseAuthConf(data []byte) ([]Credential, error) {
+	var tokens []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		tokens = append(tokens, strings.Fields(line)...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var creds []Credential
+	for i := 0; i < len(tokens); i += 2 {
+		if i+1 >= len(tokens) {
+			return nil, fmt.Errorf("missing value for %q", tokens[i])
+		}
+		key, value := tokens[i], tokens[i+1]
+		if key == "machine" {
+			creds = append(creds, Credential{Machine: value})
+			continue
+		}
+		if len(creds) == 0 {
+			return nil, fmt.Errorf("%q before the first machine", key)
+		}
+		switch key {
+		case "login":
+			creds[len(creds)-1].Login = value
+		case "password":
+			creds[len(creds)-1].Password = value
+		default:
+			return nil, fmt.Errorf("unknown token %q", key)
+		}
+	}
+	return creds, nil
+}
+
+// authTransport adds credentials to the requests whose URL matches an entry, replacing
+// any credentials embedded in the URL. It runs for every request the client sends,
+// redirects included, and decides from that request's own URL: credentials for one host
+// are never forwarded to a redirect target on another. Requests matching no entry are
+// sent unchanged.
+type authTransport struct {
+	base        http.RoundTripper
+	credentials []credentialEntry
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	i := slices.IndexFunc(t.credentials, func(e credentialEntry) bool { return e.matches(req.URL) })
+	if i < 0 {
+		return t.base.RoundTrip(req)
+	}
+
+	req = req.Clone(req.Context())
+	t.credentials[i].apply(req)
+	return t.base.RoundTrip(req)
+}
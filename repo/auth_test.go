@@ -0,0 +1,149 @@
+package repo
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseAuthConf(t *testing.T) {
+	creds, err := parseAuthConf([]byte(`# Ubuntu Pro
+machine esm.ubuntu.com/apps/ubuntu/ login bearer password s3cret
+machine private-ppa.launchpadcontent.net/acme/tools
+  login alice
+  password hunter2
+`))
+	if err != nil {
+		t.Fatalf("parseAuthConf failed: %v", err)
+	}
+	want := []Credential{
+		{Machine: "esm.ubuntu.com/apps/ubuntu/", Login: "bearer", Password: "s3cret"},
+		{Machine: "private-ppa.launchpadcontent.net/acme/tools", Login: "alice", Password: "hunter2"},
+	}
+	if !reflect.DeepEqual(creds, want) {
+		t.Errorf("parseAuthConf = %+v, want %+v", creds, want)
+	}
+
+	for _, invalid := range []string{"login alice", "machine example.com login", "machine example.com account x"} {
+		if _, err := parseAuthConf([]byte(invalid)); err == nil {
+			t.Errorf("parseAuthConf(%q): expected an error", invalid)
+		}
+	}
+}
+
+func TestCredentialEntry_Matches(t *testing.T) {
+	tests := []struct {
+		machine string
+		url     string
+		want    bool
+	}{
+		{"repo.example.com", "https://repo.example.com/ubuntu/dists/focal/Release", true},
+		{"repo.example.com", "https://REPO.example.com/ubuntu", true},
+		{"repo.example.com", "http://repo.example.com/ubuntu", false}, // https only without a scheme
+		{"http://repo.example.com", "http://repo.example.com/ubuntu", true},
+		{"http://repo.example.com", "https://repo.example.com/ubuntu", false},
+		{"repo.example.com", "https://mirror.repo.example.com/ubuntu", false},
+		{"repo.example.com", "https://repo.example.com.evil.test/ubuntu", false},
+		{"repo.example.com:8443", "https://repo.example.com:8443/ubuntu", true},
+		{"repo.example.com:8443", "https://repo.example.com/ubuntu", false},
+		{"repo.example.com:443", "https://repo.example.com/ubuntu", true},
+		{"repo.example.com/acme/tools", "https://repo.example.com/acme/tools/ubuntu/pool/a.deb", true},
+		{"repo.example.com/acme/tools/", "https://repo.example.com/acme/tools/ubuntu", true},
+		{"repo.example.com/acme/tools", "https://repo.example.com/acme/tools-other/a.deb", false},
+		{"repo.example.com/acme/tools", "https://repo.example.com/acme/other/a.deb", false},
+	}
+	for _, tt := range tests {
+		e, err := newCredentialEntry(Credential{Machine: tt.machine})
+		if err != nil {
+			t.Fatalf("newCredentialEntry(%q) failed: %v", tt.machine, err)
+		}
+		u, _ := url.Parse(tt.url)
+		if got := e.matches(u); got != tt.want {
+			t.Errorf("machine %q matches %s = %v, want %v", tt.machine, tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestLoadCredentials(t *testing.T) {
+	fs := NewMemFileSystem().(*MemFileSystem)
+	_ = fs.MkdirAll("/etc/apt/auth.conf.d/nested", 0o755)
+	writeMemFile(t, fs, "/etc/apt/auth.conf.d/20-b.conf", []byte("machine b.example login b password b\n"))
+	writeMemFile(t, fs, "/etc/apt/auth.conf.d/10-a.conf", []byte("machine a.example login a password a\n"))
+	writeMemFile(t, fs, "/etc/apt/auth.conf.d/README", []byte("not a conf file"))
+	writeMemFile(t, fs, "/etc/apt/auth.conf.d/nested/30-c.conf", []byte("machine c.example login c password c\n"))
+	writeMemFile(t, fs, "/etc/apt/auth.conf", []byte("machine a.example login from-file password x\n"))
+
+	t.Setenv("DITTO_TEST_TOKEN", "tok")
+	entries, err := loadCredentials(fs, HTTPConfig{
+		Credentials: []Credential{{Machine: "a.example", TokenEnv: "DITTO_TEST_TOKEN"}},
+		AuthConf:    []string{"/etc/apt/auth.conf", "/etc/apt/auth.conf.d"},
+	})
+	if err != nil {
+		t.Fatalf("loadCredentials failed: %v", err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.host+"="+e.login+e.token)
+	}
+	want := []string{"a.example=tok", "a.example=from-file", "a.example=a", "b.example=b"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("loaded %v, want %v", got, want)
+	}
+
+	if _, err := loadCredentials(fs, HTTPConfig{AuthConf: []string{"/etc/apt/missing.conf"}}); err == nil {
+		t.Error("expected an error for a missing auth.conf")
+	}
+}
+
+func TestHTTPDownloader_Credentials(t *testing.T) {
+	var leaked atomic.Value
+	leaked.Store("")
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		leaked.Store(r.Header.Get("Authorization"))
+		_, _ = w.Write([]byte("redirected"))
+	}))
+	defer other.Close()
+	// Reach the second server through another host name, as a CDN redirect would.
+	otherURL := strings.Replace(other.URL, "127.0.0.1", "localhost", 1)
+
+	private := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != "alice" || pass != "hunter2" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path == "/ubuntu/pool/big.deb" {
+			http.Redirect(w, r, otherURL+"/cdn/big.deb", http.StatusFound)
+			return
+		}
+		_, _ = w.Write([]byte("private"))
+	}))
+	defer private.Close()
+
+	fs := NewMemFileSystem()
+	downloader := newTestHTTPDownloader(t, fs, HTTPConfig{Credentials: []Credential{
+		{Machine: "http://" + strings.TrimPrefix(private.URL, "http://") + "/ubuntu", Login: "alice", Password: "hunter2"},
+	}})
+
+	if _, err := downloader.DownloadFile(private.URL+"/ubuntu/dists/focal/Release", "/mirror/Release", ""); err != nil {
+		t.Fatalf("authenticated download failed: %v", err)
+	}
+	if _, err := downloader.DownloadFile(private.URL+"/other/Release", "/mirror/Release", ""); err == nil {
+		t.Error("credentials were sent outside the configured path")
+	}
+	if _, err := downloader.DownloadFile(private.URL+"/ubuntu/pool/big.deb", "/mirror/big.deb", ""); err != nil {
+		t.Fatalf("redirected download failed: %v", err)
+	}
+	if got := leaked.Load(); got != "" {
+		t.Errorf("credentials leaked to the redirect target: %q", got)
+	}
+	// Credentials embedded in a URL that matches no entry are still sent.
+	embedded := strings.Replace(private.URL, "http://", "http://alice:hunter2@", 1)
+	if _, err := downloader.DownloadFile(embedded+"/other/Release", "/mirror/Release", ""); err != nil {
+		t.Errorf("download with credentials in the URL failed: %v", err)
+	}
+}
@@ -5,8 +5,11 @@ import (
 	"compress/gzip"
 	"fmt"
 	"path/filepath"
+	"slices"
 	"testing"
 	"time"
+
+	"github.com/ulikunitz/xz"
 )
 
 func TestCleanupOrphanedPackages(t *testing.T) {
@@ -235,3 +238,218 @@ func TestCleanupOrphanedPackages_AllValid(t *testing.T) {
 		t.Error("Expected 'No orphaned packages found.' message in logs")
 	}
 }
+
+func TestCleanupOrphanedPackages_XzIndex(t *testing.T) {
+	fs := NewMemFileSystem().(*MemFileSystem)
+
+	config := DittoConfig{
+		DownloadPath: "/mirror",
+		Logger:       &mockLogger{},
+		FileSystem:   fs,
+		Downloader:   &mockDownloader{},
+	}
+
+	repo := NewDittoRepo(config).(*dittoRepo)
+
+	_ = fs.MkdirAll("/mirror/pool/main/f/foo", 0o755)
+	testData := []byte("test package data")
+	fs.mu.Lock()
+	fs.files["/mirror/pool/main/f/foo/foo_1.0_amd64.deb"] = &memFile{data: testData, mode: 0o644, modTime: time.Now()}
+	fs.files["/mirror/pool/main/f/foo/foo_0.9_amd64.deb"] = &memFile{data: testData, mode: 0o644, modTime: time.Now()}
+	fs.mu.Unlock()
+
+	// The only index for this component is xz-compressed.
+	_ = fs.MkdirAll("/mirror/dists/focal/main/binary-amd64", 0o755)
+	var pkgsBuf bytes.Buffer
+	xzW, err := xz.NewWriter(&pkgsBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = fmt.Fprint(xzW, "Filename: pool/main/f/foo/foo_1.0_amd64.deb\nSHA256: aaaa\nSize: 17\n\n")
+	_ = xzW.Close()
+	fs.mu.Lock()
+	fs.files["/mirror/dists/focal/main/binary-amd64/Packages.xz"] = &memFile{data: pkgsBuf.Bytes(), mode: 0o644, modTime: time.Now()}
+	fs.mu.Unlock()
+
+	if err := repo.cleanupOrphanedPackages(); err != nil {
+		t.Fatalf("cleanupOrphanedPackages failed: %v", err)
+	}
+
+	if _, err := fs.Stat("/mirror/pool/main/f/foo/foo_1.0_amd64.deb"); err != nil {
+		t.Error("package referenced by the xz index was incorrectly removed")
+	}
+	if _, err := fs.Stat("/mirror/pool/main/f/foo/foo_0.9_amd64.deb"); err == nil {
+		t.Error("orphaned package foo_0.9 was not removed")
+	}
+}
+
+func TestCleanupOrphanedPackages_SourceFiles(t *testing.T) {
+	setup := func(t *testing.T, sources bool) (*dittoRepo, *MemFileSystem) {
+		t.Helper()
+		fs := NewMemFileSystem().(*MemFileSystem)
+		_ = fs.MkdirAll("/mirror/pool/main/h/hello", 0o755)
+		_ = fs.MkdirAll("/mirror/dists/focal/main/source", 0o755)
+
+		testData := []byte("test source data")
+		fs.mu.Lock()
+		for _, name := range []string{
+			"hello_2.10-3.dsc", "hello_2.10.orig.tar.gz", "hello_2.10-3.debian.tar.xz",
+			"hello_2.9-1.dsc", "hello_2.9.orig.tar.gz", "hello_2.9.orig.tar.gz.asc", "hello_2.9-1.diff.gz",
+		} {
+			fs.files["/mirror/pool/main/h/hello/"+name] = &memFile{data: testData, mode: 0o644, modTime: time.Now()}
+		}
+		fs.files["/mirror/dists/focal/main/source/Sources"] = &memFile{data: []byte(`Package: hello
+Directory: pool/main/h/hello
+Checksums-Sha256:
+ aaaa 1 hello_2.10-3.dsc
+ bbbb 1 hello_2.10.orig.tar.gz
+ cccc 1 hello_2.10-3.debian.tar.xz
+`), mode: 0o644, modTime: time.Now()}
+		fs.mu.Unlock()
+
+		repo := NewDittoRepo(DittoConfig{
+			DownloadPath: "/mirror",
+			Sources:      sources,
+			Logger:       &mockLogger{},
+			FileSystem:   fs,
+			Downloader:   &mockDownloader{},
+		}).(*dittoRepo)
+		return repo, fs
+	}
+
+	t.Run("removes unreferenced source files when mirroring sources", func(t *testing.T) {
+		repo, fs := setup(t, true)
+		if err := repo.cleanupOrphanedPackages(); err != nil {
+			t.Fatalf("cleanupOrphanedPackages failed: %v", err)
+		}
+		for _, name := range []string{"hello_2.10-3.dsc", "hello_2.10.orig.tar.gz", "hello_2.10-3.debian.tar.xz"} {
+			if _, err := fs.Stat("/mirror/pool/main/h/hello/" + name); err != nil {
+				t.Errorf("referenced source file %s was incorrectly removed", name)
+			}
+		}
+		for _, name := range []string{"hello_2.9-1.dsc", "hello_2.9.orig.tar.gz", "hello_2.9.orig.tar.gz.asc", "hello_2.9-1.diff.gz"} {
+			if _, err := fs.Stat("/mirror/pool/main/h/hello/" + name); err == nil {
+				t.Errorf("orphaned source file %s was not removed", name)
+			}
+		}
+	})
+
+	t.Run("leaves source files alone otherwise", func(t *testing.T) {
+		repo, fs := setup(t, false)
+		if err := repo.cleanupOrphanedPackages(); err != nil {
+			t.Fatalf("cleanupOrphanedPackages failed: %v", err)
+		}
+		if _, err := fs.Stat("/mirror/pool/main/h/hello/hello_2.9-1.dsc"); err != nil {
+			t.Error("source file was removed although Sources is disabled")
+		}
+	})
+}
+
+func TestCleanupOrphanedPackages_Udebs(t *testing.T) {
+	fs := NewMemFileSystem().(*MemFileSystem)
+
+	repo := NewDittoRepo(DittoConfig{
+		DownloadPath: "/mirror",
+		Logger:       &mockLogger{},
+		FileSystem:   fs,
+		Downloader:   &mockDownloader{},
+	}).(*dittoRepo)
+
+	_ = fs.MkdirAll("/mirror/pool/main/d/di-utils", 0o755)
+	_ = fs.MkdirAll("/mirror/dists/focal/main/debian-installer/binary-amd64", 0o755)
+	testData := []byte("test udeb data")
+	fs.mu.Lock()
+	fs.files["/mirror/pool/main/d/di-utils/di-utils_1.1_amd64.udeb"] = &memFile{data: testData, mode: 0o644, modTime: time.Now()}
+	fs.files["/mirror/pool/main/d/di-utils/di-utils_1.0_amd64.udeb"] = &memFile{data: testData, mode: 0o644, modTime: time.Now()}
+	fs.files["/mirror/dists/focal/main/debian-installer/binary-amd64/Packages"] = &memFile{
+		data:    []byte("Filename: pool/main/d/di-utils/di-utils_1.1_amd64.udeb\nSHA256: aaaa\nSize: 14\n\n"),
+		mode:    0o644,
+		modTime: time.Now(),
+	}
+	fs.mu.Unlock()
+
+	if err := repo.cleanupOrphanedPackages(); err != nil {
+		t.Fatalf("cleanupOrphanedPackages failed: %v", err)
+	}
+
+	if _, err := fs.Stat("/mirror/pool/main/d/di-utils/di-utils_1.1_amd64.udeb"); err != nil {
+		t.Error("udeb referenced by the installer index was incorrectly removed")
+	}
+	if _, err := fs.Stat("/mirror/pool/main/d/di-utils/di-utils_1.0_amd64.udeb"); err == nil {
+		t.Error("orphaned udeb was not removed")
+	}
+}
+
+func TestCleanupOrphanedPackages_Flat(t *testing.T) {
+	fs := NewMemFileSystem().(*MemFileSystem)
+
+	repo := NewDittoRepo(DittoConfig{
+		DownloadPath: "/mirror",
+		Flat:         true,
+		Logger:       &mockLogger{},
+		FileSystem:   fs,
+		Downloader:   &mockDownloader{},
+	}).(*dittoRepo)
+
+	_ = fs.MkdirAll("/mirror/stable", 0o755)
+	testData := []byte("test deb data")
+	fs.mu.Lock()
+	fs.files["/mirror/stable/tool_2.0_amd64.deb"] = &memFile{data: testData, mode: 0o644, modTime: time.Now()}
+	fs.files["/mirror/stable/tool_1.0_amd64.deb"] = &memFile{data: testData, mode: 0o644, modTime: time.Now()}
+	fs.files["/mirror/stable/Packages"] = &memFile{
+		data:    []byte("Filename: ./stable/tool_2.0_amd64.deb\nSHA256: aaaa\nSize: 13\n\n"),
+		mode:    0o644,
+		modTime: time.Now(),
+	}
+	fs.mu.Unlock()
+
+	if err := repo.cleanupOrphanedPackages(); err != nil {
+		t.Fatalf("cleanupOrphanedPackages failed: %v", err)
+	}
+
+	if _, err := fs.Stat("/mirror/stable/tool_2.0_amd64.deb"); err != nil {
+		t.Error("package referenced by the flat index was incorrectly removed")
+	}
+	if _, err := fs.Stat("/mirror/stable/tool_1.0_amd64.deb"); err == nil {
+		t.Error("orphaned package was not removed")
+	}
+}
+
+func TestCleanupPartialDownloads(t *testing.T) {
+	fs := NewMemFileSystem().(*MemFileSystem)
+	repo := NewDittoRepo(DittoConfig{
+		DownloadPath: "/mirror",
+		Logger:       &mockLogger{},
+		FileSystem:   fs,
+		Downloader:   &mockDownloader{},
+	}).(*dittoRepo)
+
+	_ = fs.MkdirAll("/mirror/pool/main/f/foo", 0o755)
+	_ = fs.MkdirAll("/mirror/dists/focal/main/binary-amd64", 0o755)
+	partials := []string{
+		"/mirror/pool/main/f/foo/foo_1.0_amd64.deb.tmp",
+		"/mirror/pool/main/f/foo/foo_1.0_amd64.deb.tmp.validator",
+		"/mirror/dists/focal/main/binary-amd64/Packages.gz.tmp",
+	}
+	kept := []string{
+		"/mirror/pool/main/f/foo/foo_1.0_amd64.deb",
+		"/mirror/dists/focal/main/binary-amd64/Packages.gz",
+	}
+	for _, p := range append(slices.Clone(partials), kept...) {
+		writeMemFile(t, fs, p, []byte("data"))
+	}
+
+	if err := repo.cleanupPartialDownloads(); err != nil {
+		t.Fatalf("cleanupPartialDownloads failed: %v", err)
+	}
+	for _, p := range partials {
+		if _, err := fs.Stat(p); err == nil {
+			t.Errorf("partial download %s was not removed", p)
+		}
+	}
+	for _, p := range kept {
+		if _, err := fs.Stat(p); err != nil {
+			t.Errorf("%s was removed: %v", p, err)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/canonical/ditto-repo/deb822"
+)
+
+// defaultDependencyFields are the relationship fields followed when DependencyFields is
+// not set: the ones a package cannot be installed without.
+var defaultDependencyFields = []string{"Pre-Depends", "Depends"}
+
+// closureEntry holds what dependency resolution needs from a single Packages stanza.
+type closureEntry struct {
+	name     string
+	provides []string
+	groups   [][]string // dependency groups, each a list of alternatives
+}
+
+// resolveDependencyClosure parses the Packages indices in indexPaths (other index types are
+// ignored) and stores the names of SeedPackages and every package they transitively depend
+// on in d.dependencyClosure. Resolution is by name only: versions and architectures are not
+// considered, so the closure may be slightly larger than what apt would install. For each
+// dependency the first alternative that exists is followed; a virtual package resolves to
+// the real package of that name if there is one, and otherwise to all of its providers.
+func (d *dittoRepo) resolveDependencyClosure(ctx context.Context, indexPaths []string) error {
+	fields := d.config.DependencyFields
+	if len(fields) == 0 {
+		fields = defaultDependencyFields
+	}
+
+	packagesIndices := slices.DeleteFunc(slices.Clone(indexPaths), func(p string) bool {
+		stem, _ := splitCompressionExt(path.Base(p))
+		return stem != "Packages"
+	})
+
+	deps := make(map[string][][]string) // groups of every version/architecture of a package
+	providers := make(map[string][]string)
+	err := d.forEachIndex(ctx, packagesIndices, func(localIndexPath string) error {
+		// Collect the whole index first so that a variant failing halfway through does not
+		// leave partial data behind when falling back to the next one.
+		var entries []closureEntry
+		err := d.forEachStanza(localIndexPath, func(stanza deb822.Stanza) error {
+			entry := closureEntry{name: stanza.Get("Package")}
+			if entry.name == "" {
+				return nil
+			}
+			for _, group := range parseRelations(stanza.Get("Provides")) {
+				entry.provides = append(entry.provides, group...)
+			}
+			for _, field := range fields {
+				entry.groups = append(entry.groups, parseRelations(stanza.Get(field))...)
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, e := range entries {
+			// Assigning even an empty list records that the package exists.
+			deps[e.name] = append(deps[e.name], e.groups...)
+			for _, virtual := range e.provides {
+				if !slices.Contains(providers[virtual], e.name) {
+					providers[virtual] = append(providers[virtual], e.name)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// resolve returns the real packages that satisfy a dependency on name.
+	resolve := func(name string) []string {
+		if _, ok := deps[name]; ok {
+			return []string{name}
+		}
+		return providers[name]
+	}
+
+	closure := make(map[string]bool)
+	var queue []string
+	add := func(names []string) {
+		for _, n := range names {
+			if !closure[n] {
+				closure[n] = true
+				queue = append(queue, n)
+			}
+		}
+	}
+
+	for _, seed := range d.config.SeedPackages {
+		resolved := resolve(seed)
+		if len(resolved) == 0 {
+			d.logger.Warn(fmt.Sprintf("Seed package %s not found in any index", seed))
+		}
+		add(resolved)
+	}
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		for _, group := range deps[name] {
+			for _, alt := range group {
+				if resolved := resolve(alt); len(resolved) > 0 {
+					add(resolved)
+					break
+				}
+			}
+		}
+	}
+
+	d.logger.Info(fmt.Sprintf("Resolved dependency closure of %d seed package(s): %d packages", len(d.config.SeedPackages), len(closure)))
+	d.dependencyClosure = closure
+	return nil
+}
+
+// inDependencyClosure reports whether the package described by stanza is part of the
+// resolved dependency closure. Every package is when no closure has been resolved.
+func (d *dittoRepo) inDependencyClosure(stanza deb822.Stanza) bool {
+	return d.dependencyClosure == nil || d.dependencyClosure[stanza.Get("Package")]
+}
+
+// parseRelations splits a relationship field such as Depends ("a (>= 1.0) | b, c:any
+// [amd64] <!nocheck>") into groups of alternative package names, dropping version
+// constraints, architecture qualifiers and restrictions.
+func parseRelations(value string) [][]string {
+	var groups [][]string
+	for _, group := range strings.Split(deb822.Folded(value), ",") {
+		var alts []string
+		for _, alt := range strings.Split(group, "|") {
+			name := strings.TrimSpace(alt)
+			if i := strings.IndexAny(name, " ([<"); i >= 0 {
+				name = name[:i]
+			}
+			name, _, _ = strings.Cut(name, ":")
+			if name != "" {
+				alts = append(alts, name)
+			}
+		}
+		if len(alts) > 0 {
+			groups = append(groups, alts)
+		}
+	}
+	return groups
+}
@@ -0,0 +1,301 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+const closurePackages = `Package: app
+Pre-Depends: init-system
+Depends: libfoo (>= 1.0), mail-transport-agent | sendmail, missing-pkg | libbar:any
+Recommends: docs
+Filename: pool/main/a/app/app_1_amd64.deb
+SHA256: 01
+
+Package: libfoo
+Depends: libc6 (>= 2.34) [amd64], libc6-compat <!nocheck>
+Filename: pool/main/libf/libfoo/libfoo_1_amd64.deb
+SHA256: 02
+
+Package: libc6
+Filename: pool/main/g/glibc/libc6_2.35_amd64.deb
+SHA256: 03
+
+Package: libc6-compat
+Filename: pool/main/g/glibc/libc6-compat_2.35_amd64.deb
+SHA256: 04
+
+Package: postfix
+Provides: mail-transport-agent
+Filename: pool/main/p/postfix/postfix_3_amd64.deb
+SHA256: 05
+
+Package: exim4
+Provides: mail-transport-agent (= 4)
+Filename: pool/main/e/exim4/exim4_4_amd64.deb
+SHA256: 06
+
+Package: sendmail
+Filename: pool/main/s/sendmail/sendmail_8_amd64.deb
+SHA256: 07
+
+Package: libbar
+Filename: pool/main/libb/libbar/libbar_1_amd64.deb
+SHA256: 08
+
+Package: systemd
+Provides: init-system
+Filename: pool/main/s/systemd/systemd_1_amd64.deb
+SHA256: 09
+
+Package: docs
+Filename: pool/main/d/docs/docs_1_all.deb
+SHA256: 10
+
+Package: unrelated
+Filename: pool/main/u/unrelated/unrelated_1_amd64.deb
+SHA256: 11
+`
+
+func newClosureTestRepo(t *testing.T, config DittoConfig) (*dittoRepo, *MemFileSystem) {
+	t.Helper()
+	memFS := NewMemFileSystem().(*MemFileSystem)
+	_ = memFS.MkdirAll("/mirror/dists/focal/main/binary-amd64", 0o755)
+	memFS.mu.Lock()
+	memFS.files["/mirror/dists/focal/main/binary-amd64/Packages"] = &memFile{data: []byte(closurePackages), mode: 0o644, modTime: time.Now()}
+	memFS.mu.Unlock()
+
+	config.Dists = []string{"focal"}
+	config.DownloadPath = "/mirror"
+	config.Logger = &mockLogger{}
+	config.FileSystem = memFS
+	config.Downloader = &mockDownloader{}
+	return NewDittoRepo(config).(*dittoRepo), memFS
+}
+
+func TestResolveDependencyClosure(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields []string
+		want   []string
+	}{
+		{
+			name: "default fields",
+			// mail-transport-agent is virtual: both providers are included. missing-pkg
+			// does not exist, so its alternative libbar is followed instead.
+			want: []string{"app", "exim4", "libbar", "libc6", "libc6-compat", "libfoo", "postfix", "systemd"},
+		},
+		{
+			name:   "with Recommends",
+			fields: []string{"Pre-Depends", "Depends", "Recommends"},
+			want:   []string{"app", "docs", "exim4", "libbar", "libc6", "libc6-compat", "libfoo", "postfix", "systemd"},
+		},
+		{
+			name:   "Depends only",
+			fields: []string{"Depends"},
+			want:   []string{"app", "exim4", "libbar", "libc6", "libc6-compat", "libfoo", "postfix"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo, _ := newClosureTestRepo(t, DittoConfig{
+				SeedPackages:     []string{"app", "not-in-archive"},
+				DependencyFields: tt.fields,
+			})
+			err := repo.resolveDependencyClosure(context.Background(), []string{
+				"/mirror/dists/focal/main/binary-amd64/Packages",
+				"/mirror/dists/focal/main/i18n/Translation-en",
+			})
+			if err != nil {
+				t.Fatalf("resolveDependencyClosure failed: %v", err)
+			}
+
+			var got []string
+			for name := range repo.dependencyClosure {
+				got = append(got, name)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("closure = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractDebsFromIndex_DependencyClosure(t *testing.T) {
+	repo, _ := newClosureTestRepo(t, DittoConfig{SeedPackages: []string{"libfoo"}})
+	const index = "/mirror/dists/focal/main/binary-amd64/Packages"
+	if err := repo.resolveDependencyClosure(context.Background(), []string{index}); err != nil {
+		t.Fatalf("resolveDependencyClosure failed: %v", err)
+	}
+
+	debs, err := repo.extractDebsFromIndex(index)
+	if err != nil {
+		t.Fatalf("extractDebsFromIndex failed: %v", err)
+	}
+	var got []string
+	for _, deb := range debs {
+		got = append(got, deb.Path)
+	}
+	want := []string{
+		"pool/main/libf/libfoo/libfoo_1_amd64.deb",
+		"pool/main/g/glibc/libc6_2.35_amd64.deb",
+		"pool/main/g/glibc/libc6-compat_2.35_amd64.deb",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("extractDebsFromIndex = %v, want %v", got, want)
+	}
+}
+
+func TestMirror_DependencyClosure(t *testing.T) {
+	// The mock downloader does not write files, so the index is pre-seeded.
+	releaseContent := fmt.Sprintf(`Origin: Ubuntu
+SHA256:
+ e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855 %8d main/binary-amd64/Packages
+`, len(closurePackages))
+	md := &mockDownloader{}
+	memFS := NewMemFileSystem().(*MemFileSystem)
+	_ = memFS.MkdirAll("/mirror/dists/focal/main/binary-amd64", 0o755)
+	memFS.mu.Lock()
+	memFS.files["/mirror/dists/focal/Release"] = &memFile{data: []byte(releaseContent), mode: 0o644, modTime: time.Now()}
+	memFS.files["/mirror/dists/focal/main/binary-amd64/Packages"] = &memFile{data: []byte(closurePackages), mode: 0o644, modTime: time.Now()}
+	memFS.mu.Unlock()
+
+	repo := NewDittoRepo(DittoConfig{
+		RepoURL:      "http://example.com/ubuntu",
+		Dists:        []string{"focal"},
+		Components:   []string{"main"},
+		Archs:        []string{"amd64"},
+		DownloadPath: "/mirror",
+		SeedPackages: []string{"libfoo"},
+		Logger:       &mockLogger{},
+		FileSystem:   memFS,
+		Downloader:   md,
+	})
+	progress, errChan := repo.MirrorWithErrors(context.Background())
+	for range progress {
+	}
+	if err := <-errChan; err != nil {
+		t.Fatalf("Mirror failed: %v", err)
+	}
+
+	var pool []string
+	for _, url := range md.downloads {
+		if strings.Contains(url, "/pool/") && !slices.Contains(pool, url) {
+			pool = append(pool, url)
+		}
+	}
+	sort.Strings(pool)
+	want := []string{
+		"http://example.com/ubuntu/pool/main/g/glibc/libc6-compat_2.35_amd64.deb",
+		"http://example.com/ubuntu/pool/main/g/glibc/libc6_2.35_amd64.deb",
+		"http://example.com/ubuntu/pool/main/libf/libfoo/libfoo_1_amd64.deb",
+	}
+	if !reflect.DeepEqual(pool, want) {
+		t.Errorf("downloaded pool files = %v, want %v", pool, want)
+	}
+}
+
+// upstreamDownloader serves files from an in-memory upstream into the mirror's file system,
+// switching to the next upstream once a Release file has been downloaded switchAfter times.
+type upstreamDownloader struct {
+	fs          FileSystem
+	upstreams   []map[string]string // URL to content
+	switchAfter int
+	releases    int
+	downloads   []string
+}
+
+func (d *upstreamDownloader) DownloadFile(urlStr string, dest string, expectedSHA256 string) (string, error) {
+	d.downloads = append(d.downloads, urlStr)
+	if strings.HasSuffix(urlStr, "/Release") {
+		d.releases++
+	}
+	upstream := d.upstreams[0]
+	if d.releases > d.switchAfter {
+		upstream = d.upstreams[1]
+	}
+	content, ok := upstream[urlStr]
+	if !ok {
+		if strings.Contains(urlStr, "/pool/") {
+			return expectedSHA256, nil
+		}
+		return "", fmt.Errorf("404 Not Found: %s", urlStr)
+	}
+	if err := d.fs.MkdirAll(path.Dir(dest), 0o755); err != nil {
+		return "", err
+	}
+	f, err := d.fs.Create(dest)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.WriteString(f, content); err != nil {
+		_ = f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return sha256Hex([]byte(content)), nil
+}
+
+func TestMirror_DependencyClosureResync(t *testing.T) {
+	const base = "http://example.com/ubuntu/dists/focal/"
+	upstream := func(packages string) map[string]string {
+		return map[string]string{
+			base + "Release": fmt.Sprintf("Origin: Ubuntu\nSHA256:\n %s %d main/binary-amd64/Packages\n",
+				sha256Hex([]byte(packages)), len(packages)),
+			base + "main/binary-amd64/Packages": packages,
+		}
+	}
+	before := "Package: libfoo\nFilename: pool/main/libf/libfoo/libfoo_1_amd64.deb\nSHA256: 01\n\n" +
+		"Package: libbar\nFilename: pool/main/libb/libbar/libbar_1_amd64.deb\nSHA256: 02\n"
+	// Upstream changes during the sync: libfoo now depends on libbar.
+	after := "Package: libfoo\nDepends: libbar\nFilename: pool/main/libf/libfoo/libfoo_2_amd64.deb\nSHA256: 03\n\n" +
+		"Package: libbar\nFilename: pool/main/libb/libbar/libbar_1_amd64.deb\nSHA256: 02\n"
+
+	memFS := NewMemFileSystem()
+	md := &upstreamDownloader{fs: memFS, upstreams: []map[string]string{upstream(before), upstream(after)}, switchAfter: 1}
+	repo := NewDittoRepo(DittoConfig{
+		RepoURL:      "http://example.com/ubuntu",
+		Dists:        []string{"focal"},
+		Components:   []string{"main"},
+		Archs:        []string{"amd64"},
+		DownloadPath: "/mirror",
+		SeedPackages: []string{"libfoo"},
+		Logger:       &mockLogger{},
+		FileSystem:   memFS,
+		Downloader:   md,
+	})
+	progress, errChan := repo.MirrorWithErrors(context.Background())
+	for range progress {
+	}
+	if err := <-errChan; err != nil {
+		t.Fatalf("Mirror failed: %v", err)
+	}
+
+	var pool []string
+	for _, url := range md.downloads {
+		if strings.Contains(url, "/pool/") && !slices.Contains(pool, url) {
+			pool = append(pool, url)
+		}
+	}
+	sort.Strings(pool)
+	want := []string{
+		"http://example.com/ubuntu/pool/main/libb/libbar/libbar_1_amd64.deb",
+		"http://example.com/ubuntu/pool/main/libf/libfoo/libfoo_1_amd64.deb",
+		"http://example.com/ubuntu/pool/main/libf/libfoo/libfoo_2_amd64.deb",
+	}
+	if !reflect.DeepEqual(pool, want) {
+		t.Errorf("downloaded pool files = %v, want %v", pool, want)
+	}
+}
@@ -0,0 +1,64 @@
+package repo
+
+import (
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+)
+
+// indexCompressionExts lists the compression extensions used for repository indices, in
+// the order variants of the same index are preferred for parsing: cheapest to decompress
+// first. An uncompressed variant (no extension) is preferred over all of them.
+var indexCompressionExts = []string{".gz", ".zst", ".lz4", ".xz", ".bz2"}
+
+// splitCompressionExt splits a known compression extension off p, returning the stem and
+// the extension. The extension is empty when p is not compressed with a known format.
+func splitCompressionExt(p string) (stem, ext string) {
+	for _, ext := range indexCompressionExts {
+		if strings.HasSuffix(p, ext) {
+			return strings.TrimSuffix(p, ext), ext
+		}
+	}
+	return p, ""
+}
+
+// compressionRank orders index variants for parsing: lower is preferred.
+func compressionRank(p string) int {
+	_, ext := splitCompressionExt(p)
+	return slices.Index(indexCompressionExts, ext) + 1 // uncompressed ("") ranks 0
+}
+
+// decompressReader wraps r with the decompressor matching the compression extension of
+// name. Names without a known compression extension are read as-is. The returned
+// ReadCloser must be closed by the caller; closing it does not close r.
+func decompressReader(r io.Reader, name string) (io.ReadCloser, error) {
+	_, ext := splitCompressionExt(name)
+	switch ext {
+	case ".gz":
+		return gzip.NewReader(r)
+	case ".xz":
+		xzReader, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(xzReader), nil
+	case ".bz2":
+		return io.NopCloser(bzip2.NewReader(r)), nil
+	case ".zst":
+		zstdReader, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zstdReader.IOReadCloser(), nil
+	case ".lz4":
+		return io.NopCloser(lz4.NewReader(r)), nil
+	default:
+		return io.NopCloser(r), nil
+	}
+}
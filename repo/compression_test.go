@@ -0,0 +1,139 @@
+package repo
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ulikunitz/xz"
+)
+
+func TestDecompressReader(t *testing.T) {
+	want, err := os.ReadFile("testdata/Packages")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gzBuf, xzBuf bytes.Buffer
+	gzW := gzip.NewWriter(&gzBuf)
+	_, _ = gzW.Write(want)
+	gzW.Close()
+	xzW, err := xz.NewWriter(&xzBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = xzW.Write(want)
+	xzW.Close()
+
+	inputs := map[string][]byte{
+		"Packages":    want,
+		"Packages.gz": gzBuf.Bytes(),
+		"Packages.xz": xzBuf.Bytes(),
+	}
+	// bzip2, zstd and lz4 fixtures are produced by the reference CLI tools; the lz4 one
+	// uses 64KB linked blocks with block checksums.
+	for _, name := range []string{"Packages.bz2", "Packages.zst", "Packages.lz4"} {
+		data, err := os.ReadFile("testdata/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inputs[name] = data
+	}
+
+	for name, data := range inputs {
+		t.Run(name, func(t *testing.T) {
+			r, err := decompressReader(bytes.NewReader(data), name)
+			if err != nil {
+				t.Fatalf("decompressReader failed: %v", err)
+			}
+			defer r.Close()
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("read failed: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("decompressed %d bytes, want %d bytes of original content", len(got), len(want))
+			}
+		})
+	}
+}
+
+func TestParseReleaseFile_Compressions(t *testing.T) {
+	releaseContent := `SHA256:
+ 0000000000000000000000000000000000000000000000000000000000000001     1000 main/binary-amd64/Packages
+ 0000000000000000000000000000000000000000000000000000000000000002      200 main/binary-amd64/Packages.zst
+ 0000000000000000000000000000000000000000000000000000000000000003      210 main/binary-amd64/Packages.lz4
+ 0000000000000000000000000000000000000000000000000000000000000004      190 main/binary-amd64/Packages.bz2
+ 0000000000000000000000000000000000000000000000000000000000000005     1000 universe/binary-amd64/Packages
+ 0000000000000000000000000000000000000000000000000000000000000006      100 main/binary-amd64/Release
+`
+	repo := newTestRepo(t, DittoConfig{
+		Components: []string{"main", "universe"},
+		Archs:      []string{"amd64"},
+	}, &mockDownloader{})
+
+	entries, err := repo.parseReleaseFile(releaseContent)
+	if err != nil {
+		t.Fatalf("parseReleaseFile failed: %v", err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Path)
+	}
+	// The uncompressed main index has compressed siblings and is dropped; the universe one
+	// is the only variant published and is kept.
+	want := []string{
+		"main/binary-amd64/Packages.zst",
+		"main/binary-amd64/Packages.lz4",
+		"main/binary-amd64/Packages.bz2",
+		"universe/binary-amd64/Packages",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("parseReleaseFile = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("entry %d: got %s, want %s", i, got[i], want[i])
+		}
+	}
+}
+
+func TestExtractDebsFromIndices_PrefersCheapestVariant(t *testing.T) {
+	memFS := NewMemFileSystem().(*MemFileSystem)
+	_ = memFS.MkdirAll("/mirror/dists/focal/main/binary-amd64", 0o755)
+	_ = memFS.MkdirAll("/mirror/dists/focal/main/binary-i386", 0o755)
+
+	plain := "Filename: pool/main/a/a/a_1_amd64.deb\nSHA256: aaaa\nSize: 1\n\n"
+	bz2, err := os.ReadFile("testdata/Packages.bz2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	memFS.mu.Lock()
+	// A corrupt gz variant must fall back to the next variant of the same stem.
+	memFS.files["/mirror/dists/focal/main/binary-amd64/Packages.gz"] = &memFile{data: []byte("not gzip"), mode: 0o644, modTime: time.Now()}
+	memFS.files["/mirror/dists/focal/main/binary-amd64/Packages.bz2"] = &memFile{data: bz2, mode: 0o644, modTime: time.Now()}
+	// A different index, published uncompressed only.
+	memFS.files["/mirror/dists/focal/main/binary-i386/Packages"] = &memFile{data: []byte(plain), mode: 0o644, modTime: time.Now()}
+	memFS.mu.Unlock()
+
+	repo := NewDittoRepo(DittoConfig{Logger: &mockLogger{}, FileSystem: memFS, Downloader: &mockDownloader{}}).(*dittoRepo)
+
+	debs, err := repo.extractPoolFilesFromIndices(context.Background(), []string{
+		"/mirror/dists/focal/main/binary-amd64/Packages.bz2",
+		"/mirror/dists/focal/main/binary-amd64/Packages.gz",
+		"/mirror/dists/focal/main/binary-i386/Packages",
+		"/mirror/dists/focal/main/i18n/Translation-en.gz",
+	})
+	if err != nil {
+		t.Fatalf("extractPoolFilesFromIndices failed: %v", err)
+	}
+	// 250 packages from the bz2 fixture plus one from the uncompressed i386 index.
+	if len(debs) != 251 {
+		t.Errorf("expected 251 packages, got %d", len(debs))
+	}
+}
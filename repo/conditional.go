@@ -0,0 +1,186 @@
+package repo
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"sync"
+)
+
+// cachedResponse describes the last full response received for a URL: its validators and
+// the SHA256 and local path of the body that was saved.
+type cachedResponse struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last-modified,omitempty"`
+	SHA256       string `json:"sha256"`
+	Path         string `json:"path"`
+}
+
+// validatorCache remembers a cachedResponse per URL so that files can be fetched again
+// with conditional requests (If-None-Match, If-Modified-Since). It is kept in memory and,
+// when path is set, persisted there through fs so that later runs benefit too. Persisting
+// is best-effort: the cache only saves requests, so an unreadable or unwritable file
+// merely disables it across runs.
+type validatorCache struct {
+	fs   FileSystem
+	path string
+
+	mu      sync.Mutex
+	entries map[string]cachedResponse
+}
+
+// loadValidatorCache returns the cache persisted at p, or an empty one.
+func loadValidatorCache(fs FileSystem, p string) *validatorCache {
+	c := &validatorCache{fs: fs, path: p, entries: make(map[string]cachedResponse)}
+	if p == "" {
+		return c
+	}
+	if data, err := fs.ReadFile(p); err == nil {
+		_ = json.Unmarshal(data, &c.entries)
+	}
+	return c
+}
+
+func (c *validatorCache) get(urlStr string) (cachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[urlStr]
+	return entry, ok
+}
+
+// record stores the validators of header for urlStr, whose body was saved to p with the
+// given hash. A response without validators cannot be revalidated and removes the entry.
+func (c *validatorCache) record(urlStr string, header http.Header, hash, p string) {
+	entry := cachedResponse{
+		ETag:         header.Get("ETag"),
+		LastModified: header.Get("Last-Modified"),
+		SHA256:       hash,
+		Path:         p,
+	}
+	if entry.ETag == "" && entry.LastModified == "" {
+		c.remove(urlStr)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries[urlStr] == entry {
+		return
+	}
+	c.entries[urlStr] = entry
+	c.save()
+}
+
+func (c *validatorCache) remove(urlStr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[urlStr]; !ok {
+		return
+	}
+	delete(c.entries, urlStr)
+	c.save()
+}
+
+// copies returns the local paths that held a body with the given hash when they were
+// saved: entry's own path first, then those saved for other URLs (such as the same
+// Release file served by another mirror).
+func (c *validatorCache) copies(entry cachedResponse) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	paths := []string{entry.Path}
+	var others []string
+	for _, e := range c.entries {
+		if e.SHA256 == entry.SHA256 && e.Path != entry.Path {
+			others = append(others, e.Path)
+		}
+	}
+	sort.Strings(others)
+	return append(paths, others...)
+}
+
+// save writes the cache to its path atomically. It must be called with mu held.
+func (c *validatorCache) save() {
+	if c.path == "" {
+		return
+	}
+	data, err := json.MarshalIndent(c.entries, "", "  ")
+	if err != nil {
+		return
+	}
+	if err := c.fs.MkdirAll(path.Dir(c.path), 0o755); err != nil {
+		return
+	}
+	tmpPath := c.path + ".tmp"
+	f, err := c.fs.Create(tmpPath)
+	if err != nil {
+		return
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return
+	}
+	if err := f.Close(); err != nil {
+		return
+	}
+	_ = c.fs.Rename(tmpPath, c.path)
+}
+
+// conditionalHeader returns the headers asking the server to answer 304 Not Modified if
+// the file still matches entry.
+func conditionalHeader(entry cachedResponse) http.Header {
+	header := http.Header{}
+	if entry.ETag != "" {
+		header.Set("If-None-Match", entry.ETag)
+	}
+	if entry.LastModified != "" {
+		header.Set("If-Modified-Since", entry.LastModified)
+	}
+	return header
+}
+
+// reuseUnmodified makes destPath hold the body described by entry after the server has
+// reported it unchanged, copying it from the first local copy that still has its hash. It
+// returns false when no such copy is left.
+func (h *HTTPDownloader) reuseUnmodified(entry cachedResponse, destPath string) (string, bool) {
+	for _, p := range h.validators.copies(entry) {
+		hasher := sha256.New()
+		if err := h.hashFile(p, hasher); err != nil || hex.EncodeToString(hasher.Sum(nil)) != entry.SHA256 {
+			continue
+		}
+		if p == destPath {
+			return entry.SHA256, true
+		}
+		if err := h.copyFile(p, destPath); err != nil {
+			continue
+		}
+		return entry.SHA256, true
+	}
+	return "", false
+}
+
+// copyFile copies src to dest through a temporary file renamed into place.
+func (h *HTTPDownloader) copyFile(src, dest string) error {
+	in, err := h.fs.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmpPath := dest + ".tmp"
+	out, err := h.fs.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		_ = h.fs.Remove(tmpPath)
+		return fmt.Errorf("cannot copy %s: %w", src, err)
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return h.fs.Rename(tmpPath, dest)
+}
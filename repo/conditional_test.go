@@ -0,0 +1,172 @@
+package repo
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// releaseServer serves a Release file whose content and ETag can be changed, counting the
+// full and 304 responses it sends.
+type releaseServer struct {
+	mu          sync.Mutex
+	content     string
+	etag        string
+	full        int
+	notModified int
+	conditional []string // If-None-Match of every request
+}
+
+func (s *releaseServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conditional = append(s.conditional, r.Header.Get("If-None-Match"))
+	if r.Header.Get("If-None-Match") == s.etag {
+		s.notModified++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	s.full++
+	w.Header().Set("ETag", s.etag)
+	w.Header().Set("Last-Modified", time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC).Format(http.TimeFormat))
+	_, _ = w.Write([]byte(s.content))
+}
+
+func (s *releaseServer) counts() (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.full, s.notModified
+}
+
+func TestHTTPDownloader_ConditionalRequests(t *testing.T) {
+	upstream := &releaseServer{content: "Suite: focal\n", etag: `"r1"`}
+	srv := httptest.NewServer(upstream)
+	defer srv.Close()
+	releaseURL := srv.URL + "/dists/focal/Release"
+	sum := sha256.Sum256([]byte(upstream.content))
+	wantHash := hex.EncodeToString(sum[:])
+
+	fs := NewMemFileSystem().(*MemFileSystem)
+	downloader := newTestHTTPDownloader(t, fs, HTTPConfig{ValidatorCache: "/mirror/.ditto-validators.json"})
+	download := func(dest string) string {
+		t.Helper()
+		hash, err := downloader.DownloadFile(releaseURL, dest, "")
+		if err != nil {
+			t.Fatalf("DownloadFile(%s) failed: %v", dest, err)
+		}
+		return hash
+	}
+	expectCounts := func(full, notModified int) {
+		t.Helper()
+		if gotFull, gotNotModified := upstream.counts(); gotFull != full || gotNotModified != notModified {
+			t.Errorf("server sent %d full and %d 304 responses, want %d and %d", gotFull, gotNotModified, full, notModified)
+		}
+	}
+
+	if hash := download("/mirror/dists/focal/Release"); hash != wantHash {
+		t.Errorf("hash = %s, want %s", hash, wantHash)
+	}
+	expectCounts(1, 0)
+
+	// Unchanged: the local copy is kept.
+	if hash := download("/mirror/dists/focal/Release"); hash != wantHash {
+		t.Errorf("hash after 304 = %s, want %s", hash, wantHash)
+	}
+	expectCounts(1, 1)
+
+	// Unchanged, to a scratch path (as isDistributionFresh does): the local copy is reused,
+	// and the cache keeps pointing at it.
+	hash, _, err := downloadFileThrottled(context.Background(), downloader, releaseURL, "/mirror/dists/focal/Release.check", "", downloadOptions{scratch: true})
+	if err != nil || hash != wantHash {
+		t.Errorf("scratch download = %s, %v; want %s", hash, err, wantHash)
+	}
+	if data, _ := fs.ReadFile("/mirror/dists/focal/Release.check"); string(data) != upstream.content {
+		t.Errorf("Release.check = %q, want the local copy", data)
+	}
+	if cached, _ := downloader.(*HTTPDownloader).validators.get(releaseURL); cached.Path != "/mirror/dists/focal/Release" {
+		t.Errorf("validator cache points at %q after a scratch download", cached.Path)
+	}
+	expectCounts(1, 2)
+
+	// The local copy was modified: it cannot stand in for the upstream file any more.
+	writeMemFile(t, fs, "/mirror/dists/focal/Release", []byte("Suite: tampered\n"))
+	_ = fs.Remove("/mirror/dists/focal/Release.check")
+	download("/mirror/dists/focal/Release")
+	if data, _ := fs.ReadFile("/mirror/dists/focal/Release"); string(data) != upstream.content {
+		t.Errorf("Release = %q after refetch", data)
+	}
+	expectCounts(2, 3)
+
+	// Changed upstream.
+	upstream.mu.Lock()
+	upstream.content, upstream.etag = "Suite: focal\nVersion: 2\n", `"r2"`
+	upstream.mu.Unlock()
+	download("/mirror/dists/focal/Release")
+	if data, _ := fs.ReadFile("/mirror/dists/focal/Release"); !strings.Contains(string(data), "Version: 2") {
+		t.Errorf("Release = %q, want the new upstream file", data)
+	}
+	expectCounts(3, 3)
+
+	// The validators survive the downloader, so the next run starts with a conditional request.
+	next := newTestHTTPDownloader(t, fs, HTTPConfig{ValidatorCache: "/mirror/.ditto-validators.json"})
+	if _, err := next.DownloadFile(releaseURL, "/mirror/dists/focal/Release", ""); err != nil {
+		t.Fatalf("DownloadFile failed: %v", err)
+	}
+	expectCounts(3, 4)
+}
+
+func TestHTTPDownloader_ConditionalRequestsAcrossMirrors(t *testing.T) {
+	a := &releaseServer{content: "Suite: focal\n", etag: `"a1"`}
+	b := &releaseServer{content: "Suite: focal\n", etag: `"b1"`}
+	srvA, srvB := httptest.NewServer(a), httptest.NewServer(b)
+	defer srvA.Close()
+	defer srvB.Close()
+
+	fs := NewMemFileSystem()
+	downloader := newTestHTTPDownloader(t, fs, HTTPConfig{})
+	fetch := func(base, dest string) {
+		t.Helper()
+		if _, err := downloader.DownloadFile(base+"/dists/focal/Release", dest, ""); err != nil {
+			t.Fatalf("DownloadFile failed: %v", err)
+		}
+	}
+
+	// As validateMirrorConsistency does: the second mirror's copy is only a temporary file.
+	fetch(srvA.URL, "/mirror/dists/focal/Release")
+	fetch(srvB.URL, "/mirror/dists/focal/Release.validate")
+	_ = fs.Remove("/mirror/dists/focal/Release.validate")
+
+	// Its 304 is satisfied by the identical file fetched from the first mirror.
+	fetch(srvB.URL, "/mirror/dists/focal/Release.validate")
+	if full, notModified := b.counts(); full != 1 || notModified != 1 {
+		t.Errorf("second mirror sent %d full and %d 304 responses, want 1 and 1", full, notModified)
+	}
+	if data, _ := fs.ReadFile("/mirror/dists/focal/Release.validate"); string(data) != b.content {
+		t.Errorf("Release.validate = %q", data)
+	}
+}
+
+func TestHTTPDownloader_NoConditionalRequestsWithChecksum(t *testing.T) {
+	upstream := &releaseServer{content: "Package: hello\n", etag: `"p1"`}
+	srv := httptest.NewServer(upstream)
+	defer srv.Close()
+	sum := sha256.Sum256([]byte(upstream.content))
+
+	downloader := newTestHTTPDownloader(t, NewMemFileSystem(), HTTPConfig{})
+	for range 2 {
+		if _, err := downloader.DownloadFile(srv.URL+"/dists/focal/main/binary-amd64/Packages", "/mirror/Packages", hex.EncodeToString(sum[:])); err != nil {
+			t.Fatalf("DownloadFile failed: %v", err)
+		}
+	}
+	for _, inm := range upstream.conditional {
+		if inm != "" {
+			t.Errorf("index requested with If-None-Match %q", inm)
+		}
+	}
+}
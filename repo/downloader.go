@@ -1,62 +1,290 @@
 package repo
 
 import (
+	"context"
 	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
 	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+const (
+	defaultConnectTimeout = Duration(30 * time.Second)
+	defaultReadTimeout    = Duration(60 * time.Second)
+	defaultUserAgent      = "ditto-repo"
+)
+
+// HTTPStatusError is returned by HTTPDownloader when the server answers with a status
+// other than 200 OK.
+type HTTPStatusError struct {
+	StatusCode int
+	// RetryAfter is the delay requested by the server's Retry-After header, if any.
+	RetryAfter time.Duration
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("status %d", e.StatusCode)
+}
+
 // HTTPDownloader implements the Downloader interface using HTTP.
 type HTTPDownloader struct {
-	fs FileSystem
+	fs          FileSystem
+	client      *http.Client
+	userAgent   string
+	readTimeout time.Duration
+	// limiter throttles response bodies (nil when no rate limit is configured).
+	limiter *bandwidthLimiter
+	// validators holds the validators of files fetched without a known checksum.
+	validators *validatorCache
 }
 
-// NewHTTPDownloader creates a new HTTP-based downloader.
-func NewHTTPDownloader(fs FileSystem) Downloader {
+// NewHTTPDownloader creates a new HTTP-based downloader using the given client settings.
+// Unset timeouts and User-Agent take their defaults. The CA bundle, client certificate and
+// auth.conf files, if any, are read through fs; an error is returned if they cannot be
+// loaded.
+func NewHTTPDownloader(fs FileSystem, config HTTPConfig) (Downloader, error) {
+	if config.ConnectTimeout <= 0 {
+		config.ConnectTimeout = defaultConnectTimeout
+	}
+	if config.ReadTimeout <= 0 {
+		config.ReadTimeout = defaultReadTimeout
+	}
+	if config.UserAgent == "" {
+		config.UserAgent = defaultUserAgent
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{Timeout: time.Duration(config.ConnectTimeout), KeepAlive: 30 * time.Second}
+	transport.DialContext = dialer.DialContext
+	transport.TLSHandshakeTimeout = time.Duration(config.ConnectTimeout)
+	transport.ResponseHeaderTimeout = time.Duration(config.ReadTimeout)
+
+	if config.Proxy != "" {
+		proxyURL, err := url.Parse(config.Proxy)
+		if err != nil || proxyURL.Host == "" {
+			return nil, fmt.Errorf("invalid proxy URL %q", config.Proxy)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	tlsConfig, err := loadTLSConfig(fs, config)
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	credentials, err := loadCredentials(fs, config)
+	if err != nil {
+		return nil, err
+	}
+	var roundTripper http.RoundTripper = transport
+	if len(credentials) > 0 {
+		roundTripper = &authTransport{base: transport, credentials: credentials}
+	}
+
+	limiter, err := newBandwidthLimiter(config)
+	if err != nil {
+		return nil, err
+	}
+
 	return &HTTPDownloader{
 		fs: fs,
+		client: &http.Client{
+			Transport: roundTripper,
+			Timeout:   time.Duration(config.Timeout),
+		},
+		userAgent:   config.UserAgent,
+		readTimeout: time.Duration(config.ReadTimeout),
+		limiter:     limiter,
+		validators:  loadValidatorCache(fs, config.ValidatorCache),
+	}, nil
+}
+
+// loadTLSConfig builds the TLS settings for config: the system roots plus CABundle, and
+// the client certificate, if configured.
+func loadTLSConfig(fs FileSystem, config HTTPConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if config.CABundle != "" {
+		pem, err := fs.ReadFile(config.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read CA bundle: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("cannot load CA bundle %s: no PEM certificates found", config.CABundle)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if (config.ClientCert == "") != (config.ClientKey == "") {
+		return nil, errors.New("client-cert and client-key must be set together")
 	}
+	if config.ClientCert != "" {
+		certPEM, err := fs.ReadFile(config.ClientCert)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read client certificate: %w", err)
+		}
+		keyPEM, err := fs.ReadFile(config.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read client key: %w", err)
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
 }
 
 // DownloadFile fetches a URL to a local path with atomic writing and checksum verification.
-// It returns the calculated SHA256 on success.
+// It returns the calculated SHA256 on success. A non-200 response is reported as an
+// *HTTPStatusError; network errors are wrapped so callers can tell transient failures
+// (see isRetryableError) from permanent ones.
+//
+// The file is downloaded to "<destPath>.tmp" and only renamed into place once complete and
+// verified. When a download is interrupted, the partial file is kept together with the URL
+// and validator (strong ETag or Last-Modified) of the response it came from, and the next
+// attempt from the same URL, even in a later run, resumes it with a Range request guarded
+// by If-Range. If the server does not support ranges or the file has changed, it answers
+// with the whole file and the download starts over. A partial file is never resumed from
+// another URL, such as another mirror, whose Last-Modified dates cannot be compared.
+// Resuming requires a FileSystem implementing AppendFileSystem.
+//
+// Files downloaded without an expected checksum (Release files and their signatures,
+// whose content cannot be known in advance) are requested conditionally once they have
+// been fetched: the ETag and Last-Modified of the last response are sent back, and on 304
+// Not Modified the local copy is reused, provided it still has the hash recorded for it.
 func (h *HTTPDownloader) DownloadFile(urlStr string, destPath string, expectedSHA256 string) (string, error) {
+	hash, _, err := h.downloadFileThrottled(context.Background(), urlStr, destPath, expectedSHA256, downloadOptions{})
+	return hash, err
+}
+
+// downloadFileThrottled is DownloadFile with opts, also reporting how long the body was
+// held back by the rate limits. Cancelling ctx aborts the download, including a wait for
+// the rate limits.
+func (h *HTTPDownloader) downloadFileThrottled(ctx context.Context, urlStr string, destPath string, expectedSHA256 string, opts downloadOptions) (string, time.Duration, error) {
+	var throttled time.Duration
+	hash, err := h.download(ctx, urlStr, destPath, expectedSHA256, opts, &throttled)
+	return hash, throttled, err
+}
+
+// download implements DownloadFile, adding the time spent waiting for the rate limiter to
+// throttled.
+func (h *HTTPDownloader) download(ctx context.Context, urlStr string, destPath string, expectedSHA256 string, opts downloadOptions, throttled *time.Duration) (string, error) {
 	// 1. Ensure the directory structure exists
 	if err := h.fs.MkdirAll(path.Dir(destPath), 0o755); err != nil {
 		return "", fmt.Errorf("mkdir failed: %v", err)
 	}
 
-	// 2. Create a temporary file to avoid corrupting the destination until success
-	// We append ".tmp" to the filename
+	// 2. Look for a partial download to resume. The temporary file avoids corrupting the
+	// destination until success.
 	tmpPath := destPath + ".tmp"
-	out, err := h.fs.Create(tmpPath)
+	validatorPath := tmpPath + ".validator"
+	offset, validator := h.partialDownload(urlStr, tmpPath, validatorPath)
+
+	// 3. Perform the HTTP Request. The request is cancelled if the body stalls for longer
+	// than the read timeout. A file fetched without a known checksum (a Release file or
+	// its signature) is only transferred if it changed since it was last fetched.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	header := http.Header{}
+	cached, conditional := cachedResponse{}, false
+	if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		header.Set("If-Range", validator)
+	} else if expectedSHA256 == "" {
+		if cached, conditional = h.validators.get(urlStr); conditional {
+			header = conditionalHeader(cached)
+		}
+	}
+	resp, err := h.get(ctx, urlStr, header)
 	if err != nil {
-		return "", fmt.Errorf("failed to create temp file: %v", err)
+		return "", err
 	}
-	defer out.Close()
+	defer func() { resp.Body.Close() }()
 
-	// 3. Perform the HTTP Request
-	resp, err := http.Get(urlStr)
-	if err != nil {
-		return "", fmt.Errorf("http error: %v", err)
+	if conditional && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		if hash, ok := h.reuseUnmodified(cached, destPath); ok {
+			return hash, nil
+		}
+		// No local copy of the unchanged file is left: fetch it again.
+		if !opts.scratch {
+			h.validators.remove(urlStr)
+		}
+		if resp, err = h.get(ctx, urlStr, nil); err != nil {
+			return "", err
+		}
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("status %d", resp.StatusCode)
+	if offset > 0 && (resp.StatusCode == http.StatusRequestedRangeNotSatisfiable ||
+		resp.StatusCode == http.StatusPartialContent && contentRangeStart(resp.Header.Get("Content-Range")) != offset) {
+		// The partial file does not fit the file on the server (it may have shrunk): start
+		// over with a full download.
+		resp.Body.Close()
+		h.discardPartial(tmpPath, validatorPath)
+		offset = 0
+		if resp, err = h.get(ctx, urlStr, nil); err != nil {
+			return "", err
+		}
 	}
 
 	// 4. Set up hashing while downloading (Streaming)
 	// We write to both the file ('out') and the sha256 calculator ('hasher') simultaneously.
 	hasher := sha256.New()
+	var out io.WriteCloser
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		// Resuming: hash the part we already have, then append the rest to it.
+		if err := h.hashFile(tmpPath, hasher); err != nil {
+			return "", fmt.Errorf("cannot read partial download: %w", err)
+		}
+		out, err = h.fs.(AppendFileSystem).OpenAppend(tmpPath)
+		if err != nil {
+			return "", fmt.Errorf("failed to open temp file: %v", err)
+		}
+	case resp.StatusCode == http.StatusOK:
+		out, err = h.fs.Create(tmpPath)
+		if err != nil {
+			return "", fmt.Errorf("failed to create temp file: %v", err)
+		}
+		h.saveValidator(urlStr, validatorPath, resp.Header)
+	default:
+		return "", &HTTPStatusError{
+			StatusCode: resp.StatusCode,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+	}
+	defer out.Close()
 	multiWriter := io.MultiWriter(out, hasher)
 
-	// 5. Copy the data
-	if _, err := io.Copy(multiWriter, resp.Body); err != nil {
-		return "", fmt.Errorf("copy failed: %v", err)
+	// 5. Copy the data. On failure the partial file is kept for the next attempt.
+	body := newIdleTimeoutReader(resp.Body, h.readTimeout, cancel)
+	defer body.stop()
+	var src io.Reader = body
+	if h.limiter != nil {
+		// Per-host limits apply to the upstream host asked for, even when it redirects.
+		u, _ := url.Parse(urlStr)
+		src = &rateLimitedReader{ctx: ctx, r: body, limiter: h.limiter, host: u.Hostname(), throttled: throttled}
+	}
+	if _, err := io.Copy(multiWriter, src); err != nil {
+		return "", fmt.Errorf("copy failed: %w", err)
 	}
 
 	// 6. Verify Checksum (if provided)
@@ -64,7 +292,8 @@ func (h *HTTPDownloader) DownloadFile(urlStr string, destPath string, expectedSH
 
 	if expectedSHA256 != "" && calculatedHash != expectedSHA256 {
 		// Clean up the garbage file
-		_ = h.fs.Remove(tmpPath)
+		out.Close()
+		h.discardPartial(tmpPath, validatorPath)
 		return "", fmt.Errorf("checksum mismatch!\nExpected: %s\nActual:   %s", expectedSHA256, calculatedHash)
 	}
 
@@ -74,5 +303,155 @@ func (h *HTTPDownloader) DownloadFile(urlStr string, destPath string, expectedSH
 	if err := h.fs.Rename(tmpPath, destPath); err != nil {
 		return "", fmt.Errorf("rename failed: %v", err)
 	}
+	_ = h.fs.Remove(validatorPath)
+	if expectedSHA256 == "" && !opts.scratch {
+		h.validators.record(urlStr, resp.Header, calculatedHash, destPath)
+	}
 	return calculatedHash, nil
 }
+
+// get sends a GET request for urlStr with the given extra headers.
+func (h *HTTPDownloader) get(ctx context.Context, urlStr string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, urlStr, nil)
+	if err != nil {
+		return nil, fmt.Errorf("http error: %w", err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("User-Agent", h.userAgent)
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("http error: %w", err)
+	}
+	return resp, nil
+}
+
+// partialDownload returns the size of the partial download at tmpPath and the validator
+// saved for it, or zero when there is nothing that can be resumed from urlStr.
+func (h *HTTPDownloader) partialDownload(urlStr, tmpPath, validatorPath string) (int64, string) {
+	if _, ok := h.fs.(AppendFileSystem); !ok {
+		return 0, ""
+	}
+	info, err := h.fs.Stat(tmpPath)
+	if err != nil || info.Size() == 0 {
+		return 0, ""
+	}
+	data, err := h.fs.ReadFile(validatorPath)
+	if err != nil {
+		return 0, ""
+	}
+	source, validator, _ := strings.Cut(string(data), "\n")
+	validator = strings.TrimSpace(validator)
+	if source != urlStr || validator == "" {
+		return 0, ""
+	}
+	return info.Size(), validator
+}
+
+// saveValidator records the URL and validator of a full response so that the download can
+// be resumed from the same URL if it is interrupted: its ETag if it is strong (weak ones
+// cannot be used with If-Range), otherwise its Last-Modified date. Without either, a
+// partial download cannot be safely resumed and any stale validator is removed.
+func (h *HTTPDownloader) saveValidator(urlStr, validatorPath string, header http.Header) {
+	validator := header.Get("ETag")
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		validator = header.Get("Last-Modified")
+	}
+	if validator == "" {
+		_ = h.fs.Remove(validatorPath)
+		return
+	}
+	f, err := h.fs.Create(validatorPath)
+	if err != nil {
+		return
+	}
+	_, _ = f.Write([]byte(urlStr + "\n" + validator))
+	_ = f.Close()
+}
+
+// discardPartial removes a partial download and its validator.
+func (h *HTTPDownloader) discardPartial(tmpPath, validatorPath string) {
+	_ = h.fs.Remove(tmpPath)
+	_ = h.fs.Remove(validatorPath)
+}
+
+// hashFile writes the content of the file at p to w.
+func (h *HTTPDownloader) hashFile(p string, w io.Writer) error {
+	f, err := h.fs.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// contentRangeStart returns the first byte position of a Content-Range header such as
+// "bytes 100-999/1000", or -1 if it cannot be parsed.
+func contentRangeStart(contentRange string) int64 {
+	rest, ok := strings.CutPrefix(contentRange, "bytes ")
+	if !ok {
+		return -1
+	}
+	first, _, ok := strings.Cut(rest, "-")
+	if !ok {
+		return -1
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(first), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// errReadTimeout is returned when a response body makes no progress within the read
+// timeout. It is a net.Error reporting a timeout, so the download is retried.
+var errReadTimeout error = &readTimeoutError{}
+
+type readTimeoutError struct{}
+
+func (*readTimeoutError) Error() string   { return "read timeout: no data received" }
+func (*readTimeoutError) Timeout() bool   { return true }
+func (*readTimeoutError) Temporary() bool { return true }
+
+// idleTimeoutReader cancels a request whose body does not deliver any data for longer
+// than timeout, and reports errReadTimeout instead of the cancellation error. Only the
+// time spent inside Read counts, so a reader throttled between reads is not timed out.
+type idleTimeoutReader struct {
+	r       io.Reader
+	timeout time.Duration
+	timer   *time.Timer
+
+	mu      sync.Mutex
+	expired bool
+}
+
+func newIdleTimeoutReader(r io.Reader, timeout time.Duration, cancel context.CancelFunc) *idleTimeoutReader {
+	ir := &idleTimeoutReader{r: r, timeout: timeout}
+	ir.timer = time.AfterFunc(timeout, func() {
+		ir.mu.Lock()
+		ir.expired = true
+		ir.mu.Unlock()
+		cancel()
+	})
+	return ir
+}
+
+func (ir *idleTimeoutReader) Read(p []byte) (int, error) {
+	ir.timer.Reset(ir.timeout)
+	n, err := ir.r.Read(p)
+	ir.timer.Stop()
+	ir.mu.Lock()
+	expired := ir.expired
+	ir.mu.Unlock()
+	if expired {
+		return n, errReadTimeout
+	}
+	return n, err
+}
+
+// stop releases the timer once the body has been read.
+func (ir *idleTimeoutReader) stop() {
+	ir.timer.Stop()
+}
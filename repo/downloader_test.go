@@ -0,0 +1,384 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestHTTPDownloader(t *testing.T, fs FileSystem, config HTTPConfig) Downloader {
+	t.Helper()
+	downloader, err := NewHTTPDownloader(fs, config)
+	if err != nil {
+		t.Fatalf("NewHTTPDownloader failed: %v", err)
+	}
+	return downloader
+}
+
+// writeMemFile stores data at p in fs.
+func writeMemFile(t *testing.T, fs *MemFileSystem, p string, data []byte) {
+	t.Helper()
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.files[p] = &memFile{data: data, mode: 0o600, modTime: time.Now()}
+}
+
+func TestHTTPDownloader_StatusError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "7")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	downloader := newTestHTTPDownloader(t, NewMemFileSystem(), HTTPConfig{})
+	_, err := downloader.DownloadFile(srv.URL+"/dists/focal/Release", "/mirror/dists/focal/Release", "")
+	var statusErr *HTTPStatusError
+	if !errors.As(err, &statusErr) {
+		t.Fatalf("expected an *HTTPStatusError, got %v", err)
+	}
+	if statusErr.StatusCode != http.StatusTooManyRequests || statusErr.RetryAfter != 7*time.Second {
+		t.Errorf("got %+v, want status 429 with Retry-After 7s", statusErr)
+	}
+}
+
+func TestHTTPDownloader_RetriedByFailover(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		_, _ = w.Write([]byte("Origin: Ubuntu\n"))
+	}))
+	defer srv.Close()
+
+	fs := NewMemFileSystem()
+	repo := NewDittoRepo(DittoConfig{
+		RepoURLs:     []string{srv.URL},
+		DownloadPath: "/mirror",
+		RetryBackoff: Duration(time.Millisecond),
+		Logger:       &mockLogger{},
+		FileSystem:   fs,
+	}).(*dittoRepo)
+
+	if _, err := repo.downloadWithFailover(context.Background(), "dists/focal/Release", "/mirror/dists/focal/Release", ""); err != nil {
+		t.Fatalf("expected the transient 502 to be retried, got %v", err)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("server received %d requests, want 2", got)
+	}
+	if data, err := fs.ReadFile("/mirror/dists/focal/Release"); err != nil || string(data) != "Origin: Ubuntu\n" {
+		t.Errorf("downloaded file = %q, %v", data, err)
+	}
+}
+
+func TestHTTPDownloader_UserAgent(t *testing.T) {
+	var got atomic.Value
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got.Store(r.UserAgent())
+	}))
+	defer srv.Close()
+
+	fs := NewMemFileSystem()
+	if _, err := newTestHTTPDownloader(t, fs, HTTPConfig{}).DownloadFile(srv.URL+"/a", "/mirror/a", ""); err != nil {
+		t.Fatal(err)
+	}
+	if got.Load() != defaultUserAgent {
+		t.Errorf("default User-Agent = %q, want %q", got.Load(), defaultUserAgent)
+	}
+	if _, err := newTestHTTPDownloader(t, fs, HTTPConfig{UserAgent: "acme-mirror/1.0"}).DownloadFile(srv.URL+"/a", "/mirror/a", ""); err != nil {
+		t.Fatal(err)
+	}
+	if got.Load() != "acme-mirror/1.0" {
+		t.Errorf("User-Agent = %q, want acme-mirror/1.0", got.Load())
+	}
+}
+
+func TestHTTPDownloader_ReadTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1000")
+		_, _ = w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		<-release // stall mid-body
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	downloader := newTestHTTPDownloader(t, NewMemFileSystem(), HTTPConfig{ReadTimeout: Duration(50 * time.Millisecond)})
+	start := time.Now()
+	_, err := downloader.DownloadFile(srv.URL+"/pool/big.deb", "/mirror/pool/big.deb", "")
+	if err == nil {
+		t.Fatal("expected a stalled body to time out")
+	}
+	if !isRetryableError(err) {
+		t.Errorf("read timeout should be retryable, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("read timeout took %v", time.Since(start))
+	}
+}
+
+func TestHTTPDownloader_Proxy(t *testing.T) {
+	var requested atomic.Value
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested.Store(r.URL.String())
+		_, _ = w.Write([]byte("via proxy"))
+	}))
+	defer proxy.Close()
+
+	fs := NewMemFileSystem()
+	downloader := newTestHTTPDownloader(t, fs, HTTPConfig{Proxy: proxy.URL})
+	if _, err := downloader.DownloadFile("http://archive.example/ubuntu/dists/focal/Release", "/mirror/Release", ""); err != nil {
+		t.Fatalf("download through proxy failed: %v", err)
+	}
+	if got := requested.Load(); got != "http://archive.example/ubuntu/dists/focal/Release" {
+		t.Errorf("proxy received %v", got)
+	}
+}
+
+// newClientCertificate returns a self-signed client certificate and its key, PEM-encoded.
+func newClientCertificate(t *testing.T) (certPEM, keyPEM []byte, cert *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ditto test client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, cert
+}
+
+func TestHTTPDownloader_PrivateCAAndClientCertificate(t *testing.T) {
+	certPEM, keyPEM, clientCert := newClientCertificate(t)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("internal"))
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	srv.StartTLS()
+	defer srv.Close()
+
+	fs := NewMemFileSystem().(*MemFileSystem)
+	writeMemFile(t, fs, "/etc/ditto/ca.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}))
+	writeMemFile(t, fs, "/etc/ditto/client.pem", certPEM)
+	writeMemFile(t, fs, "/etc/ditto/client.key", keyPEM)
+
+	tests := []struct {
+		name    string
+		config  HTTPConfig
+		wantErr bool
+	}{
+		{"untrusted CA", HTTPConfig{ClientCert: "/etc/ditto/client.pem", ClientKey: "/etc/ditto/client.key"}, true},
+		{"no client certificate", HTTPConfig{CABundle: "/etc/ditto/ca.pem"}, true},
+		{"CA bundle and client certificate", HTTPConfig{CABundle: "/etc/ditto/ca.pem", ClientCert: "/etc/ditto/client.pem", ClientKey: "/etc/ditto/client.key"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			downloader := newTestHTTPDownloader(t, fs, tt.config)
+			_, err := downloader.DownloadFile(srv.URL+"/dists/focal/Release", "/mirror/Release", "")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("DownloadFile error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewHTTPDownloader_Invalid(t *testing.T) {
+	fs := NewMemFileSystem().(*MemFileSystem)
+	writeMemFile(t, fs, "/etc/ditto/not-a-ca.pem", []byte("hello"))
+
+	for name, config := range map[string]HTTPConfig{
+		"missing CA bundle":  {CABundle: "/etc/ditto/missing.pem"},
+		"empty CA bundle":    {CABundle: "/etc/ditto/not-a-ca.pem"},
+		"cert without key":   {ClientCert: "/etc/ditto/client.pem"},
+		"invalid proxy":      {Proxy: "://proxy"},
+		"missing client key": {ClientCert: "/etc/ditto/not-a-ca.pem", ClientKey: "/etc/ditto/missing.key"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := NewHTTPDownloader(fs, config); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+
+	// NewDittoRepo cannot fail, so an invalid configuration is reported by Mirror.
+	repo := NewDittoRepo(DittoConfig{
+		RepoURLs:   []string{"http://example.com/ubuntu"},
+		Dists:      []string{"focal"},
+		HTTP:       HTTPConfig{CABundle: "/etc/ditto/missing.pem"},
+		Logger:     &mockLogger{},
+		FileSystem: fs,
+	})
+	_, errChan := repo.MirrorWithErrors(context.Background())
+	if err := <-errChan; err == nil {
+		t.Error("expected Mirror to fail with an invalid HTTP configuration")
+	}
+}
+
+func TestHTTPDownloader_Resume(t *testing.T) {
+	content := bytes.Repeat([]byte("linux-firmware "), 4096)
+	sum := sha256.Sum256(content)
+	wantHash := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name string
+		// partial and validator are left behind by an earlier, interrupted attempt, from
+		// another mirror when otherMirror is set.
+		partial     []byte
+		validator   string
+		otherMirror bool
+		etag        string
+		wantRange   string
+	}{
+		{"resumes from the partial file", content[:1000], `"v1"`, false, `"v1"`, "bytes=1000-"},
+		{"restarts when the file changed", []byte("stale prefix"), `"v0"`, false, `"v1"`, "bytes=12-"},
+		{"restarts when the partial file is too long", append(slices.Clone(content), "junk"...), `"v1"`, false, `"v1"`, "bytes=" + strconv.Itoa(len(content)+4) + "-"},
+		{"restarts without a validator", content[:1000], "", false, `"v1"`, ""},
+		{"restarts when the partial file came from another mirror", content[:1000], `"v1"`, true, `"v1"`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ranges []string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ranges = append(ranges, r.Header.Get("Range"))
+				w.Header().Set("ETag", tt.etag)
+				http.ServeContent(w, r, "firmware.deb", time.Time{}, bytes.NewReader(content))
+			}))
+			defer srv.Close()
+
+			fs := NewMemFileSystem().(*MemFileSystem)
+			_ = fs.MkdirAll("/mirror/pool", 0o755)
+			writeMemFile(t, fs, "/mirror/pool/firmware.deb.tmp", tt.partial)
+			source := srv.URL + "/pool/firmware.deb"
+			if tt.otherMirror {
+				source = "http://mirror.example.com/pool/firmware.deb"
+			}
+			if tt.validator != "" {
+				writeMemFile(t, fs, "/mirror/pool/firmware.deb.tmp.validator", []byte(source+"\n"+tt.validator))
+			}
+
+			hash, err := newTestHTTPDownloader(t, fs, HTTPConfig{}).DownloadFile(srv.URL+"/pool/firmware.deb", "/mirror/pool/firmware.deb", wantHash)
+			if err != nil {
+				t.Fatalf("DownloadFile failed: %v", err)
+			}
+			if hash != wantHash {
+				t.Errorf("hash = %s, want %s", hash, wantHash)
+			}
+			if data, _ := fs.ReadFile("/mirror/pool/firmware.deb"); !bytes.Equal(data, content) {
+				t.Errorf("downloaded file has %d bytes, want the %d bytes of the original", len(data), len(content))
+			}
+			if ranges[0] != tt.wantRange {
+				t.Errorf("first request Range = %q, want %q", ranges[0], tt.wantRange)
+			}
+			for _, leftover := range []string{"/mirror/pool/firmware.deb.tmp", "/mirror/pool/firmware.deb.tmp.validator"} {
+				if _, err := fs.Stat(leftover); err == nil {
+					t.Errorf("%s left behind", leftover)
+				}
+			}
+		})
+	}
+}
+
+func TestHTTPDownloader_KeepsPartialOnFailure(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 10000)
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		if requests.Add(1) == 1 {
+			// Drop the connection halfway through the body.
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			_, _ = w.Write(content[:4000])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		if got := r.Header.Get("Range"); got != "bytes=4000-" {
+			t.Errorf("retry Range = %q, want bytes=4000-", got)
+		}
+		http.ServeContent(w, r, "big.deb", time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC), bytes.NewReader(content))
+	}))
+	defer srv.Close()
+
+	fs := NewMemFileSystem()
+	downloader := newTestHTTPDownloader(t, fs, HTTPConfig{})
+	_, err := downloader.DownloadFile(srv.URL+"/pool/big.deb", "/mirror/pool/big.deb", "")
+	if err == nil || !isRetryableError(err) {
+		t.Fatalf("expected a retryable error for the dropped connection, got %v", err)
+	}
+	if info, err := fs.Stat("/mirror/pool/big.deb.tmp"); err != nil || info.Size() != 4000 {
+		t.Fatalf("partial file not kept: %v", err)
+	}
+
+	if _, err := downloader.DownloadFile(srv.URL+"/pool/big.deb", "/mirror/pool/big.deb", ""); err != nil {
+		t.Fatalf("resumed download failed: %v", err)
+	}
+	if data, _ := fs.ReadFile("/mirror/pool/big.deb"); !bytes.Equal(data, content) {
+		t.Errorf("resumed file has %d bytes, want %d", len(data), len(content))
+	}
+}
+
+func TestHTTPDownloader_NoResumeWithoutAppend(t *testing.T) {
+	var gotRange string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotRange = r.Header.Get("Range")
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "a.deb", time.Time{}, strings.NewReader("complete"))
+	}))
+	defer srv.Close()
+
+	memFS := NewMemFileSystem().(*MemFileSystem)
+	writeMemFile(t, memFS, "/mirror/a.deb.tmp", []byte("comp"))
+	writeMemFile(t, memFS, "/mirror/a.deb.tmp.validator", []byte(srv.URL+"/a.deb\n"+`"v1"`))
+	// Hide OpenAppend: only the FileSystem methods are visible to the downloader.
+	fs := struct{ FileSystem }{memFS}
+
+	if _, err := newTestHTTPDownloader(t, fs, HTTPConfig{}).DownloadFile(srv.URL+"/a.deb", "/mirror/a.deb", ""); err != nil {
+		t.Fatalf("DownloadFile failed: %v", err)
+	}
+	if gotRange != "" {
+		t.Errorf("Range %q sent although the file system cannot append", gotRange)
+	}
+	if data, _ := memFS.ReadFile("/mirror/a.deb"); string(data) != "complete" {
+		t.Errorf("downloaded %q", data)
+	}
+}
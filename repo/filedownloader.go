@@ -0,0 +1,124 @@
+package repo
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// FileDownloader implements the Downloader interface for repositories reachable on a local
+// or mounted filesystem (an NFS export, a USB drive), given as file:// URLs or plain paths.
+// It offers the same guarantees as HTTPDownloader: files are copied to a temporary file,
+// verified, and only then renamed into place.
+type FileDownloader struct {
+	source FileSystem
+	fs     FileSystem
+}
+
+// NewFileDownloader creates a downloader copying files read through source to destinations
+// written through fs.
+func NewFileDownloader(source, fs FileSystem) Downloader {
+	return &FileDownloader{source: source, fs: fs}
+}
+
+// DownloadFile copies the file at urlStr, a file:// URL or a path, to destPath, returning
+// its SHA256. A missing source file is reported with an error wrapping fs.ErrNotExist.
+func (f *FileDownloader) DownloadFile(urlStr string, destPath string, expectedSHA256 string) (string, error) {
+	srcPath, err := localPath(urlStr)
+	if err != nil {
+		return "", err
+	}
+	src, err := f.source.Open(srcPath)
+	if err != nil {
+		return "", fmt.Errorf("cannot open %s: %w", srcPath, err)
+	}
+	defer src.Close()
+
+	if err := f.fs.MkdirAll(path.Dir(destPath), 0o755); err != nil {
+		return "", fmt.Errorf("mkdir failed: %v", err)
+	}
+	tmpPath := destPath + ".tmp"
+	out, err := f.fs.Create(tmpPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp file: %v", err)
+	}
+	defer out.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, hasher), src); err != nil {
+		out.Close()
+		_ = f.fs.Remove(tmpPath)
+		return "", fmt.Errorf("copy failed: %w", err)
+	}
+
+	calculatedHash := hex.EncodeToString(hasher.Sum(nil))
+	if expectedSHA256 != "" && calculatedHash != expectedSHA256 {
+		out.Close()
+		_ = f.fs.Remove(tmpPath)
+		return "", fmt.Errorf("checksum mismatch!\nExpected: %s\nActual:   %s", expectedSHA256, calculatedHash)
+	}
+
+	if err := out.Close(); err != nil {
+		_ = f.fs.Remove(tmpPath)
+		return "", fmt.Errorf("cannot write %s: %v", tmpPath, err)
+	}
+	if err := f.fs.Rename(tmpPath, destPath); err != nil {
+		return "", fmt.Errorf("rename failed: %v", err)
+	}
+	return calculatedHash, nil
+}
+
+// isLocalURL reports whether a repository URL designates a local directory: a file:// URL
+// or a plain absolute or relative ("./", "../") path.
+func isLocalURL(urlStr string) bool {
+	return strings.HasPrefix(urlStr, "file:") ||
+		strings.HasPrefix(urlStr, "/") ||
+		strings.HasPrefix(urlStr, "./") ||
+		strings.HasPrefix(urlStr, "../")
+}
+
+// localPath returns the path designated by a file:// URL or a plain path. Only URLs
+// without a host, or with "localhost", are local.
+func localPath(urlStr string) (string, error) {
+	if !strings.HasPrefix(urlStr, "file:") {
+		return urlStr, nil
+	}
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return "", fmt.Errorf("invalid file URL %q: %w", urlStr, err)
+	}
+	if u.Host != "" && u.Host != "localhost" {
+		return "", fmt.Errorf("invalid file URL %q: remote host %q", urlStr, u.Host)
+	}
+	if u.Path == "" {
+		return "", fmt.Errorf("invalid file URL %q: no path", urlStr)
+	}
+	return u.Path, nil
+}
+
+// schemeDownloader sends the URLs of local repositories (see isLocalURL) to local and
+// every other URL to remote, so that RepoURLs can mix both.
+type schemeDownloader struct {
+	local  Downloader
+	remote Downloader
+}
+
+func (s *schemeDownloader) DownloadFile(urlStr string, destPath string, expectedSHA256 string) (string, error) {
+	if isLocalURL(urlStr) {
+		return s.local.DownloadFile(urlStr, destPath, expectedSHA256)
+	}
+	return s.remote.DownloadFile(urlStr, destPath, expectedSHA256)
+}
+
+func (s *schemeDownloader) downloadFileThrottled(ctx context.Context, urlStr string, destPath string, expectedSHA256 string, opts downloadOptions) (string, time.Duration, error) {
+	if isLocalURL(urlStr) {
+		return downloadFileThrottled(ctx, s.local, urlStr, destPath, expectedSHA256, opts)
+	}
+	return downloadFileThrottled(ctx, s.remote, urlStr, destPath, expectedSHA256, opts)
+}
@@ -0,0 +1,98 @@
+package repo
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileDownloader(t *testing.T) {
+	source := NewMemFileSystem().(*MemFileSystem)
+	_ = source.MkdirAll("/srv/ubuntu/dists/focal", 0o755)
+	writeMemFile(t, source, "/srv/ubuntu/dists/focal/Release", []byte("Suite: focal\n"))
+	sum := sha256.Sum256([]byte("Suite: focal\n"))
+	wantHash := hex.EncodeToString(sum[:])
+
+	dest := NewMemFileSystem()
+	downloader := NewFileDownloader(source, dest)
+
+	for _, u := range []string{
+		"file:///srv/ubuntu/dists/focal/Release",
+		"file://localhost/srv/ubuntu/dists/focal/Release",
+		"/srv/ubuntu/dists/focal/Release",
+	} {
+		_ = dest.Remove("/mirror/dists/focal/Release")
+		hash, err := downloader.DownloadFile(u, "/mirror/dists/focal/Release", wantHash)
+		if err != nil {
+			t.Fatalf("DownloadFile(%s) failed: %v", u, err)
+		}
+		if hash != wantHash {
+			t.Errorf("DownloadFile(%s) = %s, want %s", u, hash, wantHash)
+		}
+		if data, _ := dest.ReadFile("/mirror/dists/focal/Release"); string(data) != "Suite: focal\n" {
+			t.Errorf("DownloadFile(%s) copied %q", u, data)
+		}
+	}
+
+	_ = dest.Remove("/mirror/dists/focal/Release")
+	if _, err := downloader.DownloadFile("/srv/ubuntu/dists/focal/Release", "/mirror/dists/focal/Release", "bad"); err == nil {
+		t.Error("expected a checksum mismatch")
+	}
+	for _, leftover := range []string{"/mirror/dists/focal/Release", "/mirror/dists/focal/Release.tmp"} {
+		if _, err := dest.Stat(leftover); err == nil {
+			t.Errorf("%s left behind after a checksum mismatch", leftover)
+		}
+	}
+
+	_, err := downloader.DownloadFile("file:///srv/ubuntu/dists/jammy/Release", "/mirror/dists/jammy/Release", "")
+	if !errors.Is(err, fs.ErrNotExist) || isRetryableError(err) {
+		t.Errorf("expected a permanent not-exist error for a missing file, got %v", err)
+	}
+	if _, err := downloader.DownloadFile("file://nas.example/srv/ubuntu/dists/focal/Release", "/mirror/Release", ""); err == nil {
+		t.Error("expected an error for a file URL with a remote host")
+	}
+}
+
+func TestSchemeDownloader(t *testing.T) {
+	local, remote := &mockDownloader{}, &mockDownloader{}
+	downloader := &schemeDownloader{local: local, remote: remote}
+	for _, u := range []string{"file:///srv/ubuntu/Release", "/srv/ubuntu/Release", "./ubuntu/Release", "http://archive.ubuntu.com/ubuntu/Release", "https://ports.ubuntu.com/Release"} {
+		if _, err := downloader.DownloadFile(u, "/mirror/Release", ""); err != nil {
+			t.Fatalf("DownloadFile(%s) failed: %v", u, err)
+		}
+	}
+	if len(local.downloads) != 3 || len(remote.downloads) != 2 {
+		t.Errorf("local got %v, remote got %v", local.downloads, remote.downloads)
+	}
+}
+
+func TestDownloadWithFailover_LocalRepository(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "dists", "focal"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "dists", "focal", "Release"), []byte("Suite: focal\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	memFS := NewMemFileSystem()
+	// The default downloader copies from the local filesystem, into the configured one.
+	repo := NewDittoRepo(DittoConfig{
+		RepoURLs:     []string{"http://127.0.0.1:1/unreachable", "file://" + dir},
+		DownloadPath: "/mirror",
+		MaxRetries:   -1,
+		Logger:       &mockLogger{},
+		FileSystem:   memFS,
+	}).(*dittoRepo)
+	if _, err := repo.downloadWithFailover(context.Background(), "dists/focal/Release", "/mirror/dists/focal/Release", ""); err != nil {
+		t.Fatalf("downloadWithFailover failed: %v", err)
+	}
+	if data, _ := memFS.ReadFile("/mirror/dists/focal/Release"); string(data) != "Suite: focal\n" {
+		t.Errorf("Release = %q", data)
+	}
+}
@@ -30,6 +30,10 @@ func (fs *OsFileSystem) Create(path string) (io.WriteCloser, error) {
 	return os.Create(path)
 }
 
+func (fs *OsFileSystem) OpenAppend(path string) (io.WriteCloser, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+}
+
 func (fs *OsFileSystem) MkdirAll(path string, perm os.FileMode) error {
 	return os.MkdirAll(path, perm)
 }
@@ -127,6 +127,26 @@ func (fs *MemFileSystem) Create(path string) (io.WriteCloser, error) {
 	}, nil
 }
 
+// OpenAppend opens an existing file for writing at its end.
+func (fs *MemFileSystem) OpenAppend(path string) (io.WriteCloser, error) {
+	path = normalizePath(path)
+
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	file, exists := fs.files[path]
+	if !exists || file.isDir {
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	}
+
+	buf := new(bytes.Buffer)
+	buf.Write(file.data)
+	return &memFileWriter{
+		fs:   fs,
+		path: path,
+		buf:  buf,
+	}, nil
+}
+
 // MkdirAll creates a directory and all necessary parents.
 func (fs *MemFileSystem) MkdirAll(path string, perm os.FileMode) error {
 	fs.mu.Lock()
@@ -260,9 +280,10 @@ func (fs *MemFileSystem) WalkDir(root string, walkFn func(path string, d fs.DirE
 
 // memFileWriter is an io.WriteCloser for writing to an in-memory file.
 type memFileWriter struct {
-	fs   *MemFileSystem
-	path string
-	buf  *bytes.Buffer
+	fs     *MemFileSystem
+	path   string
+	buf    *bytes.Buffer
+	closed bool
 }
 
 // Write writes data to the buffer.
@@ -270,11 +291,17 @@ func (w *memFileWriter) Write(p []byte) (n int, err error) {
 	return w.buf.Write(p)
 }
 
-// Close finalizes the write and stores the file in the filesystem.
+// Close finalizes the write and stores the file in the filesystem. Closing it again is a
+// no-op, so that a deferred Close cannot recreate a file renamed in the meantime.
 func (w *memFileWriter) Close() error {
 	w.fs.mu.Lock()
 	defer w.fs.mu.Unlock()
 
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
 	w.fs.files[w.path] = &memFile{
 		data:    w.buf.Bytes(),
 		mode:    0o644,
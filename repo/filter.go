@@ -0,0 +1,109 @@
+package repo
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/canonical/ditto-repo/deb822"
+)
+
+// packageFilter selects binary packages by the Package, Section and Priority fields of their
+// index stanzas, as configured by IncludePackages, ExcludePackages, Sections and Priorities.
+type packageFilter struct {
+	include    []func(string) bool
+	exclude    []func(string) bool
+	sections   []func(string) bool
+	priorities []func(string) bool
+}
+
+// newPackageFilter compiles the package filters of config. It returns nil when no filter
+// is configured, in which case every package is selected.
+func newPackageFilter(config DittoConfig) (*packageFilter, error) {
+	if len(config.IncludePackages) == 0 && len(config.ExcludePackages) == 0 &&
+		len(config.Sections) == 0 && len(config.Priorities) == 0 {
+		return nil, nil
+	}
+
+	var f packageFilter
+	var err error
+	if f.include, err = compilePatterns(config.IncludePackages); err != nil {
+		return nil, err
+	}
+	if f.exclude, err = compilePatterns(config.ExcludePackages); err != nil {
+		return nil, err
+	}
+	if f.sections, err = compilePatterns(config.Sections); err != nil {
+		return nil, err
+	}
+	if f.priorities, err = compilePatterns(config.Priorities); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// compilePatterns compiles each pattern into a matcher. A pattern wrapped in slashes
+// ("/^lib.*-dev$/") is a regular expression matched against the whole value; anything else
+// is a shell glob ("python3-*").
+func compilePatterns(patterns []string) ([]func(string) bool, error) {
+	matchers := make([]func(string) bool, 0, len(patterns))
+	for _, p := range patterns {
+		if len(p) >= 2 && strings.HasPrefix(p, "/") && strings.HasSuffix(p, "/") {
+			re, err := regexp.Compile("^(?:" + p[1:len(p)-1] + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid package pattern %q: %w", p, err)
+			}
+			matchers = append(matchers, re.MatchString)
+			continue
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid package pattern %q: %w", p, err)
+		}
+		matchers = append(matchers, func(s string) bool {
+			ok, _ := path.Match(p, s)
+			return ok
+		})
+	}
+	return matchers, nil
+}
+
+// matchesAny reports whether any of matchers accepts one of the values.
+func matchesAny(matchers []func(string) bool, values ...string) bool {
+	for _, m := range matchers {
+		for _, v := range values {
+			if m(v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matches reports whether the package described by stanza passes the filter. A package is
+// selected when its name matches an include pattern (or none are configured), matches no
+// exclude pattern, and its section and priority match the configured ones, if any. Sections
+// are matched both in full ("universe/python") and without their component ("python").
+func (f *packageFilter) matches(stanza deb822.Stanza) bool {
+	if f == nil {
+		return true
+	}
+
+	name := stanza.Get("Package")
+	if len(f.include) > 0 && !matchesAny(f.include, name) {
+		return false
+	}
+	if matchesAny(f.exclude, name) {
+		return false
+	}
+	if len(f.sections) > 0 {
+		section := stanza.Get("Section")
+		if !matchesAny(f.sections, section, path.Base(section)) {
+			return false
+		}
+	}
+	if len(f.priorities) > 0 && !matchesAny(f.priorities, stanza.Get("Priority")) {
+		return false
+	}
+	return true
+}
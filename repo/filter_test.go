@@ -0,0 +1,129 @@
+package repo
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/canonical/ditto-repo/deb822"
+)
+
+func TestPackageFilter(t *testing.T) {
+	stanza := func(pkg, section, priority string) deb822.Stanza {
+		return deb822.Stanza{Fields: []deb822.Field{
+			{Name: "Package", Value: pkg},
+			{Name: "Section", Value: section},
+			{Name: "Priority", Value: priority},
+		}}
+	}
+
+	tests := []struct {
+		name   string
+		config DittoConfig
+		stanza deb822.Stanza
+		want   bool
+	}{
+		{"no filter", DittoConfig{}, stanza("vim", "editors", "optional"), true},
+		{"include glob", DittoConfig{IncludePackages: []string{"python3-*"}}, stanza("python3-yaml", "python", "optional"), true},
+		{"include glob miss", DittoConfig{IncludePackages: []string{"python3-*"}}, stanza("python-yaml", "python", "optional"), false},
+		{"include regex", DittoConfig{IncludePackages: []string{"/^lib.*-dev$/"}}, stanza("libssl-dev", "libdevel", "optional"), true},
+		{"regex is anchored", DittoConfig{IncludePackages: []string{"/ssl/"}}, stanza("libssl-dev", "libdevel", "optional"), false},
+		{"exclude wins", DittoConfig{IncludePackages: []string{"lib*"}, ExcludePackages: []string{"*-dbg"}}, stanza("libc6-dbg", "debug", "optional"), false},
+		{"section without component", DittoConfig{Sections: []string{"python"}}, stanza("python3-yaml", "universe/python", "optional"), true},
+		{"section with component", DittoConfig{Sections: []string{"universe/*"}}, stanza("python3-yaml", "universe/python", "optional"), true},
+		{"section miss", DittoConfig{Sections: []string{"python"}}, stanza("vim", "editors", "optional"), false},
+		{"priority", DittoConfig{Priorities: []string{"required", "important"}}, stanza("bash", "shells", "required"), true},
+		{"priority miss", DittoConfig{Priorities: []string{"required", "important"}}, stanza("vim", "editors", "optional"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := newPackageFilter(tt.config)
+			if err != nil {
+				t.Fatalf("newPackageFilter failed: %v", err)
+			}
+			if got := f.matches(tt.stanza); got != tt.want {
+				t.Errorf("matches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPackageFilter_InvalidPattern(t *testing.T) {
+	for _, config := range []DittoConfig{
+		{IncludePackages: []string{"/lib(/"}},
+		{ExcludePackages: []string{"lib["}},
+	} {
+		if _, err := newPackageFilter(config); err == nil {
+			t.Errorf("newPackageFilter(%+v): expected an error", config)
+		}
+	}
+
+	md := &mockDownloader{}
+	repo := newTestRepo(t, DittoConfig{
+		RepoURL:         "http://example.com/ubuntu",
+		Dists:           []string{"focal"},
+		IncludePackages: []string{"lib["},
+	}, md)
+	_, errChan := repo.MirrorWithErrors(context.Background())
+	if err := <-errChan; err == nil {
+		t.Error("expected Mirror to fail with an invalid filter")
+	}
+	if len(md.downloads) != 0 {
+		t.Errorf("expected no downloads with an invalid filter, got %v", md.downloads)
+	}
+}
+
+func TestExtractDebsFromIndex_Filtered(t *testing.T) {
+	const index = "/mirror/dists/focal/universe/binary-amd64/Packages"
+	packages := strings.Join([]string{
+		"Package: python3-yaml\nSection: universe/python\nFilename: pool/universe/p/pyyaml/python3-yaml_5.3_amd64.deb\nSHA256: aaaa\nSize: 1\n",
+		"Package: vim\nSection: universe/editors\nFilename: pool/universe/v/vim/vim_8.1_amd64.deb\nSHA256: bbbb\nSize: 1\n",
+		"Package: python3-yaml-dbg\nSection: universe/debug\nFilename: pool/universe/p/pyyaml/python3-yaml-dbg_5.3_amd64.deb\nSHA256: cccc\nSize: 1\n",
+	}, "\n")
+
+	memFS := NewMemFileSystem().(*MemFileSystem)
+	_ = memFS.MkdirAll("/mirror/dists/focal/universe/binary-amd64", 0o755)
+	_ = memFS.MkdirAll("/mirror/pool/universe/v/vim", 0o755)
+	memFS.mu.Lock()
+	memFS.files[index] = &memFile{data: []byte(packages), mode: 0o644, modTime: time.Now()}
+	memFS.files["/mirror/pool/universe/v/vim/vim_8.1_amd64.deb"] = &memFile{data: []byte("x"), mode: 0o644, modTime: time.Now()}
+	// A distribution mirrored earlier and no longer configured keeps all of its packages.
+	memFS.files["/mirror/dists/bionic/universe/binary-amd64/Packages"] = &memFile{
+		data:    []byte("Package: nano\nFilename: pool/universe/n/nano/nano_2.9_amd64.deb\nSHA256: dddd\nSize: 1\n"),
+		mode:    0o644,
+		modTime: time.Now(),
+	}
+	memFS.files["/mirror/pool/universe/n/nano/nano_2.9_amd64.deb"] = &memFile{data: []byte("x"), mode: 0o644, modTime: time.Now()}
+	memFS.mu.Unlock()
+
+	repo := NewDittoRepo(DittoConfig{
+		Dists:           []string{"focal"},
+		DownloadPath:    "/mirror",
+		IncludePackages: []string{"python3-*"},
+		ExcludePackages: []string{"*-dbg"},
+		Logger:          &mockLogger{},
+		FileSystem:      memFS,
+		Downloader:      &mockDownloader{},
+	}).(*dittoRepo)
+
+	debs, err := repo.extractDebsFromIndex(index)
+	if err != nil {
+		t.Fatalf("extractDebsFromIndex failed: %v", err)
+	}
+	if len(debs) != 1 || debs[0].Path != "pool/universe/p/pyyaml/python3-yaml_5.3_amd64.deb" {
+		t.Errorf("extractDebsFromIndex = %+v, want only python3-yaml", debs)
+	}
+
+	// A previously mirrored package that no longer passes the filter is cleaned up.
+	if err := repo.cleanupOrphanedPackages(); err != nil {
+		t.Fatalf("cleanupOrphanedPackages failed: %v", err)
+	}
+	if _, err := memFS.Stat("/mirror/pool/universe/v/vim/vim_8.1_amd64.deb"); err == nil {
+		t.Error("filtered-out package was not removed by cleanup")
+	}
+	if _, err := memFS.Stat("/mirror/pool/universe/n/nano/nano_2.9_amd64.deb"); err != nil {
+		t.Error("package of an unconfigured distribution was removed by cleanup")
+	}
+}
@@ -0,0 +1,93 @@
+package repo
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// hostConnLimiter caps the number of downloads in flight to each upstream host, so that a
+// small mirror aggregated with a large one does not receive the full Workers concurrency.
+// A nil *hostConnLimiter places no limit.
+type hostConnLimiter struct {
+	perHost int
+	hosts   map[string]int
+
+	mu    sync.Mutex
+	slots map[string]chan struct{}
+}
+
+// newHostConnLimiter returns a limiter allowing perHost concurrent downloads from each host,
+// or the value of its entry in hosts (keyed by host name), or nil when neither sets a limit.
+// A zero or negative limit is unlimited.
+func newHostConnLimiter(perHost int, hosts map[string]int) *hostConnLimiter {
+	l := &hostConnLimiter{perHost: perHost, hosts: make(map[string]int), slots: make(map[string]chan struct{})}
+	limited := perHost > 0
+	for host, n := range hosts {
+		l.hosts[strings.ToLower(host)] = n
+		limited = limited || n > 0
+	}
+	if !limited {
+		return nil
+	}
+	return l
+}
+
+// slotsFor returns the semaphore of the host serving base, or nil when it is unlimited.
+// Local repositories are never limited.
+func (l *hostConnLimiter) slotsFor(base string) chan struct{} {
+	if l == nil || isLocalURL(base) {
+		return nil
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil
+	}
+	host := strings.ToLower(u.Hostname())
+	limit, ok := l.hosts[host]
+	if !ok {
+		limit = l.perHost
+	}
+	if limit <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	slots, ok := l.slots[host]
+	if !ok {
+		slots = make(chan struct{}, limit)
+		l.slots[host] = slots
+	}
+	return slots
+}
+
+// tryAcquire takes a connection slot on the host serving base without waiting. It returns
+// the function releasing the slot, and false when the host is saturated.
+func (l *hostConnLimiter) tryAcquire(base string) (func(), bool) {
+	slots := l.slotsFor(base)
+	if slots == nil {
+		return func() {}, true
+	}
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, true
+	default:
+		return nil, false
+	}
+}
+
+// acquire takes a connection slot on the host serving base, waiting for one to be released
+// unless ctx is cancelled first. It returns the function releasing the slot.
+func (l *hostConnLimiter) acquire(ctx context.Context, base string) (func(), error) {
+	slots := l.slotsFor(base)
+	if slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,108 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestHostConnLimiter(t *testing.T) {
+	if l := newHostConnLimiter(0, map[string]int{"mirror.internal": 0}); l != nil {
+		t.Error("a limiter without any limit should be nil")
+	}
+	var unlimited *hostConnLimiter
+	if _, ok := unlimited.tryAcquire("http://archive.example/ubuntu"); !ok {
+		t.Error("a nil limiter refused a connection")
+	}
+
+	l := newHostConnLimiter(2, map[string]int{"Mirror.Internal": 1, "archive.example": 0})
+	release, ok := l.tryAcquire("http://mirror.internal/ubuntu")
+	if !ok {
+		t.Fatal("first connection to mirror.internal refused")
+	}
+	// The limit is per host, whatever the port, scheme or path.
+	if _, ok := l.tryAcquire("https://mirror.internal:8443/debian"); ok {
+		t.Error("mirror.internal accepted more than its override of 1 connection")
+	}
+	for range 2 {
+		if _, ok := l.tryAcquire("http://ports.example/ubuntu"); !ok {
+			t.Error("ports.example refused a connection under the default limit")
+		}
+	}
+	if _, ok := l.tryAcquire("http://ports.example/ubuntu"); ok {
+		t.Error("ports.example accepted more than the default limit")
+	}
+	for range 5 {
+		if _, ok := l.tryAcquire("http://archive.example/ubuntu"); !ok {
+			t.Error("archive.example is unlimited by its override")
+		}
+		if _, ok := l.tryAcquire("file:///srv/ubuntu"); !ok {
+			t.Error("local repositories are unlimited")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := l.acquire(ctx, "http://mirror.internal/ubuntu"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("acquire on a saturated host = %v, want the context's error", err)
+	}
+	release()
+	if _, err := l.acquire(context.Background(), "http://mirror.internal/ubuntu"); err != nil {
+		t.Errorf("acquire after a release failed: %v", err)
+	}
+}
+
+func TestDownloadWithFailover_HostConnections(t *testing.T) {
+	const small, big = "http://mirror.internal/ubuntu", "http://archive.example/ubuntu"
+	downloader := &mockDownloader{}
+	repo := newTestRepo(t, DittoConfig{
+		RepoURLs:           []string{small, big},
+		MaxRetries:         -1,
+		HostMaxConnections: map[string]int{"mirror.internal": 1},
+	}, downloader)
+
+	// Another worker holds the only connection to the small mirror: skip to the next one.
+	release, ok := repo.hostConns.tryAcquire(small)
+	if !ok {
+		t.Fatal("cannot take the connection to the small mirror")
+	}
+	if _, err := repo.downloadWithFailover(context.Background(), "pool/a.deb", "/tmp/a.deb", ""); err != nil {
+		t.Fatalf("downloadWithFailover failed: %v", err)
+	}
+	if !slices.Equal(downloader.downloads, []string{big + "/pool/a.deb"}) {
+		t.Errorf("downloads = %v, want the file from the second mirror", downloader.downloads)
+	}
+
+	// When the other mirrors fail, the download waits for the saturated host.
+	downloader.downloads = nil
+	downloader.errByURL = map[string]error{big + "/pool/b.deb": &HTTPStatusError{StatusCode: http.StatusNotFound}}
+	done := make(chan error)
+	go func() {
+		_, err := repo.downloadWithFailover(context.Background(), "pool/b.deb", "/tmp/b.deb", "")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("download did not wait for the saturated host: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	release()
+	if err := <-done; err != nil {
+		t.Fatalf("downloadWithFailover failed: %v", err)
+	}
+	if !slices.Equal(downloader.downloads, []string{big + "/pool/b.deb", small + "/pool/b.deb"}) {
+		t.Errorf("downloads = %v", downloader.downloads)
+	}
+
+	// Waiting stops with the context.
+	release, _ = repo.hostConns.tryAcquire(small)
+	defer release()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := repo.downloadWithFailover(ctx, "pool/b.deb", "/tmp/b.deb", ""); !errors.Is(err, context.Canceled) {
+		t.Errorf("downloadWithFailover = %v, want context.Canceled", err)
+	}
+}
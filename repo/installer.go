@@ -0,0 +1,164 @@
+package repo
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// isInstallerImageSums reports whether filePath is the SHA256SUMS file (or its detached
+// signature) of an installer image tree that should be mirrored. These trees are only
+// listed in the Release file through their SHA256SUMS, for example:
+//
+//	main/installer-amd64/current/images/SHA256SUMS  (Debian/Ubuntu netboot images)
+//	main/uefi/grub2-amd64/current/SHA256SUMS        (Ubuntu signed bootloaders)
+//	main/signed/linux-amd64/current/SHA256SUMS      (Ubuntu signed kernels)
+//
+// Only the "current" tree of each configured component and architecture is selected; the
+// versioned trees it points to upstream are not mirrored separately.
+func (d *dittoRepo) isInstallerImageSums(filePath string) bool {
+	if !d.config.InstallerImages {
+		return false
+	}
+
+	base := path.Base(filePath)
+	if base != "SHA256SUMS" && base != "SHA256SUMS.gpg" {
+		return false
+	}
+
+	parts := strings.Split(filePath, "/")
+	if len(parts) < 4 || !slices.Contains(d.config.Components, parts[0]) || !slices.Contains(parts, "current") {
+		return false
+	}
+
+	for _, a := range d.config.Archs {
+		switch parts[1] {
+		case "installer-" + a:
+			return true
+		case "uefi", "signed":
+			if strings.HasSuffix(parts[2], "-"+a) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// extractInstallerImages parses the SHA256SUMS file of an installer image tree at
+// localSumsPath and returns every file it lists as a repository-relative path under the
+// tree's directory, with the SHA256 the downloader must verify it against. Sizes are not
+// listed in SHA256SUMS and are reported as unknown (-1), so that VerifySize falls back to
+// checking their SHA256.
+func (d *dittoRepo) extractInstallerImages(localSumsPath string) ([]packageMeta, error) {
+	treeDir, err := filepath.Rel(d.config.DownloadPath, path.Dir(localSumsPath))
+	if err != nil {
+		return nil, err
+	}
+	treeDir = filepath.ToSlash(treeDir)
+
+	f, err := d.fs.Open(localSumsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var images []packageMeta
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Format: checksum, whitespace, then the file name, optionally prefixed with "*"
+		// (binary mode) and usually with "./".
+		hash, name, found := strings.Cut(strings.TrimSpace(scanner.Text()), " ")
+		if !found || len(hash) != 64 {
+			continue
+		}
+		name = strings.TrimPrefix(strings.TrimLeft(name, " "), "*")
+		name = path.Clean(name)
+		if name == "." || path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return nil, fmt.Errorf("invalid file name %q in %s", name, localSumsPath)
+		}
+		images = append(images, packageMeta{
+			Path:   path.Join(treeDir, name),
+			SHA256: strings.ToLower(hash),
+			Size:   -1,
+		})
+	}
+	return images, scanner.Err()
+}
+
+// isInstallerTreeSums reports whether relPath, relative to DownloadPath, is the SHA256SUMS
+// file of an installer image tree, whatever the current configuration: the trees left by
+// earlier runs must be cleaned up too.
+func isInstallerTreeSums(relPath string) bool {
+	if path.Base(relPath) != "SHA256SUMS" || !strings.Contains(relPath, "/current/") {
+		return false
+	}
+	return strings.Contains(relPath, "/installer-") || strings.Contains(relPath, "/uefi/") || strings.Contains(relPath, "/signed/")
+}
+
+// cleanupOrphanedInstallerImages removes the files of every installer image tree under
+// dists/ that its SHA256SUMS no longer lists, such as the images of a previous release.
+func (d *dittoRepo) cleanupOrphanedInstallerImages() error {
+	distsPath := filepath.Join(d.config.DownloadPath, "dists")
+	if _, err := d.fs.Stat(distsPath); err != nil || d.config.Flat {
+		return nil
+	}
+
+	var sumsPaths []string
+	err := d.fs.WalkDir(distsPath, func(p string, de fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if rel, err := filepath.Rel(d.config.DownloadPath, p); err == nil && !de.IsDir() && isInstallerTreeSums(filepath.ToSlash(rel)) {
+			sumsPaths = append(sumsPaths, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("cannot scan dists directory: %v", err)
+	}
+
+	for _, sumsPath := range sumsPaths {
+		images, err := d.extractInstallerImages(sumsPath)
+		if err != nil {
+			d.logger.Warn(fmt.Sprintf("cannot parse %s: %v", sumsPath, err))
+			continue
+		}
+		treeDir := filepath.Dir(sumsPath)
+		valid := map[string]bool{
+			sumsPath:                                 true,
+			filepath.Join(treeDir, "SHA256SUMS.gpg"): true,
+		}
+		for _, image := range images {
+			valid[filepath.Join(d.config.DownloadPath, image.Path)] = true
+		}
+
+		var toRemove []string
+		err = d.fs.WalkDir(treeDir, func(p string, de fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !de.IsDir() && !valid[p] {
+				toRemove = append(toRemove, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("cannot walk %s: %v", treeDir, err)
+		}
+		for _, p := range toRemove {
+			relPath, _ := filepath.Rel(d.config.DownloadPath, p)
+			d.logger.Debug(fmt.Sprintf("Removing: %s", relPath))
+			if err := d.fs.Remove(p); err != nil {
+				d.logger.Warn(fmt.Sprintf("cannot remove %s: %v", relPath, err))
+			}
+		}
+		if len(toRemove) > 0 {
+			d.logger.Info(fmt.Sprintf("Removed %d orphaned installer images from %s", len(toRemove), treeDir))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsDesired_InstallerImages(t *testing.T) {
+	config := DittoConfig{
+		Components: []string{"main"},
+		Archs:      []string{"amd64"},
+	}
+
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"main/installer-amd64/current/images/SHA256SUMS", true},
+		{"main/installer-amd64/current/legacy-images/SHA256SUMS", true},
+		{"main/uefi/grub2-amd64/current/SHA256SUMS", true},
+		{"main/uefi/grub2-amd64/current/SHA256SUMS.gpg", true},
+		{"main/signed/linux-amd64/current/SHA256SUMS", true},
+		{"main/installer-amd64/20230607+deb12u5/images/SHA256SUMS", false}, // versioned tree
+		{"main/installer-arm64/current/images/SHA256SUMS", false},          // arch not configured
+		{"main/uefi/grub2-arm64/current/SHA256SUMS", false},
+		{"universe/installer-amd64/current/images/SHA256SUMS", false}, // component not configured
+		{"main/installer-amd64/current/images/MD5SUMS", false},
+	}
+
+	off := newTestRepo(t, config, &mockDownloader{})
+	config.InstallerImages = true
+	on := newTestRepo(t, config, &mockDownloader{})
+
+	for _, tt := range tests {
+		if got := on.isDesired(tt.path); got != tt.want {
+			t.Errorf("isDesired(%q) with InstallerImages = %v, want %v", tt.path, got, tt.want)
+		}
+		if off.isDesired(tt.path) {
+			t.Errorf("isDesired(%q) without InstallerImages = true, want false", tt.path)
+		}
+	}
+}
+
+func TestExtractInstallerImages(t *testing.T) {
+	const sumsPath = "/mirror/dists/bookworm/main/installer-amd64/current/images/SHA256SUMS"
+	sums := strings.Join([]string{
+		"0000000000000000000000000000000000000000000000000000000000000001  ./netboot/netboot.tar.gz",
+		"0000000000000000000000000000000000000000000000000000000000000002  ./cdrom/vmlinuz",
+		"",
+		"00000000000000000000000000000000000000000000000000000000000000AB *hd-media/initrd.gz",
+	}, "\n")
+
+	memFS := NewMemFileSystem().(*MemFileSystem)
+	_ = memFS.MkdirAll(strings.TrimSuffix(sumsPath, "/SHA256SUMS"), 0o755)
+	memFS.mu.Lock()
+	memFS.files[sumsPath] = &memFile{data: []byte(sums), mode: 0o644, modTime: time.Now()}
+	memFS.mu.Unlock()
+
+	repo := NewDittoRepo(DittoConfig{
+		DownloadPath: "/mirror",
+		Logger:       &mockLogger{},
+		FileSystem:   memFS,
+		Downloader:   &mockDownloader{},
+	}).(*dittoRepo)
+
+	images, err := repo.extractInstallerImages(sumsPath)
+	if err != nil {
+		t.Fatalf("extractInstallerImages failed: %v", err)
+	}
+
+	want := []packageMeta{
+		{Path: "dists/bookworm/main/installer-amd64/current/images/netboot/netboot.tar.gz", SHA256: "0000000000000000000000000000000000000000000000000000000000000001", Size: -1},
+		{Path: "dists/bookworm/main/installer-amd64/current/images/cdrom/vmlinuz", SHA256: "0000000000000000000000000000000000000000000000000000000000000002", Size: -1},
+		{Path: "dists/bookworm/main/installer-amd64/current/images/hd-media/initrd.gz", SHA256: "00000000000000000000000000000000000000000000000000000000000000ab", Size: -1},
+	}
+	if len(images) != len(want) {
+		t.Fatalf("got %d images, want %d: %v", len(images), len(want), images)
+	}
+	for i := range want {
+		if images[i] != want[i] {
+			t.Errorf("image %d: got %+v, want %+v", i, images[i], want[i])
+		}
+	}
+
+	t.Run("rejects paths escaping the tree", func(t *testing.T) {
+		memFS.mu.Lock()
+		memFS.files[sumsPath] = &memFile{
+			data:    []byte("0000000000000000000000000000000000000000000000000000000000000001  ../../../../Release\n"),
+			mode:    0o644,
+			modTime: time.Now(),
+		}
+		memFS.mu.Unlock()
+		if _, err := repo.extractInstallerImages(sumsPath); err == nil {
+			t.Error("expected an error for a path outside the tree")
+		}
+	})
+}
+
+func TestMirrorDistribution_InstallerImages(t *testing.T) {
+	const sumsHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	const imageHash = "1111111111111111111111111111111111111111111111111111111111111111"
+	sums := imageHash + "  ./netboot/netboot.tar.gz\n"
+	releaseContent := fmt.Sprintf(`Origin: Debian
+Suite: bookworm
+SHA256:
+ %s %8d main/installer-amd64/current/images/SHA256SUMS
+`, sumsHash, len(sums))
+	memFS := NewMemFileSystem().(*MemFileSystem)
+	_ = memFS.MkdirAll("/mirror/dists/bookworm/main/installer-amd64/current/images", 0o755)
+	memFS.mu.Lock()
+	memFS.files["/mirror/dists/bookworm/Release"] = &memFile{data: []byte(releaseContent), mode: 0o644, modTime: time.Now()}
+	// The mock downloader does not write files, so the tree's SHA256SUMS is pre-seeded.
+	memFS.files["/mirror/dists/bookworm/main/installer-amd64/current/images/SHA256SUMS"] = &memFile{
+		data:    []byte(sums),
+		mode:    0o644,
+		modTime: time.Now(),
+	}
+	memFS.mu.Unlock()
+
+	md := &mockDownloader{}
+	repo := NewDittoRepo(DittoConfig{
+		RepoURL:         "http://example.com/debian",
+		Dists:           []string{"bookworm"},
+		Components:      []string{"main"},
+		Archs:           []string{"amd64"},
+		DownloadPath:    "/mirror",
+		InstallerImages: true,
+		Logger:          &mockLogger{},
+		FileSystem:      memFS,
+		Downloader:      md,
+	}).(*dittoRepo)
+	repo.progressChan = make(chan ProgressUpdate, 100)
+
+	// No by-hash entry is created in the tree, where the cleanup would remove it again on
+	// every run.
+	const tree = "/mirror/dists/bookworm/main/installer-amd64/current/images"
+	for range 2 {
+		if err := repo.mirrorDistribution(context.Background(), "bookworm"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := memFS.Stat(tree + "/by-hash"); err == nil {
+			t.Error("a by-hash entry was created for the SHA256SUMS of the tree")
+		}
+		if err := repo.cleanupOrphanedInstallerImages(); err != nil {
+			t.Fatalf("cleanupOrphanedInstallerImages failed: %v", err)
+		}
+		if _, err := memFS.Stat(tree + "/SHA256SUMS"); err != nil {
+			t.Error("the SHA256SUMS of the tree was removed")
+		}
+	}
+
+	const imageURL = "http://example.com/debian/dists/bookworm/main/installer-amd64/current/images/netboot/netboot.tar.gz"
+	found := false
+	for i, url := range md.downloads {
+		if url == imageURL {
+			found = true
+			if md.checksums[i] != imageHash {
+				t.Errorf("image downloaded with expected checksum %q, want %q", md.checksums[i], imageHash)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("installer image was not downloaded; downloads: %v", md.downloads)
+	}
+}
+
+func TestCleanupOrphanedInstallerImages(t *testing.T) {
+	const tree = "/mirror/dists/bookworm/main/installer-amd64/current/images"
+	const imageHash = "1111111111111111111111111111111111111111111111111111111111111111"
+	memFS := NewMemFileSystem().(*MemFileSystem)
+	_ = memFS.MkdirAll(tree+"/netboot", 0o755)
+	memFS.mu.Lock()
+	for p, data := range map[string]string{
+		tree + "/SHA256SUMS":              imageHash + "  ./netboot/netboot.tar.gz\n",
+		tree + "/SHA256SUMS.gpg":          "signature",
+		tree + "/netboot/netboot.tar.gz":  "current image",
+		tree + "/netboot/mini.iso":        "image dropped from SHA256SUMS",
+		tree + "/cdrom/vmlinuz.tmp":       "partial download",
+		"/mirror/dists/bookworm/Release":  "Origin: Debian\n",
+		"/mirror/dists/bookworm/main/foo": "not part of a tree",
+	} {
+		memFS.files[p] = &memFile{data: []byte(data), mode: 0o644, modTime: time.Now()}
+	}
+	memFS.mu.Unlock()
+
+	// Trees are cleaned up even once InstallerImages is no longer set.
+	repo := NewDittoRepo(DittoConfig{
+		DownloadPath: "/mirror",
+		Logger:       &mockLogger{},
+		FileSystem:   memFS,
+		Downloader:   &mockDownloader{},
+	}).(*dittoRepo)
+	if err := repo.cleanupOrphanedInstallerImages(); err != nil {
+		t.Fatalf("cleanupOrphanedInstallerImages failed: %v", err)
+	}
+
+	for _, kept := range []string{tree + "/SHA256SUMS", tree + "/SHA256SUMS.gpg", tree + "/netboot/netboot.tar.gz", "/mirror/dists/bookworm/Release", "/mirror/dists/bookworm/main/foo"} {
+		if _, err := memFS.Stat(kept); err != nil {
+			t.Errorf("%s was removed", kept)
+		}
+	}
+	for _, removed := range []string{tree + "/netboot/mini.iso", tree + "/cdrom/vmlinuz.tmp"} {
+		if _, err := memFS.Stat(removed); err == nil {
+			t.Errorf("%s was kept", removed)
+		}
+	}
+}
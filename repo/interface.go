@@ -20,6 +20,16 @@ type DittoRepo interface {
 	MirrorWithErrors(ctx context.Context) (<-chan ProgressUpdate, <-chan error)
 }
 
+// MirrorStatsReporter is implemented by the DittoRepo returned by NewDittoRepo. It is kept
+// apart from DittoRepo so that other implementations need not provide it; callers check
+// for it with a type assertion.
+type MirrorStatsReporter interface {
+	// MirrorStats reports the health of each mirror (successes, failures, latency,
+	// throughput and circuit breaker state) as observed so far. It is safe to call while
+	// mirroring is in progress.
+	MirrorStats() []MirrorStats
+}
+
 // Logger is a simple logging interface
 // It mimics the standard library log/slog methods.
 type Logger interface {
@@ -60,6 +70,16 @@ type FileSystem interface {
 	WalkDir(root string, walkFn func(path string, d fs.DirEntry, err error) error) error
 }
 
+// AppendFileSystem is implemented by FileSystems that can also append to existing files.
+// HTTPDownloader uses it to resume interrupted downloads; with a FileSystem that does not
+// implement it, every download starts from the beginning.
+type AppendFileSystem interface {
+	FileSystem
+
+	// OpenAppend opens an existing file for writing at its end
+	OpenAppend(path string) (io.WriteCloser, error)
+}
+
 // Downloader abstracts HTTP downloading operations.
 // This allows for testing and alternative download mechanisms.
 type Downloader interface {
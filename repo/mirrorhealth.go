@@ -0,0 +1,171 @@
+package repo
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMirrorFailureThreshold = 3
+	defaultMirrorCooldown         = Duration(time.Minute)
+
+	// healthSmoothing is the weight of the newest sample in the moving averages.
+	healthSmoothing = 0.3
+	// throughputSampleSize is the size from which a download measures throughput; smaller
+	// ones mostly measure latency.
+	throughputSampleSize = 256 * 1024
+	// scoreReferenceSize is the file size mirrors are compared on when ordering them.
+	scoreReferenceSize = 1 << 20
+)
+
+// MirrorStats reports the health of one mirror, as observed since the DittoRepo was
+// created. Only transient errors (see MaxRetries) count as failures: a mirror answering
+// 404 for a file it does not carry is not unhealthy.
+type MirrorStats struct {
+	URL       string
+	Successes int
+	Failures  int
+	// ConsecutiveFailures counts the failures since the last success.
+	ConsecutiveFailures int
+	LastError           string
+	LastErrorTime       time.Time
+	// SuccessRate is a moving average of recent outcomes, from 0 to 1 (1 before any).
+	SuccessRate float64
+	// Latency is a moving average of the time taken by small downloads.
+	Latency time.Duration
+	// Throughput is a moving average of the transfer rate of large downloads, in bytes
+	// per second (0 until one has completed).
+	Throughput      float64
+	BytesDownloaded int64
+	// CircuitOpenUntil is set while the mirror is skipped after repeated failures.
+	CircuitOpenUntil time.Time
+}
+
+// score estimates how long the mirror takes to deliver a file of scoreReferenceSize,
+// accounting for the downloads that fail. Lower is better; a mirror without samples
+// scores 0, so that it is tried and measured.
+func (s *MirrorStats) score() float64 {
+	seconds := s.Latency.Seconds()
+	if s.Throughput > 0 {
+		seconds += scoreReferenceSize / s.Throughput
+	}
+	return seconds / max(s.SuccessRate, 0.1)
+}
+
+// mirrorHealth tracks the outcome of the downloads from each mirror and opens a circuit
+// breaker on mirrors failing repeatedly, so that they are only tried once every other
+// mirror has failed until their cooldown expires.
+type mirrorHealth struct {
+	failureThreshold int
+	cooldown         time.Duration
+	now              func() time.Time
+
+	mu      sync.Mutex
+	mirrors map[string]*MirrorStats
+}
+
+func newMirrorHealth(failureThreshold int, cooldown time.Duration) *mirrorHealth {
+	return &mirrorHealth{
+		failureThreshold: failureThreshold,
+		cooldown:         cooldown,
+		now:              time.Now,
+		mirrors:          make(map[string]*MirrorStats),
+	}
+}
+
+// stats returns the entry of base. It must be called with mu held.
+func (h *mirrorHealth) stats(base string) *MirrorStats {
+	s, ok := h.mirrors[base]
+	if !ok {
+		s = &MirrorStats{URL: base, SuccessRate: 1}
+		h.mirrors[base] = s
+	}
+	return s
+}
+
+// recordSuccess records a download of size bytes from base that took elapsed, and closes
+// its circuit breaker.
+func (h *mirrorHealth) recordSuccess(base string, size int64, elapsed time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.stats(base)
+	s.Successes++
+	s.ConsecutiveFailures = 0
+	s.CircuitOpenUntil = time.Time{}
+	s.BytesDownloaded += size
+	s.SuccessRate = ewma(s.SuccessRate, 1)
+	if size >= throughputSampleSize && elapsed > 0 {
+		s.Throughput = ewma(s.Throughput, float64(size)/elapsed.Seconds())
+	} else {
+		s.Latency = time.Duration(ewma(float64(s.Latency), float64(elapsed)))
+	}
+}
+
+// recordFailure records a transient failure of base. It returns true when this failure
+// opened the mirror's circuit breaker.
+func (h *mirrorHealth) recordFailure(base string, err error) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.stats(base)
+	s.Failures++
+	s.ConsecutiveFailures++
+	s.LastError = err.Error()
+	s.LastErrorTime = h.now()
+	s.SuccessRate = ewma(s.SuccessRate, 0)
+	if h.failureThreshold <= 0 || s.ConsecutiveFailures < h.failureThreshold {
+		return false
+	}
+	wasOpen := s.CircuitOpenUntil.After(s.LastErrorTime)
+	s.CircuitOpenUntil = s.LastErrorTime.Add(h.cooldown)
+	return !wasOpen
+}
+
+// order returns bases with the mirrors whose circuit breaker is open moved to the end.
+// When adaptive is set, the others are sorted by score, except for the first base when
+// pinned is set (an architecture preference).
+func (h *mirrorHealth) order(bases []string, pinned, adaptive bool) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := h.now()
+	healthy := make([]string, 0, len(bases))
+	var broken []string
+	for _, base := range bases {
+		if s, ok := h.mirrors[base]; ok && s.CircuitOpenUntil.After(now) {
+			broken = append(broken, base)
+			continue
+		}
+		healthy = append(healthy, base)
+	}
+	if adaptive {
+		sorted := healthy
+		if pinned && len(healthy) > 0 && healthy[0] == bases[0] {
+			sorted = healthy[1:]
+		}
+		slices.SortStableFunc(sorted, func(a, b string) int {
+			return cmp.Compare(h.stats(a).score(), h.stats(b).score())
+		})
+	}
+	return append(healthy, broken...)
+}
+
+// snapshot returns a copy of the stats of each of bases.
+func (h *mirrorHealth) snapshot(bases []string) []MirrorStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	stats := make([]MirrorStats, 0, len(bases))
+	for _, base := range bases {
+		stats = append(stats, *h.stats(base))
+	}
+	return stats
+}
+
+// ewma folds sample into the moving average avg. An average of zero has no samples yet
+// and is replaced by the first one.
+func ewma(avg, sample float64) float64 {
+	if avg == 0 {
+		return sample
+	}
+	return avg + healthSmoothing*(sample-avg)
+}
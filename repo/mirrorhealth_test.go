@@ -0,0 +1,141 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestMirrorHealth_CircuitBreaker(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	h := newMirrorHealth(2, time.Minute)
+	h.now = func() time.Time { return now }
+	bases := []string{"http://a.example", "http://b.example"}
+	unavailable := &HTTPStatusError{StatusCode: http.StatusServiceUnavailable}
+
+	if h.recordFailure(bases[0], unavailable) {
+		t.Error("circuit opened before reaching the threshold")
+	}
+	if got := h.order(bases, false, false); !slices.Equal(got, bases) {
+		t.Errorf("order after one failure = %v, want %v", got, bases)
+	}
+	if !h.recordFailure(bases[0], unavailable) {
+		t.Error("circuit did not open at the threshold")
+	}
+	if h.recordFailure(bases[0], unavailable) {
+		t.Error("an already open circuit was reported as opening again")
+	}
+	if got := h.order(bases, false, false); !slices.Equal(got, []string{bases[1], bases[0]}) {
+		t.Errorf("order with an open circuit = %v, want the failing mirror last", got)
+	}
+	// Even a pinned architecture preference is demoted while its circuit is open.
+	if got := h.order(bases, true, true); got[0] != bases[1] {
+		t.Errorf("pinned order with an open circuit = %v", got)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if got := h.order(bases, false, false); !slices.Equal(got, bases) {
+		t.Errorf("order after the cooldown = %v, want %v", got, bases)
+	}
+	// Still failing after the cooldown: the circuit opens again straight away.
+	if !h.recordFailure(bases[0], unavailable) {
+		t.Error("circuit did not reopen on the first failure after the cooldown")
+	}
+	h.recordSuccess(bases[0], 100, time.Millisecond)
+	if got := h.order(bases, false, false); !slices.Equal(got, bases) {
+		t.Errorf("order after a success = %v, want %v", got, bases)
+	}
+
+	stats := h.snapshot(bases)
+	if stats[0].Successes != 1 || stats[0].Failures != 4 || stats[0].ConsecutiveFailures != 0 || stats[0].LastError != "status 503" {
+		t.Errorf("stats = %+v", stats[0])
+	}
+	if stats[0].SuccessRate >= 0.5 {
+		t.Errorf("success rate = %v after mostly failures", stats[0].SuccessRate)
+	}
+	if stats[1].Successes != 0 || stats[1].SuccessRate != 1 {
+		t.Errorf("stats of an unused mirror = %+v", stats[1])
+	}
+
+	disabled := newMirrorHealth(-1, time.Minute)
+	for range 10 {
+		if disabled.recordFailure(bases[0], unavailable) {
+			t.Fatal("circuit opened with a negative threshold")
+		}
+	}
+}
+
+func TestMirrorHealth_AdaptiveOrder(t *testing.T) {
+	const slow, fast, flaky = "http://slow.example", "http://fast.example", "http://flaky.example"
+	h := newMirrorHealth(-1, time.Minute)
+	for range 3 {
+		h.recordSuccess(slow, 1024, 500*time.Millisecond)
+		h.recordSuccess(fast, 1024, 50*time.Millisecond)
+		h.recordSuccess(flaky, 1024, 50*time.Millisecond)
+		h.recordFailure(flaky, errors.New("connection reset"))
+	}
+	// Large downloads measure throughput: the slow mirror is also slow there.
+	h.recordSuccess(slow, 4<<20, 4*time.Second)
+	h.recordSuccess(fast, 4<<20, time.Second)
+	h.recordSuccess(flaky, 4<<20, time.Second)
+
+	bases := []string{slow, flaky, fast}
+	if got := h.order(bases, false, false); !slices.Equal(got, bases) {
+		t.Errorf("configured order = %v, want %v", got, bases)
+	}
+	if got := h.order(bases, false, true); !slices.Equal(got, []string{fast, flaky, slow}) {
+		t.Errorf("adaptive order = %v, want [fast flaky slow]", got)
+	}
+	if got := h.order(bases, true, true); !slices.Equal(got, []string{slow, fast, flaky}) {
+		t.Errorf("adaptive order with a pinned preference = %v, want [slow fast flaky]", got)
+	}
+
+	// A mirror without samples scores best, so that it gets measured.
+	if got := h.order([]string{fast, "http://new.example"}, false, true); got[0] != "http://new.example" {
+		t.Errorf("adaptive order = %v, want the unmeasured mirror first", got)
+	}
+}
+
+func TestDownloadWithFailover_CircuitBreaker(t *testing.T) {
+	const a, b = "http://a.example", "http://b.example"
+	unavailable := &HTTPStatusError{StatusCode: http.StatusServiceUnavailable}
+	fd := &flakyDownloader{errs: map[string][]error{
+		a + "/pool/1.deb": {unavailable},
+		a + "/pool/2.deb": {unavailable},
+		a + "/pool/3.deb": {&HTTPStatusError{StatusCode: http.StatusNotFound}},
+		a + "/pool/4.deb": {unavailable},
+	}}
+	repo := newTestRepo(t, DittoConfig{
+		RepoURLs:               []string{a, b},
+		MaxRetries:             -1,
+		MirrorFailureThreshold: 3,
+	}, fd)
+
+	for _, file := range []string{"1.deb", "2.deb", "3.deb", "4.deb", "5.deb"} {
+		if _, err := repo.downloadWithFailover(context.Background(), "pool/"+file, "/tmp/"+file, ""); err != nil {
+			t.Fatalf("downloading %s failed: %v", file, err)
+		}
+	}
+	// 3.deb's 404 does not count, so the circuit only opens on 4.deb's failure and
+	// 5.deb goes to b first.
+	if got := fd.attempts[a+"/pool/5.deb"]; got != 0 {
+		t.Errorf("mirror with an open circuit tried %d times for 5.deb, want 0", got)
+	}
+	if got := repo.candidateURLs("pool/6.deb"); !slices.Equal(got, []string{b, a}) {
+		t.Errorf("candidateURLs = %v, want [b a]", got)
+	}
+
+	stats := repo.MirrorStats()
+	if len(stats) != 2 || stats[0].URL != a || stats[1].URL != b {
+		t.Fatalf("MirrorStats = %+v", stats)
+	}
+	if stats[0].Failures != 3 || stats[0].CircuitOpenUntil.IsZero() {
+		t.Errorf("stats of the failing mirror = %+v", stats[0])
+	}
+	if stats[1].Successes != 5 {
+		t.Errorf("stats of the healthy mirror = %+v", stats[1])
+	}
+}
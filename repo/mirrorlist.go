@@ -0,0 +1,163 @@
+package repo
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"maps"
+	"math"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// mirrorListEntry is one mirror of an apt mirror list.
+type mirrorListEntry struct {
+	URL      string
+	Priority int      // lower is preferred; math.MaxInt when not given
+	Archs    []string // empty when the mirror serves every architecture
+	Types    []string // "deb", "deb-src"; empty when it serves both
+}
+
+// isMirrorListURL reports whether a RepoURLs entry points to an apt mirror list
+// (mirror://, mirror+http://, mirror+https:// or mirror+file://) rather than a repository.
+func isMirrorListURL(urlStr string) bool {
+	return strings.HasPrefix(urlStr, "mirror://") || strings.HasPrefix(urlStr, "mirror+")
+}
+
+// mirrorListLocation returns the URL the mirror list itself is fetched from: mirror://
+// stands for mirror+http://, as in apt.
+func mirrorListLocation(urlStr string) string {
+	if rest, ok := strings.CutPrefix(urlStr, "mirror://"); ok {
+		return "http://" + rest
+	}
+	return strings.TrimPrefix(urlStr, "mirror+")
+}
+
+// parseMirrorList parses an apt mirror list: one mirror URL per line, optionally followed
+// by whitespace-separated "key:value" hints ("priority:1", "arch:arm64", "type:deb"; arch
+// and type may be repeated). Blank lines and lines starting with "#" are ignored, as are
+// unknown hints and invalid priorities. The entries are returned by ascending priority,
+// keeping the list order among equal priorities.
+func parseMirrorList(data []byte) ([]mirrorListEntry, error) {
+	var entries []mirrorListEntry
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		entry := mirrorListEntry{URL: strings.TrimSuffix(fields[0], "/"), Priority: math.MaxInt}
+		if !strings.Contains(entry.URL, "://") {
+			return nil, fmt.Errorf("invalid mirror URL %q", fields[0])
+		}
+		for _, hint := range fields[1:] {
+			key, value, _ := strings.Cut(hint, ":")
+			switch key {
+			case "priority":
+				if p, err := strconv.Atoi(value); err == nil {
+					entry.Priority = p
+				}
+			case "arch":
+				entry.Archs = append(entry.Archs, value)
+			case "type":
+				entry.Types = append(entry.Types, value)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	slices.SortStableFunc(entries, func(a, b mirrorListEntry) int { return a.Priority - b.Priority })
+	return entries, nil
+}
+
+// resolveMirrorLists sets the mirrors in use for this run (see mirrors) to the configured
+// RepoURLs and ArchURLs, with every mirror list replaced by the mirrors it lists, fetched
+// afresh on every run. Mirrors restricted to some architectures are added after the
+// others, as failover candidates, and the preferred one for each mirrored architecture
+// becomes its ArchURLs entry unless one is configured explicitly. Mirrors that only serve
+// other architectures, or only deb-src, are skipped. The configuration is left untouched.
+func (d *dittoRepo) resolveMirrorLists(ctx context.Context) error {
+	if !slices.ContainsFunc(d.config.RepoURLs, isMirrorListURL) {
+		return nil
+	}
+
+	var repoURLs, archMirrors []string
+	archURLs := maps.Clone(d.config.ArchURLs)
+	for _, source := range d.config.RepoURLs {
+		if !isMirrorListURL(source) {
+			repoURLs = append(repoURLs, source)
+			continue
+		}
+		entries, err := d.fetchMirrorList(ctx, source)
+		if err != nil {
+			return fmt.Errorf("cannot read mirror list %s: %w", source, err)
+		}
+		used := 0
+		for _, entry := range entries {
+			if len(entry.Types) > 0 && !slices.Contains(entry.Types, "deb") {
+				continue
+			}
+			if len(entry.Archs) == 0 {
+				repoURLs = append(repoURLs, entry.URL)
+				used++
+				continue
+			}
+			var archs []string
+			for _, arch := range entry.Archs {
+				if slices.Contains(d.config.Archs, arch) {
+					archs = append(archs, arch)
+				}
+			}
+			if len(archs) == 0 {
+				continue
+			}
+			archMirrors = append(archMirrors, entry.URL)
+			used++
+			for _, arch := range archs {
+				if _, ok := archURLs[arch]; !ok {
+					if archURLs == nil {
+						archURLs = make(map[string]string)
+					}
+					archURLs[arch] = entry.URL
+				}
+			}
+		}
+		d.logger.Info(fmt.Sprintf("Mirror list %s: using %d of %d mirrors", source, used, len(entries)))
+	}
+
+	repoURLs = append(repoURLs, archMirrors...)
+	if len(repoURLs) == 0 {
+		return fmt.Errorf("no usable mirror in %s", strings.Join(d.config.RepoURLs, ", "))
+	}
+	d.mirrorsMu.Lock()
+	defer d.mirrorsMu.Unlock()
+	d.repoURLs, d.archURLs = repoURLs, archURLs
+	return nil
+}
+
+// fetchMirrorList downloads and parses the mirror list at source. It is downloaded through
+// the FileSystem to a scratch file outside DownloadPath, so that it is never published with
+// the mirror, and kept out of the validator cache since the file is removed once read.
+func (d *dittoRepo) fetchMirrorList(ctx context.Context, source string) ([]mirrorListEntry, error) {
+	location := mirrorListLocation(source)
+	i := strings.LastIndex(location, "/")
+	if i < 0 || i == len(location)-1 {
+		return nil, fmt.Errorf("invalid mirror list URL %q", source)
+	}
+	tmpPath := path.Join(os.TempDir(), fmt.Sprintf("ditto-mirrorlist-%d", os.Getpid()))
+	defer func() { _ = d.fs.Remove(tmpPath) }()
+	if _, err := d.downloadScratch(ctx, []string{location[:i]}, location[i+1:], tmpPath); err != nil {
+		return nil, err
+	}
+	data, err := d.fs.ReadFile(tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	return parseMirrorList(data)
+}
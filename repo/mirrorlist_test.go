@@ -0,0 +1,157 @@
+package repo
+
+import (
+	"context"
+	"io/fs"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestParseMirrorList(t *testing.T) {
+	entries, err := parseMirrorList([]byte(`# Ubuntu mirrors
+http://b.example/ubuntu/	priority:2
+http://ports.example/ubuntu	priority:1	arch:arm64	arch:armhf
+http://a.example/ubuntu	priority:1	type:deb
+http://c.example/ubuntu	priority:oops	other:hint
+
+http://src.example/ubuntu	type:deb-src
+`))
+	if err != nil {
+		t.Fatalf("parseMirrorList failed: %v", err)
+	}
+	var urls []string
+	for _, e := range entries {
+		urls = append(urls, e.URL)
+	}
+	want := []string{"http://ports.example/ubuntu", "http://a.example/ubuntu", "http://b.example/ubuntu", "http://c.example/ubuntu", "http://src.example/ubuntu"}
+	if !slices.Equal(urls, want) {
+		t.Errorf("URLs = %v, want %v", urls, want)
+	}
+	if !slices.Equal(entries[0].Archs, []string{"arm64", "armhf"}) || !slices.Equal(entries[4].Types, []string{"deb-src"}) {
+		t.Errorf("hints not parsed: %+v", entries)
+	}
+
+	if _, err := parseMirrorList([]byte("archive.ubuntu.com/ubuntu\n")); err == nil {
+		t.Error("expected an error for a mirror without a scheme")
+	}
+}
+
+func TestMirrorListLocation(t *testing.T) {
+	for source, want := range map[string]string{
+		"mirror://mirrors.ubuntu.com/mirrors.txt":    "http://mirrors.ubuntu.com/mirrors.txt",
+		"mirror+https://mirrors.example/list.txt":    "https://mirrors.example/list.txt",
+		"mirror+file:///etc/apt/mirrors/ubuntu.list": "file:///etc/apt/mirrors/ubuntu.list",
+	} {
+		if !isMirrorListURL(source) {
+			t.Errorf("isMirrorListURL(%s) = false", source)
+		}
+		if got := mirrorListLocation(source); got != want {
+			t.Errorf("mirrorListLocation(%s) = %s, want %s", source, got, want)
+		}
+	}
+	if isMirrorListURL("http://archive.ubuntu.com/ubuntu") {
+		t.Error("a repository URL was taken for a mirror list")
+	}
+}
+
+func TestResolveMirrorLists(t *testing.T) {
+	list := filepath.Join(t.TempDir(), "mirrors.list")
+	if err := os.WriteFile(list, []byte(`http://b.example/ubuntu	priority:2
+http://a.example/ubuntu	priority:1
+http://ports2.example/ubuntu	priority:2	arch:arm64
+http://ports1.example/ubuntu	priority:1	arch:arm64	arch:riscv64
+http://s390x.example/ubuntu	arch:s390x
+http://src.example/ubuntu	type:deb-src
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	memFS := NewMemFileSystem()
+	repo := NewDittoRepo(DittoConfig{
+		RepoURLs:     []string{"http://local.example/ubuntu", "mirror+file://" + list},
+		ArchURLs:     map[string]string{"riscv64": "http://riscv.example/ubuntu"},
+		Archs:        []string{"amd64", "arm64", "riscv64"},
+		DownloadPath: "/mirror",
+		MaxRetries:   -1,
+		Logger:       &mockLogger{},
+		FileSystem:   memFS,
+	}).(*dittoRepo)
+
+	// Resolving twice must start again from the configured sources.
+	for range 2 {
+		if err := repo.resolveMirrorLists(context.Background()); err != nil {
+			t.Fatalf("resolveMirrorLists failed: %v", err)
+		}
+		repoURLs, archURLs := repo.mirrors()
+		wantRepo := []string{"http://local.example/ubuntu", "http://a.example/ubuntu", "http://b.example/ubuntu", "http://ports1.example/ubuntu", "http://ports2.example/ubuntu"}
+		if !slices.Equal(repoURLs, wantRepo) {
+			t.Errorf("RepoURLs = %v, want %v", repoURLs, wantRepo)
+		}
+		// The explicit riscv64 preference wins over the list.
+		wantArch := map[string]string{"arm64": "http://ports1.example/ubuntu", "riscv64": "http://riscv.example/ubuntu"}
+		if !maps.Equal(archURLs, wantArch) {
+			t.Errorf("ArchURLs = %v, want %v", archURLs, wantArch)
+		}
+	}
+	// The configuration keeps the mirror list, and nothing is left on the FileSystem.
+	if want := []string{"http://local.example/ubuntu", "mirror+file://" + list}; !slices.Equal(repo.config.RepoURLs, want) {
+		t.Errorf("configured RepoURLs changed to %v", repo.config.RepoURLs)
+	}
+	_ = memFS.WalkDir("/", func(p string, de fs.DirEntry, err error) error {
+		if err == nil && !de.IsDir() {
+			t.Errorf("the mirror list was left on the FileSystem as %s", p)
+		}
+		return nil
+	})
+
+	repo.config.RepoURLs = []string{"mirror+file://" + filepath.Join(filepath.Dir(list), "missing.list")}
+	if err := repo.resolveMirrorLists(context.Background()); err == nil {
+		t.Error("expected an error for a missing mirror list")
+	}
+}
+
+func TestResolveMirrorLists_NotCached(t *testing.T) {
+	var requests, conditional int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" {
+			conditional++
+		}
+		w.Header().Set("ETag", `"list"`)
+		_, _ = w.Write([]byte("http://a.example/ubuntu\n"))
+	}))
+	defer srv.Close()
+
+	memFS := NewMemFileSystem()
+	repo := NewDittoRepo(DittoConfig{
+		RepoURLs:     []string{"mirror+" + srv.URL + "/mirrors.txt"},
+		DownloadPath: "/mirror",
+		MaxRetries:   -1,
+		Logger:       &mockLogger{},
+		FileSystem:   memFS,
+		HTTP:         HTTPConfig{ValidatorCache: "/cache/validators.json"},
+	}).(*dittoRepo)
+
+	// The list is removed once read, so it must be fetched in full on every run rather
+	// than requested conditionally for a file that is gone.
+	for range 2 {
+		if err := repo.resolveMirrorLists(context.Background()); err != nil {
+			t.Fatalf("resolveMirrorLists failed: %v", err)
+		}
+		if repoURLs, _ := repo.mirrors(); !slices.Equal(repoURLs, []string{"http://a.example/ubuntu"}) {
+			t.Errorf("RepoURLs = %v", repoURLs)
+		}
+	}
+	if requests != 2 || conditional != 0 {
+		t.Errorf("got %d requests, %d conditional; want 2, 0", requests, conditional)
+	}
+	validators := repo.downloader.(*schemeDownloader).remote.(*HTTPDownloader).validators
+	if _, ok := validators.get(srv.URL + "/mirrors.txt"); ok {
+		t.Error("the mirror list was recorded in the validator cache")
+	}
+}
@@ -0,0 +1,225 @@
+package repo
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ulikunitz/xz"
+
+	"github.com/canonical/ditto-repo/deb822"
+)
+
+// releaseDateFormat is the format of the Date field of a Release file.
+const releaseDateFormat = "Mon, 02 Jan 2006 15:04:05 UTC"
+
+// publishedIndexExts are the variants written for every regenerated Packages index.
+var publishedIndexExts = []string{"", ".gz", ".xz"}
+
+// publishDistribution regenerates the Packages indices of dist so they only list the packages
+// that were mirrored (those passing the package filters, dependency closure and version
+// retention), then writes a new Release file covering the regenerated indices and every
+// other index fetched for dist, and signs it with the configured SigningKey.
+// downloadedIndices are the local paths fetched from upstream during this sync; the Release
+// file on disk is still the upstream one when this is called.
+func (d *dittoRepo) publishDistribution(ctx context.Context, dist string, downloadedIndices []string) error {
+	distDir := path.Join(d.config.DownloadPath, d.distDir(dist))
+	releasePath := path.Join(distDir, "Release")
+
+	upstream, err := d.fs.ReadFile(releasePath)
+	if err != nil {
+		return fmt.Errorf("cannot read local Release file: %w", err)
+	}
+	release, err := d.newDeb822Reader(bytes.NewReader(upstream), releasePath).Next()
+	if err != nil {
+		return fmt.Errorf("cannot parse Release file: %w", err)
+	}
+	// Invalid entries were already reported when the Release file was first parsed.
+	upstreamSums, _ := deb822.ParseChecksums(release.Get("SHA256"))
+
+	packagesIndices := slices.DeleteFunc(slices.Clone(downloadedIndices), func(p string) bool {
+		stem, _ := splitCompressionExt(path.Base(p))
+		return stem != "Packages"
+	})
+
+	// 1. Regenerate each Packages index from one of its upstream variants.
+	regeneratedStems := make(map[string]bool) // local paths without compression extension
+	var sums []deb822.Checksum
+	err = d.forEachIndex(ctx, packagesIndices, func(localIndexPath string) error {
+		var kept []deb822.Stanza
+		err := d.forEachMirroredPackage(localIndexPath, func(stanza deb822.Stanza) error {
+			kept = append(kept, stanza)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		stem, _ := splitCompressionExt(localIndexPath)
+		written, err := d.writeIndexVariants(stem, kept)
+		if err != nil {
+			return err
+		}
+		d.logger.Info(fmt.Sprintf("  -> Regenerated %s with %d packages.\n", stem, len(kept)))
+
+		regeneratedStems[stem] = true
+		for localPath, sum := range written {
+			sum.Name = strings.TrimPrefix(localPath, distDir+"/")
+			sums = append(sums, sum)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// 2. Keep the upstream entries of every other index fetched in this sync; their
+	// content was verified against these hashes on download.
+	for _, sum := range upstreamSums {
+		localPath := path.Join(distDir, sum.Name)
+		stem, _ := splitCompressionExt(localPath)
+		if regeneratedStems[stem] || !slices.Contains(downloadedIndices, localPath) {
+			continue
+		}
+		sums = append(sums, sum)
+	}
+	slices.SortFunc(sums, func(a, b deb822.Checksum) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	// 3. Write the new Release file. Only SHA256 is listed, which is all apt requires;
+	// Valid-Until no longer applies to our copy.
+	var list strings.Builder
+	for _, sum := range sums {
+		fmt.Fprintf(&list, "\n%s %8d %s", sum.Hash, sum.Size, sum.Name)
+	}
+	for _, field := range []string{"MD5Sum", "SHA1", "SHA512", "Valid-Until"} {
+		release.Del(field)
+	}
+	release.Set("Date", time.Now().UTC().Format(releaseDateFormat))
+	release.Set("SHA256", list.String())
+
+	var releaseBuf bytes.Buffer
+	if _, err := release.WriteTo(&releaseBuf); err != nil {
+		return err
+	}
+	if err := d.writeFileAtomic(releasePath, releaseBuf.Bytes()); err != nil {
+		return fmt.Errorf("cannot write Release file: %w", err)
+	}
+
+	// 4. Sign it, or drop the upstream signatures that no longer match.
+	if d.config.SigningKey == "" {
+		d.logger.Warn(fmt.Sprintf("No signing key configured: the regenerated Release file for %s is unsigned", dist))
+		_ = d.fs.Remove(path.Join(distDir, "InRelease"))
+		_ = d.fs.Remove(path.Join(distDir, "Release.gpg"))
+		return nil
+	}
+	inRelease, releaseGPG, err := d.signRelease(releaseBuf.Bytes())
+	if err != nil {
+		return fmt.Errorf("cannot sign Release file: %w", err)
+	}
+	if err := d.writeFileAtomic(path.Join(distDir, "InRelease"), inRelease); err != nil {
+		return fmt.Errorf("cannot write InRelease file: %w", err)
+	}
+	if err := d.writeFileAtomic(path.Join(distDir, "Release.gpg"), releaseGPG); err != nil {
+		return fmt.Errorf("cannot write Release.gpg file: %w", err)
+	}
+	d.logger.Info(fmt.Sprintf("Published regenerated indices for %s.", dist))
+	return nil
+}
+
+// writeIndexVariants writes stanzas as the uncompressed, gzip and xz variants of the index
+// at stem (a local path without compression extension), creating a by-hash link for each.
+// Other variants of the same index are removed, as they would still list the unfiltered
+// upstream content, and so are the by-hash links of every variant replaced. It returns the
+// checksum of every file written, keyed by local path.
+func (d *dittoRepo) writeIndexVariants(stem string, stanzas []deb822.Stanza) (map[string]deb822.Checksum, error) {
+	var plain bytes.Buffer
+	if err := deb822.Write(&plain, stanzas); err != nil {
+		return nil, err
+	}
+
+	var gz bytes.Buffer
+	gzWriter := gzip.NewWriter(&gz)
+	if _, err := gzWriter.Write(plain.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := gzWriter.Close(); err != nil {
+		return nil, err
+	}
+
+	var xzBuf bytes.Buffer
+	xzWriter, err := xz.NewWriter(&xzBuf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := xzWriter.Write(plain.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := xzWriter.Close(); err != nil {
+		return nil, err
+	}
+
+	contents := map[string][]byte{"": plain.Bytes(), ".gz": gz.Bytes(), ".xz": xzBuf.Bytes()}
+	hashes := make(map[string]string, len(contents))
+	current := make(map[string]bool, len(contents))
+	for ext, data := range contents {
+		sum := sha256.Sum256(data)
+		hashes[ext] = hex.EncodeToString(sum[:])
+		current[hashes[ext]] = true
+	}
+
+	// The by-hash links of the variants on disk, such as the unfiltered upstream ones,
+	// would keep serving them to clients fetching by hash.
+	for _, ext := range append([]string{""}, indexCompressionExts...) {
+		if hash, err := d.fileSHA256(stem + ext); err == nil && !current[hash] {
+			_ = d.fs.Remove(path.Join(path.Dir(stem), "by-hash", "SHA256", hash))
+		}
+	}
+
+	written := make(map[string]deb822.Checksum, len(contents))
+	for _, ext := range publishedIndexExts {
+		data, hash := contents[ext], hashes[ext]
+		if err := d.writeFileAtomic(stem+ext, data); err != nil {
+			return nil, err
+		}
+		if err := d.createByHashLink(stem+ext, hash); err != nil {
+			d.logger.Warn(fmt.Sprintf("  cannot create by-hash link: %v\n", err))
+		}
+		written[stem+ext] = deb822.Checksum{Hash: hash, Size: int64(len(data))}
+	}
+
+	for _, ext := range indexCompressionExts {
+		if !slices.Contains(publishedIndexExts, ext) {
+			_ = d.fs.Remove(stem + ext)
+		}
+	}
+	return written, nil
+}
+
+// writeFileAtomic writes data to a temporary file next to dest and renames it into place,
+// so readers never observe a partially written file.
+func (d *dittoRepo) writeFileAtomic(dest string, data []byte) error {
+	tmpPath := dest + ".tmp"
+	f, err := d.fs.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		_ = d.fs.Remove(tmpPath)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		_ = d.fs.Remove(tmpPath)
+		return err
+	}
+	return d.fs.Rename(tmpPath, dest)
+}
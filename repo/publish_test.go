@@ -0,0 +1,273 @@
+package repo
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+
+	"github.com/canonical/ditto-repo/deb822"
+)
+
+const publishPackages = `Package: keep-me
+Filename: pool/main/k/keep-me/keep-me_1_amd64.deb
+SHA256: 01
+Description: kept package
+ with a long description
+
+Package: drop-me
+Filename: pool/main/d/drop-me/drop-me_1_amd64.deb
+SHA256: 02
+`
+
+// armoredPrivateKey serialises e, including its private key, as an armored keyring.
+func armoredPrivateKey(t *testing.T, e *openpgp.Entity) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SerializePrivate(w, nil); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	return buf.Bytes()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// newPublishTestRepo seeds a mirrored focal distribution whose upstream Release lists a
+// Packages.gz index (with two packages) and a translation.
+func newPublishTestRepo(t *testing.T, signingKey string) (*dittoRepo, *MemFileSystem) {
+	t.Helper()
+
+	var gz bytes.Buffer
+	gzW := gzip.NewWriter(&gz)
+	_, _ = gzW.Write([]byte(publishPackages))
+	gzW.Close()
+	translation := []byte("Package: keep-me\nDescription-en: kept package\n")
+
+	release := fmt.Sprintf(`Origin: Ubuntu
+Suite: focal
+Date: Thu, 23 Apr 2020 17:33:17 UTC
+Valid-Until: Thu, 30 Apr 2020 17:33:17 UTC
+MD5Sum:
+ d41d8cd98f00b204e9800998ecf8427e        0 main/binary-amd64/Packages.gz
+SHA256:
+ %s %8d main/binary-amd64/Packages.gz
+ %s %8d main/i18n/Translation-en
+ %s %8d universe/binary-amd64/Packages.gz
+`, sha256Hex(gz.Bytes()), gz.Len(), sha256Hex(translation), len(translation), strings.Repeat("0", 64), 10)
+
+	memFS := NewMemFileSystem().(*MemFileSystem)
+	_ = memFS.MkdirAll("/mirror/dists/focal/main/binary-amd64", 0o755)
+	_ = memFS.MkdirAll("/mirror/dists/focal/main/i18n", 0o755)
+	_ = memFS.MkdirAll("/keys", 0o755)
+	memFS.mu.Lock()
+	memFS.files["/mirror/dists/focal/Release"] = &memFile{data: []byte(release), mode: 0o644, modTime: time.Now()}
+	memFS.files["/mirror/dists/focal/InRelease"] = &memFile{data: []byte("upstream signature"), mode: 0o644, modTime: time.Now()}
+	memFS.files["/mirror/dists/focal/main/binary-amd64/Packages.gz"] = &memFile{data: gz.Bytes(), mode: 0o644, modTime: time.Now()}
+	memFS.files["/mirror/dists/focal/main/binary-amd64/Packages.bz2"] = &memFile{data: []byte("stale"), mode: 0o644, modTime: time.Now()}
+	// The by-hash links of the upstream variants, as created when they were fetched.
+	memFS.files["/mirror/dists/focal/main/binary-amd64/by-hash/SHA256/"+sha256Hex(gz.Bytes())] = &memFile{data: gz.Bytes(), mode: 0o644, modTime: time.Now()}
+	memFS.files["/mirror/dists/focal/main/binary-amd64/by-hash/SHA256/"+sha256Hex([]byte("stale"))] = &memFile{data: []byte("stale"), mode: 0o644, modTime: time.Now()}
+	memFS.files["/mirror/dists/focal/main/i18n/Translation-en"] = &memFile{data: translation, mode: 0o644, modTime: time.Now()}
+	memFS.mu.Unlock()
+
+	repo := NewDittoRepo(DittoConfig{
+		RepoURL:           "http://example.com/ubuntu",
+		Dists:             []string{"focal"},
+		Components:        []string{"main"},
+		Archs:             []string{"amd64"},
+		Languages:         []string{"en"},
+		DownloadPath:      "/mirror",
+		IncludePackages:   []string{"keep-*"},
+		RegenerateIndices: true,
+		SigningKey:        signingKey,
+		Logger:            &mockLogger{},
+		FileSystem:        memFS,
+		Downloader:        &mockDownloader{},
+	}).(*dittoRepo)
+	return repo, memFS
+}
+
+func TestPublishDistribution(t *testing.T) {
+	signer := newTestEntity(t, "local mirror")
+	repo, memFS := newPublishTestRepo(t, "/keys/mirror.asc")
+	memFS.mu.Lock()
+	memFS.files["/keys/mirror.asc"] = &memFile{data: armoredPrivateKey(t, signer), mode: 0o600, modTime: time.Now()}
+	memFS.files["/keys/mirror.pub"] = &memFile{data: armoredPublicKey(t, signer), mode: 0o644, modTime: time.Now()}
+	memFS.mu.Unlock()
+
+	downloaded := []string{
+		"/mirror/dists/focal/main/binary-amd64/Packages.gz",
+		"/mirror/dists/focal/main/i18n/Translation-en",
+	}
+	upstreamGz, _ := memFS.ReadFile("/mirror/dists/focal/main/binary-amd64/Packages.gz")
+	if err := repo.publishDistribution(context.Background(), "focal", downloaded); err != nil {
+		t.Fatalf("publishDistribution failed: %v", err)
+	}
+
+	// The regenerated index only lists the package passing the filter.
+	plain, err := memFS.ReadFile("/mirror/dists/focal/main/binary-amd64/Packages")
+	if err != nil {
+		t.Fatalf("uncompressed index not written: %v", err)
+	}
+	stanzas, err := deb822.ParseAll(bytes.NewReader(plain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stanzas) != 1 || stanzas[0].Get("Package") != "keep-me" {
+		t.Fatalf("regenerated index = %q, want only keep-me", plain)
+	}
+	if got := stanzas[0].Get("Description"); got != "kept package\nwith a long description" {
+		t.Errorf("multi-line field not preserved: %q", got)
+	}
+	for _, ext := range []string{".gz", ".xz"} {
+		r, err := memFS.Open("/mirror/dists/focal/main/binary-amd64/Packages" + ext)
+		if err != nil {
+			t.Fatalf("Packages%s not written: %v", ext, err)
+		}
+		dr, err := decompressReader(r, "Packages"+ext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(dr)
+		if !bytes.Equal(data, plain) {
+			t.Errorf("Packages%s does not match the uncompressed index", ext)
+		}
+	}
+	if _, err := memFS.Stat("/mirror/dists/focal/main/binary-amd64/Packages.bz2"); err == nil {
+		t.Error("stale unfiltered Packages.bz2 was not removed")
+	}
+	for _, data := range [][]byte{upstreamGz, []byte("stale")} {
+		if _, err := memFS.Stat("/mirror/dists/focal/main/binary-amd64/by-hash/SHA256/" + sha256Hex(data)); err == nil {
+			t.Errorf("by-hash link of an unfiltered variant was kept: %s", sha256Hex(data))
+		}
+	}
+
+	// The new Release lists the regenerated variants with their real hashes, keeps the
+	// translation's upstream entry and drops entries for files that were not fetched.
+	releaseData, _ := memFS.ReadFile("/mirror/dists/focal/Release")
+	release, err := deb822.NewReader(bytes.NewReader(releaseData)).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"MD5Sum", "Valid-Until"} {
+		if _, ok := release.Lookup(field); ok {
+			t.Errorf("Release still has %s", field)
+		}
+	}
+	if release.Get("Date") == "Thu, 23 Apr 2020 17:33:17 UTC" {
+		t.Error("Release Date was not updated")
+	}
+	sums, err := deb822.ParseChecksums(release.Get("SHA256"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed := make(map[string]deb822.Checksum)
+	for _, sum := range sums {
+		listed[sum.Name] = sum
+	}
+	if len(listed) != 4 {
+		t.Errorf("Release lists %d files, want 4: %v", len(listed), sums)
+	}
+	for _, name := range []string{"main/binary-amd64/Packages", "main/binary-amd64/Packages.gz", "main/binary-amd64/Packages.xz", "main/i18n/Translation-en"} {
+		data, err := memFS.ReadFile("/mirror/dists/focal/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum, ok := listed[name]
+		if !ok {
+			t.Errorf("Release does not list %s", name)
+			continue
+		}
+		if sum.Hash != sha256Hex(data) || sum.Size != int64(len(data)) {
+			t.Errorf("Release entry for %s = %+v, does not match the file", name, sum)
+		}
+		if path.Base(path.Dir(name)) == "binary-amd64" {
+			if _, err := memFS.Stat(path.Join("/mirror/dists/focal", path.Dir(name), "by-hash/SHA256", sum.Hash)); err != nil {
+				t.Errorf("no by-hash link for %s", name)
+			}
+		}
+	}
+
+	// Both signatures verify against the local public key.
+	repo.config.Keyrings = []string{"/keys/mirror.pub"}
+	if err := repo.verifyReleaseSignature("focal"); err != nil {
+		t.Errorf("regenerated Release does not verify: %v", err)
+	}
+	inRelease, _ := memFS.ReadFile("/mirror/dists/focal/InRelease")
+	if bytes.Equal(inRelease, []byte("upstream signature")) {
+		t.Error("InRelease was not re-signed")
+	}
+}
+
+func TestPublishDistribution_Unsigned(t *testing.T) {
+	repo, memFS := newPublishTestRepo(t, "")
+	downloaded := []string{"/mirror/dists/focal/main/binary-amd64/Packages.gz"}
+	if err := repo.publishDistribution(context.Background(), "focal", downloaded); err != nil {
+		t.Fatalf("publishDistribution failed: %v", err)
+	}
+	if _, err := memFS.Stat("/mirror/dists/focal/InRelease"); err == nil {
+		t.Error("upstream InRelease no longer matches and should have been removed")
+	}
+}
+
+func TestLoadSigningKey_EncryptedSubkeys(t *testing.T) {
+	// Only the signing subkeys are protected, as when the primary key is kept offline.
+	signer := newTestEntity(t, "local mirror")
+	for _, sub := range signer.Subkeys {
+		if err := sub.PrivateKey.Encrypt([]byte("s3cret")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	key := armoredPrivateKey(t, signer)
+
+	tests := []struct {
+		name           string
+		passphrase     string
+		passphraseFile string
+		wantErr        bool
+	}{
+		{name: "passphrase", passphrase: "s3cret"},
+		{name: "passphrase file", passphraseFile: "/keys/passphrase"},
+		{name: "wrong passphrase", passphrase: "wrong", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo, memFS := newPublishTestRepo(t, "/keys/mirror.asc")
+			repo.config.SigningKeyPassphrase = tt.passphrase
+			repo.config.SigningKeyPassphraseFile = tt.passphraseFile
+			memFS.mu.Lock()
+			memFS.files["/keys/mirror.asc"] = &memFile{data: key, mode: 0o600, modTime: time.Now()}
+			memFS.files["/keys/passphrase"] = &memFile{data: []byte("s3cret\n"), mode: 0o600, modTime: time.Now()}
+			memFS.mu.Unlock()
+
+			_, _, err := repo.signRelease([]byte("Origin: Ubuntu\n"))
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("signRelease failed: %v", err)
+			}
+		})
+	}
+}
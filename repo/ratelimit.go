@@ -0,0 +1,298 @@
+package repo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimitChunk is the largest read charged to a rate limiter at once, so that the
+// workers sharing a limit take turns in small steps instead of whole files.
+const rateLimitChunk = 32 * 1024
+
+// ByteRate is a transfer rate in bytes per second. In JSON it is either a number of bytes
+// or a string with a binary unit such as "512K", "10M" or "1.5GiB/s".
+type ByteRate int64
+
+// ParseByteRate parses a rate such as "800", "512K", "10MB" or "1.5GiB/s". Units are
+// powers of 1024 and case-insensitive; the "B", "iB" and "/s" suffixes are optional.
+func ParseByteRate(s string) (ByteRate, error) {
+	str := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "/S")
+	str = strings.TrimSuffix(strings.TrimSuffix(str, "B"), "I")
+	multiplier := 1.0
+	if str != "" {
+		if i := strings.IndexByte("KMG", str[len(str)-1]); i >= 0 {
+			multiplier = float64(int64(1) << (10 * (i + 1)))
+			str = str[:len(str)-1]
+		}
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return ByteRate(v * multiplier), nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (r ByteRate) MarshalJSON() ([]byte, error) {
+	return json.Marshal(int64(r))
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (r *ByteRate) UnmarshalJSON(data []byte) error {
+	var n int64
+	if err := json.Unmarshal(data, &n); err == nil {
+		if n < 0 {
+			return fmt.Errorf("invalid rate %d", n)
+		}
+		*r = ByteRate(n)
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("rate must be a number of bytes or a string such as \"10M\": %w", err)
+	}
+	v, err := ParseByteRate(s)
+	if err != nil {
+		return err
+	}
+	*r = v
+	return nil
+}
+
+// RateLimitWindow overrides the global rate limit during part of the day.
+type RateLimitWindow struct {
+	// Start and End are local times of day ("08:00", "18:30"). A window whose End is not
+	// after its Start spans midnight.
+	Start string `json:"start"`
+	End   string `json:"end"`
+	// Days optionally restricts the window to some days of the week ("mon" ... "sun"); a
+	// window spanning midnight belongs to the day it starts on. Empty means every day.
+	Days []string `json:"days"`
+	// RateLimit applies while the window is active; zero means unlimited.
+	RateLimit ByteRate `json:"rate-limit"`
+}
+
+// rateLimitWindow is a RateLimitWindow parsed for matching.
+type rateLimitWindow struct {
+	start, end int                   // minutes since midnight
+	days       map[time.Weekday]bool // nil matches every day
+	rate       ByteRate
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func newRateLimitWindow(w RateLimitWindow) (rateLimitWindow, error) {
+	start, err := parseTimeOfDay(w.Start)
+	if err != nil {
+		return rateLimitWindow{}, err
+	}
+	end, err := parseTimeOfDay(w.End)
+	if err != nil {
+		return rateLimitWindow{}, err
+	}
+	window := rateLimitWindow{start: start, end: end, rate: w.RateLimit}
+	for _, day := range w.Days {
+		weekday, ok := weekdays[strings.ToLower(day)]
+		if !ok {
+			return rateLimitWindow{}, fmt.Errorf("invalid day %q in rate limit schedule", day)
+		}
+		if window.days == nil {
+			window.days = make(map[time.Weekday]bool)
+		}
+		window.days[weekday] = true
+	}
+	return window, nil
+}
+
+// parseTimeOfDay parses "HH:MM" into minutes since midnight.
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q in rate limit schedule", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// active reports whether the window applies at t.
+func (w rateLimitWindow) active(t time.Time) bool {
+	minutes := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	switch {
+	case w.start < w.end:
+		if minutes < w.start || minutes >= w.end {
+			return false
+		}
+	case minutes >= w.start:
+	case minutes < w.end:
+		// The early hours of a window that started the day before.
+		day = (day + 6) % 7
+	default:
+		return false
+	}
+	return w.days == nil || w.days[day]
+}
+
+// tokenBucket limits a byte stream to rate bytes per second, allowing bursts of up to one
+// second's worth. Callers that run out of tokens borrow against the future and wait for
+// the debt to be paid back, so a read larger than the bucket is still let through.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// reserve takes n tokens at now, at the given rate, and returns how long the caller must
+// wait before using them.
+func (b *tokenBucket) reserve(now time.Time, rate ByteRate, n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.last.IsZero() {
+		b.tokens = float64(rate)
+	} else {
+		// Refill at the rate in force until now, then switch to the current one.
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+	}
+	b.rate = float64(rate)
+	b.last = now
+	b.tokens = min(b.tokens, b.rate) - float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// bandwidthLimiter enforces the global and per-host rate limits of an HTTPConfig across
+// every download of an HTTPDownloader.
+type bandwidthLimiter struct {
+	rate      ByteRate
+	schedule  []rateLimitWindow
+	hostRates map[string]ByteRate
+	now       func() time.Time
+
+	global tokenBucket
+	mu     sync.Mutex
+	hosts  map[string]*tokenBucket
+}
+
+// newBandwidthLimiter returns the limiter configured by config, or nil when no limit is set.
+func newBandwidthLimiter(config HTTPConfig) (*bandwidthLimiter, error) {
+	if config.RateLimit == 0 && len(config.RateLimitSchedule) == 0 && len(config.HostRateLimits) == 0 {
+		return nil, nil
+	}
+	l := &bandwidthLimiter{
+		rate:      config.RateLimit,
+		hostRates: make(map[string]ByteRate),
+		now:       time.Now,
+		hosts:     make(map[string]*tokenBucket),
+	}
+	for _, w := range config.RateLimitSchedule {
+		window, err := newRateLimitWindow(w)
+		if err != nil {
+			return nil, err
+		}
+		l.schedule = append(l.schedule, window)
+	}
+	for host, rate := range config.HostRateLimits {
+		l.hostRates[strings.ToLower(host)] = rate
+	}
+	return l, nil
+}
+
+// globalRate returns the global limit in force at t: that of the first active schedule
+// window, or RateLimit outside all of them.
+func (l *bandwidthLimiter) globalRate(t time.Time) ByteRate {
+	for _, w := range l.schedule {
+		if w.active(t) {
+			return w.rate
+		}
+	}
+	return l.rate
+}
+
+// wait blocks until n bytes may be received from host under both the global limit and
+// that host's limit, or until ctx is cancelled.
+func (l *bandwidthLimiter) wait(ctx context.Context, host string, n int) error {
+	now := l.now()
+	var delay time.Duration
+	if rate := l.globalRate(now); rate > 0 {
+		delay = l.global.reserve(now, rate, n)
+	}
+	if rate := l.hostRates[strings.ToLower(host)]; rate > 0 {
+		l.mu.Lock()
+		bucket, ok := l.hosts[strings.ToLower(host)]
+		if !ok {
+			bucket = &tokenBucket{}
+			l.hosts[strings.ToLower(host)] = bucket
+		}
+		l.mu.Unlock()
+		delay = max(delay, bucket.reserve(now, rate, n))
+	}
+	if delay == 0 {
+		return nil
+	}
+	return sleepContext(ctx, delay)
+}
+
+// rateLimitedReader throttles the reads from r to the limits of host, adding the time
+// spent waiting for the limiter to throttled.
+type rateLimitedReader struct {
+	ctx       context.Context
+	r         io.Reader
+	limiter   *bandwidthLimiter
+	host      string
+	throttled *time.Duration
+}
+
+func (rr *rateLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > rateLimitChunk {
+		p = p[:rateLimitChunk]
+	}
+	n, err := rr.r.Read(p)
+	if n > 0 {
+		start := time.Now()
+		waitErr := rr.limiter.wait(rr.ctx, rr.host, n)
+		*rr.throttled += time.Since(start)
+		if waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// downloadOptions adjusts a single download by the built-in downloaders.
+type downloadOptions struct {
+	// scratch marks a destination that is removed right after it is read, such as a
+	// mirror list or the Release file fetched for a consistency check. It may still be
+	// requested conditionally, but the validator cache is left as it is, since its
+	// entries must point at files that stay on disk.
+	scratch bool
+}
+
+// throttledDownloader is implemented by the downloaders that apply rate limits. Besides
+// the hash, downloadFileThrottled reports how long the download was held back by the
+// limits, which is left out of the latency and throughput measured for the mirror.
+// Cancelling ctx also ends a wait for the limits.
+type throttledDownloader interface {
+	downloadFileThrottled(ctx context.Context, urlStr, destPath, expectedSHA256 string, opts downloadOptions) (string, time.Duration, error)
+}
+
+// downloadFileThrottled downloads urlStr with downloader, reporting the time it was held
+// back by rate limits when downloader applies them. opts only applies to the built-in
+// downloaders.
+func downloadFileThrottled(ctx context.Context, downloader Downloader, urlStr, destPath, expectedSHA256 string, opts downloadOptions) (string, time.Duration, error) {
+	if td, ok := downloader.(throttledDownloader); ok {
+		return td.downloadFileThrottled(ctx, urlStr, destPath, expectedSHA256, opts)
+	}
+	hash, err := downloader.DownloadFile(urlStr, destPath, expectedSHA256)
+	return hash, 0, err
+}
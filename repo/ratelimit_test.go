@@ -0,0 +1,213 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseByteRate(t *testing.T) {
+	tests := []struct {
+		in   string
+		want ByteRate
+	}{
+		{"800", 800},
+		{"512K", 512 * 1024},
+		{"512kb", 512 * 1024},
+		{"10M", 10 << 20},
+		{"10MiB/s", 10 << 20},
+		{"1.5G", 3 << 29},
+		{"0", 0},
+	}
+	for _, tt := range tests {
+		got, err := ParseByteRate(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseByteRate(%q) = %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+	}
+	for _, invalid := range []string{"", "fast", "-1M", "10T", "M"} {
+		if _, err := ParseByteRate(invalid); err == nil {
+			t.Errorf("ParseByteRate(%q): expected an error", invalid)
+		}
+	}
+}
+
+func TestByteRate_JSON(t *testing.T) {
+	var config HTTPConfig
+	err := json.Unmarshal([]byte(`{"rate-limit": "2M", "host-rate-limits": {"ports.ubuntu.com": 1024}}`), &config)
+	if err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if config.RateLimit != 2<<20 || config.HostRateLimits["ports.ubuntu.com"] != 1024 {
+		t.Errorf("got %d / %v", config.RateLimit, config.HostRateLimits)
+	}
+	if err := json.Unmarshal([]byte(`{"rate-limit": "lots"}`), &config); err == nil {
+		t.Error("expected an error for an invalid rate")
+	}
+}
+
+func TestRateLimitWindow_Active(t *testing.T) {
+	officeHours, err := newRateLimitWindow(RateLimitWindow{Start: "08:00", End: "18:00", Days: []string{"mon", "tue", "wed", "thu", "fri"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	weekendNights, err := newRateLimitWindow(RateLimitWindow{Start: "22:00", End: "06:00", Days: []string{"Sat"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2026-10-16 is a Friday.
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2026, 10, day, hour, minute, 0, 0, time.Local)
+	}
+	tests := []struct {
+		window rateLimitWindow
+		t      time.Time
+		want   bool
+	}{
+		{officeHours, at(16, 8, 0), true},
+		{officeHours, at(16, 17, 59), true},
+		{officeHours, at(16, 18, 0), false},
+		{officeHours, at(16, 7, 59), false},
+		{officeHours, at(17, 12, 0), false}, // Saturday
+		{weekendNights, at(17, 23, 0), true},
+		{weekendNights, at(18, 5, 59), true}, // Sunday morning, started on Saturday
+		{weekendNights, at(18, 23, 0), false},
+		{weekendNights, at(17, 5, 0), false}, // Saturday morning, started on Friday
+		{weekendNights, at(17, 12, 0), false},
+	}
+	for _, tt := range tests {
+		if got := tt.window.active(tt.t); got != tt.want {
+			t.Errorf("active(%s) = %v, want %v", tt.t.Format("Mon 15:04"), got, tt.want)
+		}
+	}
+
+	for _, invalid := range []RateLimitWindow{{Start: "8am", End: "18:00"}, {Start: "08:00", End: "25:00"}, {Start: "08:00", End: "18:00", Days: []string{"monday"}}} {
+		if _, err := newRateLimitWindow(invalid); err == nil {
+			t.Errorf("newRateLimitWindow(%+v): expected an error", invalid)
+		}
+	}
+}
+
+func TestBandwidthLimiter_Schedule(t *testing.T) {
+	l, err := newBandwidthLimiter(HTTPConfig{
+		RateLimit: 10 << 20,
+		RateLimitSchedule: []RateLimitWindow{
+			{Start: "08:00", End: "18:00", RateLimit: 1 << 20},
+			{Start: "12:00", End: "13:00", RateLimit: 0},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for hour, want := range map[int]ByteRate{7: 10 << 20, 9: 1 << 20, 12: 1 << 20, 20: 10 << 20} {
+		if got := l.globalRate(time.Date(2026, 10, 16, hour, 30, 0, 0, time.Local)); got != want {
+			t.Errorf("rate at %d:30 = %d, want %d", hour, got, want)
+		}
+	}
+
+	if l, err := newBandwidthLimiter(HTTPConfig{}); l != nil || err != nil {
+		t.Errorf("expected no limiter without limits, got %v, %v", l, err)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	var b tokenBucket
+	start := time.Now()
+	// The bucket starts full: one second's worth passes immediately.
+	if got := b.reserve(start, 1000, 1000); got != 0 {
+		t.Errorf("first reserve waits %v, want 0", got)
+	}
+	if got := b.reserve(start, 1000, 500); got != 500*time.Millisecond {
+		t.Errorf("reserve on an empty bucket waits %v, want 500ms", got)
+	}
+	// A second later the debt is paid back and 500 tokens have accumulated.
+	if got := b.reserve(start.Add(time.Second), 1000, 500); got != 0 {
+		t.Errorf("reserve after refill waits %v, want 0", got)
+	}
+	// The bucket never holds more than one second's worth.
+	if got := b.reserve(start.Add(time.Hour), 1000, 2000); got != time.Second {
+		t.Errorf("reserve after a long idle period waits %v, want 1s", got)
+	}
+}
+
+func TestHTTPDownloader_RateLimit(t *testing.T) {
+	content := bytes.Repeat([]byte("a"), 96*1024)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(content)
+	}))
+	defer srv.Close()
+
+	for name, config := range map[string]HTTPConfig{
+		"global":   {RateLimit: 128 * 1024},
+		"per host": {HostRateLimits: map[string]ByteRate{"127.0.0.1": 128 * 1024}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			downloader := newTestHTTPDownloader(t, NewMemFileSystem(), config)
+			// The first 128KiB pass as a burst; the remaining 64KiB take 500ms.
+			start := time.Now()
+			for _, dest := range []string{"/mirror/a.deb", "/mirror/b.deb"} {
+				if _, err := downloader.DownloadFile(srv.URL+"/a.deb", dest, ""); err != nil {
+					t.Fatalf("DownloadFile failed: %v", err)
+				}
+			}
+			if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+				t.Errorf("two downloads took %v, want about 500ms at the configured rate", elapsed)
+			}
+		})
+	}
+
+	downloader := newTestHTTPDownloader(t, NewMemFileSystem(), HTTPConfig{HostRateLimits: map[string]ByteRate{"other.example": 1}})
+	start := time.Now()
+	if _, err := downloader.DownloadFile(srv.URL+"/a.deb", "/mirror/a.deb", ""); err != nil {
+		t.Fatalf("DownloadFile failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("download from an unlimited host took %v", elapsed)
+	}
+}
+
+func TestHTTPDownloader_ReportsThrottledTime(t *testing.T) {
+	content := bytes.Repeat([]byte("a"), 192*1024)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(content)
+	}))
+	defer srv.Close()
+
+	// The first 128KiB pass as a burst; the remaining 64KiB are held back for 500ms, which
+	// must not count against the mirror.
+	downloader := newTestHTTPDownloader(t, NewMemFileSystem(), HTTPConfig{RateLimit: 128 * 1024})
+	start := time.Now()
+	_, throttled, err := downloadFileThrottled(context.Background(), downloader, srv.URL+"/a.deb", "/mirror/a.deb", "", downloadOptions{})
+	if err != nil {
+		t.Fatalf("download failed: %v", err)
+	}
+	elapsed := time.Since(start)
+	if throttled < 400*time.Millisecond || throttled > elapsed {
+		t.Errorf("throttled for %v of %v, want about 500ms", throttled, elapsed)
+	}
+}
+
+func TestHTTPDownloader_RateLimitHonoursCancellation(t *testing.T) {
+	content := bytes.Repeat([]byte("a"), 256*1024)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(content)
+	}))
+	defer srv.Close()
+
+	// At 1KiB/s the download would take minutes: cancelling must end the wait.
+	downloader := newTestHTTPDownloader(t, NewMemFileSystem(), HTTPConfig{RateLimit: 1024})
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, _, err := downloadFileThrottled(ctx, downloader, srv.URL+"/a.deb", "/mirror/a.deb", "", downloadOptions{}); err == nil {
+		t.Fatal("expected the cancelled download to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("cancelled download took %v", elapsed)
+	}
+}
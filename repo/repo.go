@@ -1,27 +1,55 @@
 package repo
 
 import (
-	"bufio"
-	"compress/gzip"
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"log/slog"
+	"os"
 	"path"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/canonical/ditto-repo/deb822"
 )
 
 const (
 	defaultWorkers = 5
+
+	defaultMaxRetries      = 3
+	defaultRetryBackoff    = Duration(time.Second)
+	defaultMaxRetryBackoff = Duration(30 * time.Second)
+
+	// validatorCacheDir is the directory of the default ValidatorCache files, in the
+	// user's cache directory.
+	validatorCacheDir = "ditto-repo"
 )
 
+// defaultValidatorCachePath returns the default ValidatorCache of the mirror at
+// downloadPath, outside of it so that it is not published: a file in the user's cache
+// directory named after the absolute downloadPath. It returns "" when there is no cache
+// directory.
+func defaultValidatorCachePath(downloadPath string) string {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	if abs, err := filepath.Abs(downloadPath); err == nil {
+		downloadPath = abs
+	}
+	sum := sha256.Sum256([]byte(downloadPath))
+	return filepath.Join(cacheDir, validatorCacheDir, "validators-"+hex.EncodeToString(sum[:8])+".json")
+}
+
 // VerifyMode controls how already-existing pool files are checked before
 // deciding whether to re-download them.
 type VerifyMode string
@@ -34,6 +62,29 @@ const (
 	VerifySize VerifyMode = "size"
 )
 
+// Duration is a time.Duration that is read from and written to JSON as a string such as
+// "500ms" or "1m30s".
+type Duration time.Duration
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
 // ProgressUpdate represents a progress event during mirroring
 type ProgressUpdate struct {
 	PackagesDownloaded int
@@ -61,12 +112,51 @@ type dittoRepo struct {
 	// served an arch-specific file. It is consulted only as a fallback when the user has
 	// not provided an explicit ArchURLs mapping for that architecture.
 	learnedArchURLs map[string]string
+
+	// health tracks the outcome of the downloads from each mirror; it demotes failing
+	// mirrors in candidateURLs and, with AdaptiveMirrorOrder, ranks the others.
+	health *mirrorHealth
+
+	// hostConns enforces MaxConnectionsPerHost and HostMaxConnections (nil when unset).
+	hostConns *hostConnLimiter
+
+	// mirrorsMu protects repoURLs and archURLs, the mirrors in use: RepoURLs and ArchURLs
+	// as configured, with every mirror list replaced by the mirrors it lists. They are
+	// resolved again at the start of every run (see resolveMirrorLists), while MirrorStats
+	// may read them from other goroutines.
+	mirrorsMu sync.RWMutex
+	repoURLs  []string
+	archURLs  map[string]string
+
+	// packageFilter selects which binary packages are mirrored (nil selects all). An
+	// invalid filter configuration is kept in packageFilterErr and reported by Mirror.
+	packageFilter    *packageFilter
+	packageFilterErr error
+
+	// downloaderErr holds the error from building the default HTTP downloader out of an
+	// invalid HTTP configuration; it is reported by Mirror.
+	downloaderErr error
+
+	// dependencyClosure holds the names of the packages reachable from SeedPackages,
+	// resolved once per Mirror run (nil when SeedPackages is not set).
+	dependencyClosure map[string]bool
+
+	// upstreamReleaseHashes records, per distribution, the SHA256 of the upstream Release
+	// file fetched at the start of the sync (protected by mu). It is what freshness is
+	// checked against when RegenerateIndices replaces the local Release file.
+	upstreamReleaseHashes map[string]string
 }
 
 // DittoConfig holds all configuration for the mirroring process
 type DittoConfig struct {
-	RepoURL  string   `json:"repo-url"`  // Deprecated: use RepoURLs instead
-	RepoURLs []string `json:"repo-urls"` // List of mirror base URLs serving identical Release files
+	RepoURL string `json:"repo-url"` // Deprecated: use RepoURLs instead
+	// RepoURLs lists mirror base URLs serving identical Release files. Besides http(s)
+	// URLs, file:// URLs and plain paths (an NFS mount, a USB drive) are accepted and read
+	// from the local filesystem by the default Downloader. An apt mirror list
+	// (mirror://host/path, mirror+https://..., mirror+file:///path) stands for the mirrors
+	// it lists, fetched at the start of every run: they are tried by priority, and those
+	// with arch hints become the ArchURLs preference of their architecture.
+	RepoURLs []string `json:"repo-urls"`
 	// ArchURLs optionally maps an architecture to the mirror base URL that should be
 	// tried first for that architecture's files (e.g. "arm64" -> "https://ports.ubuntu.com").
 	// This is only a preference; download still falls back to the full RepoURLs list.
@@ -80,6 +170,102 @@ type DittoConfig struct {
 	Workers             int               `json:"workers"`               // Number of concurrent download workers
 	VerifyMode          VerifyMode        `json:"verify-mode"`           // How existing pool files are checked (default: checksum)
 	AllowMissingIndices bool              `json:"allow-missing-indices"` // Warn instead of failing when a Packages index file cannot be fetched
+	// Keyrings lists OpenPGP keyring files (ASCII-armored or binary) trusted to sign the
+	// upstream Release files. When set, InRelease/Release.gpg must verify against them
+	// before any index is parsed; a missing or bad signature aborts the distribution.
+	Keyrings []string `json:"keyrings"`
+	// KeyFingerprints optionally pins the signing key. When non-empty, a signature is only
+	// accepted if it was made by one of these keys (or a subkey of them).
+	KeyFingerprints []string `json:"key-fingerprints"`
+	// Sources additionally mirrors source packages: the <component>/source/Sources indices
+	// and every .dsc, tarball and diff they reference.
+	Sources bool `json:"sources"`
+	// Contents additionally mirrors the Contents-<arch> indices used by apt-file, both the
+	// per-component ones and those at the top of the distribution.
+	Contents bool `json:"contents"`
+	// DebianInstaller additionally mirrors the debian-installer udeb indices
+	// (<component>/debian-installer/binary-<arch>/Packages) and the .udeb files they list,
+	// as needed for netboot and preseeded installs.
+	DebianInstaller bool `json:"debian-installer"`
+	// InstallerImages additionally mirrors the installer image trees of each component and
+	// architecture (<component>/installer-<arch>/current/images/ and, on Ubuntu, the
+	// <component>/uefi/ and <component>/signed/ trees), verifying every file against the
+	// tree's own SHA256SUMS.
+	InstallerImages bool `json:"installer-images"`
+	// Flat mirrors flat repositories ("deb https://example.com/repo ./"), which have no
+	// dists/ tree. Each entry of Dists is then a path relative to the repository URL (e.g.
+	// "./" or "stable/") holding the Release file and the Packages (and Sources) indices
+	// directly, without components or architectures.
+	Flat bool `json:"flat"`
+	// IncludePackages, when non-empty, restricts binary packages to those whose name
+	// matches one of these patterns. ExcludePackages drops packages whose name matches
+	// one of its patterns. Patterns are shell globs ("python3-*") or, when wrapped in
+	// slashes, regular expressions matched against the whole name ("/^lib.*-dev$/").
+	IncludePackages []string `json:"include-packages"`
+	ExcludePackages []string `json:"exclude-packages"`
+	// Sections and Priorities, when non-empty, restrict binary packages to those whose
+	// Section or Priority field matches one of these patterns (same syntax as above).
+	// Sections match with or without the component prefix ("universe/python" or "python").
+	Sections   []string `json:"sections"`
+	Priorities []string `json:"priorities"`
+	// SeedPackages, when non-empty, restricts binary packages to the dependency closure of
+	// these package names: the seeds plus everything they depend on, transitively, across
+	// the Packages indices of all configured distributions. Virtual packages resolve to
+	// every package that Provides them. The closure is applied in addition to the filters
+	// above.
+	SeedPackages []string `json:"seed-packages"`
+	// DependencyFields lists the relationship fields followed when resolving the closure
+	// of SeedPackages. Defaults to Pre-Depends and Depends; add Recommends (or Suggests)
+	// to follow those too.
+	DependencyFields []string `json:"dependency-fields"`
+	// KeepVersions, when positive, keeps only the newest KeepVersions versions (by Debian
+	// version comparison) of each binary package and architecture listed in a Packages
+	// index; older versions are not downloaded and are removed from the pool by cleanup.
+	KeepVersions int `json:"keep-versions"`
+	// MaxRetries is how many times a download that failed with a transient error (a 5xx,
+	// 429 or 408 status, a timeout or a dropped connection) is retried. Each retry goes
+	// through the mirrors that failed transiently again, after an exponential backoff with
+	// jitter. Defaults to 3; a negative value disables retries.
+	MaxRetries int `json:"max-retries"`
+	// RetryBackoff is the delay before the first retry (default 1s); it doubles with every
+	// retry up to MaxRetryBackoff (default 30s). A Retry-After header asking for a longer
+	// wait than MaxRetryBackoff makes that mirror fail over instead of being retried.
+	RetryBackoff    Duration `json:"retry-backoff"`
+	MaxRetryBackoff Duration `json:"max-retry-backoff"`
+	// MirrorFailureThreshold is the number of consecutive transient failures after which
+	// a mirror's circuit breaker opens: for MirrorCooldown (default 1m), it is only tried
+	// after every other mirror has failed. Defaults to 3; a negative value disables it.
+	MirrorFailureThreshold int      `json:"mirror-failure-threshold"`
+	MirrorCooldown         Duration `json:"mirror-cooldown"`
+	// AdaptiveMirrorOrder tries the mirrors in order of their measured latency, throughput
+	// and success rate instead of their configured order. An architecture preference
+	// (ArchURLs or a learned one) is still tried first.
+	AdaptiveMirrorOrder bool `json:"adaptive-mirror-order"`
+	// MaxConnectionsPerHost caps the downloads in flight to any one upstream host, across
+	// all Workers (default 0: unlimited). When a mirror's host is saturated, a download
+	// tries the other mirrors first and only then waits for a free connection.
+	MaxConnectionsPerHost int `json:"max-connections-per-host"`
+	// HostMaxConnections overrides MaxConnectionsPerHost for individual hosts, keyed by
+	// host name (e.g. "mirror.internal": 2); zero or negative is unlimited.
+	HostMaxConnections map[string]int `json:"host-max-connections"`
+	// HTTP configures the client used by the default HTTP downloader. It is ignored when a
+	// custom Downloader is set.
+	HTTP HTTPConfig `json:"http"`
+	// RegenerateIndices rewrites the Packages indices of every distribution after its pool
+	// has been mirrored so they only list the packages that were mirrored (as selected by
+	// the package filters and SeedPackages), writes a new Release file with matching hashes
+	// and sizes, and signs it with SigningKey. Without it, upstream indices and signatures
+	// are kept byte-for-byte.
+	RegenerateIndices bool `json:"regenerate-indices"`
+	// SigningKey is the path to the OpenPGP private key (ASCII-armored or binary) used to
+	// sign regenerated Release files as InRelease and Release.gpg. When empty, regenerated
+	// Release files are left unsigned.
+	SigningKey string `json:"signing-key"`
+	// SigningKeyPassphrase unlocks SigningKey when it is passphrase-protected.
+	SigningKeyPassphrase string `json:"signing-key-passphrase"`
+	// SigningKeyPassphraseFile is the path to a file holding the passphrase of SigningKey,
+	// read instead of SigningKeyPassphrase when set. A trailing newline is ignored.
+	SigningKeyPassphraseFile string `json:"signing-key-passphrase-file"`
 
 	// Optional custom implementations
 	Logger     Logger     `json:"-"`
@@ -87,6 +273,57 @@ type DittoConfig struct {
 	Downloader Downloader `json:"-"`
 }
 
+// HTTPConfig holds the settings of the HTTP client used to download from upstream.
+type HTTPConfig struct {
+	// ConnectTimeout bounds establishing a connection, including the TLS handshake
+	// (default 30s).
+	ConnectTimeout Duration `json:"connect-timeout"`
+	// ReadTimeout bounds waiting for the response headers and, while the body is being
+	// received, for each read to make progress (default 60s). It detects stalled
+	// transfers without limiting how long a large file may take overall.
+	ReadTimeout Duration `json:"read-timeout"`
+	// Timeout bounds a whole request, body included. Zero (the default) means no limit.
+	Timeout Duration `json:"timeout"`
+	// Proxy is the URL of the proxy to use for all requests, overriding the HTTP_PROXY,
+	// HTTPS_PROXY and NO_PROXY environment variables that apply otherwise.
+	Proxy string `json:"proxy"`
+	// CABundle is the path to a PEM file of CA certificates trusted in addition to the
+	// system roots, for repositories served with a private CA.
+	CABundle string `json:"ca-bundle"`
+	// ClientCert and ClientKey are the paths to a PEM client certificate and its private
+	// key, presented to servers requiring TLS client authentication. Both must be set.
+	ClientCert string `json:"client-cert"`
+	ClientKey  string `json:"client-key"`
+	// UserAgent is sent with every request (default "ditto-repo").
+	UserAgent string `json:"user-agent"`
+	// Credentials authenticate requests to private upstreams, each applied only to the
+	// requests matching its Machine (the first match wins).
+	Credentials []Credential `json:"credentials"`
+	// AuthConf lists apt auth.conf files, or auth.conf.d-style directories of *.conf
+	// files, to read further credentials from. They are consulted after Credentials.
+	AuthConf []string `json:"auth-conf"`
+	// RateLimit caps the combined download rate of all workers, in bytes per second
+	// (e.g. "10M"). Zero (the default) means unlimited.
+	RateLimit ByteRate `json:"rate-limit"`
+	// RateLimitSchedule replaces RateLimit during some hours of the day, such as a lower
+	// limit during office hours. The first active window wins; RateLimit applies outside
+	// all of them. The schedule is followed throughout the sync, so a long run changes
+	// rate as it crosses a window boundary.
+	RateLimitSchedule []RateLimitWindow `json:"rate-limit-schedule"`
+	// HostRateLimits additionally caps the download rate from individual upstream hosts,
+	// keyed by host name (e.g. "ports.ubuntu.com").
+	HostRateLimits map[string]ByteRate `json:"host-rate-limits"`
+	// ValidatorCache is the path of the file where the ETag and Last-Modified of the
+	// Release files and their signatures are kept, so that later runs fetch them with
+	// conditional requests and skip unchanged ones. It records upstream URLs, so it is
+	// best kept out of the published tree: with the default FileSystem, NewDittoRepo
+	// defaults it to a file named after DownloadPath in the "ditto-repo" directory of the
+	// user's cache directory (see os.UserCacheDir). When empty, validators are only kept in
+	// memory for the lifetime of the downloader. Files fetched only for a check, which are
+	// removed right after, are never recorded.
+	ValidatorCache string `json:"validator-cache"`
+}
+
 func NewDittoRepo(config DittoConfig) DittoRepo {
 	// Set default workers if not specified
 	if config.Workers <= 0 {
@@ -98,6 +335,22 @@ func NewDittoRepo(config DittoConfig) DittoRepo {
 		config.VerifyMode = VerifyChecksum
 	}
 
+	if config.MaxRetries == 0 {
+		config.MaxRetries = defaultMaxRetries
+	}
+	if config.RetryBackoff <= 0 {
+		config.RetryBackoff = defaultRetryBackoff
+	}
+	if config.MaxRetryBackoff <= 0 {
+		config.MaxRetryBackoff = defaultMaxRetryBackoff
+	}
+	if config.MirrorFailureThreshold == 0 {
+		config.MirrorFailureThreshold = defaultMirrorFailureThreshold
+	}
+	if config.MirrorCooldown <= 0 {
+		config.MirrorCooldown = defaultMirrorCooldown
+	}
+
 	// Backwards compatibility: if Dists is empty but Dist is set, use Dist
 	if len(config.Dists) == 0 && config.Dist != "" {
 		config.Dists = []string{config.Dist}
@@ -116,19 +369,42 @@ func NewDittoRepo(config DittoConfig) DittoRepo {
 		config.FileSystem = NewOsFileSystem()
 	}
 
+	// The default cache is a path on the host, so it is only used with the host's
+	// filesystem.
+	if _, ok := config.FileSystem.(*OsFileSystem); ok && config.HTTP.ValidatorCache == "" {
+		config.HTTP.ValidatorCache = defaultValidatorCachePath(config.DownloadPath)
+	}
+
+	var downloaderErr error
 	if config.Downloader == nil {
-		config.Downloader = NewHTTPDownloader(config.FileSystem)
+		var httpDownloader Downloader
+		httpDownloader, downloaderErr = NewHTTPDownloader(config.FileSystem, config.HTTP)
+		// Repositories given as file:// URLs or paths are copied from the local filesystem.
+		config.Downloader = &schemeDownloader{
+			local:  NewFileDownloader(NewOsFileSystem(), config.FileSystem),
+			remote: httpDownloader,
+		}
 	}
 
+	packageFilter, packageFilterErr := newPackageFilter(config)
+
 	return &dittoRepo{
-		config:     config,
-		logger:     config.Logger,
-		fs:         config.FileSystem,
-		downloader: config.Downloader,
+		config:           config,
+		logger:           config.Logger,
+		fs:               config.FileSystem,
+		downloader:       config.Downloader,
+		packageFilter:    packageFilter,
+		packageFilterErr: packageFilterErr,
+		downloaderErr:    downloaderErr,
+		health:           newMirrorHealth(config.MirrorFailureThreshold, time.Duration(config.MirrorCooldown)),
+		hostConns:        newHostConnLimiter(config.MaxConnectionsPerHost, config.HostMaxConnections),
+		repoURLs:         config.RepoURLs,
+		archURLs:         config.ArchURLs,
 	}
 }
 
-// packageMeta holds the download path and integrity data for a single .deb
+// packageMeta holds the download path and integrity data for a single pool file
+// (a .deb, or one of the files making up a source package)
 type packageMeta struct {
 	Path   string
 	SHA256 string
@@ -191,6 +467,19 @@ func (d *dittoRepo) MirrorWithErrors(ctx context.Context) (<-chan ProgressUpdate
 }
 
 func (d *dittoRepo) doMirror(ctx context.Context) error {
+	if d.packageFilterErr != nil {
+		d.logger.Error(fmt.Sprintf("Invalid package filter: %v", d.packageFilterErr))
+		return fmt.Errorf("cannot mirror: %w", d.packageFilterErr)
+	}
+	if d.downloaderErr != nil {
+		d.logger.Error(fmt.Sprintf("Invalid HTTP configuration: %v", d.downloaderErr))
+		return fmt.Errorf("cannot mirror: %w", d.downloaderErr)
+	}
+	if err := d.resolveMirrorLists(ctx); err != nil {
+		d.logger.Error(fmt.Sprintf("Mirror list resolution failed: %v", err))
+		return fmt.Errorf("cannot mirror: %w", err)
+	}
+
 	// When mirroring from multiple URLs, all mirrors must serve byte-identical Release
 	// files for every distribution. This guarantees their package indices (and therefore
 	// checksums) are interchangeable, which is what makes per-file failover safe. If they
@@ -202,19 +491,61 @@ func (d *dittoRepo) doMirror(ctx context.Context) error {
 
 	// Iterate over all distributions, collecting per-distribution failures so we can
 	// report them to the caller while still attempting the remaining distributions.
+	// Every distribution's indices are fetched before any pool file, so that the
+	// dependency closure of SeedPackages can be resolved across all of them.
 	var errs []error
+	fetched := make(map[string][]string)
 	for _, dist := range d.config.Dists {
 		if ctx.Err() != nil {
 			d.logger.Error(fmt.Sprintf("Context cancelled: %v", ctx.Err()))
 			return fmt.Errorf("cannot mirror: %w", ctx.Err())
 		}
 
-		d.logger.Info(fmt.Sprintf("Starting mirror of %s [%s]...\n", strings.Join(d.config.RepoURLs, ", "), dist))
+		repoURLs, _ := d.mirrors()
+		d.logger.Info(fmt.Sprintf("Starting mirror of %s [%s]...\n", strings.Join(repoURLs, ", "), dist))
 
-		if err := d.mirrorDistribution(ctx, dist); err != nil {
+		indices, err := d.fetchDistributionIndices(ctx, dist)
+		if err != nil {
 			d.logger.Error(fmt.Sprintf("cannot mirror distribution %s: %v", dist, err))
 			errs = append(errs, fmt.Errorf("cannot mirror distribution %s: %w", dist, err))
 			// Continue with other distributions
+			continue
+		}
+		fetched[dist] = indices
+	}
+
+	// The dependency closure spans the indices of every distribution, so it is resolved
+	// once they have all been fetched, and again whenever some are re-fetched.
+	resolveClosure := func() error {
+		if len(d.config.SeedPackages) == 0 {
+			return nil
+		}
+		var allIndices []string
+		for _, dist := range d.config.Dists {
+			allIndices = append(allIndices, fetched[dist]...)
+		}
+		if err := d.resolveDependencyClosure(ctx, allIndices); err != nil {
+			d.logger.Error(fmt.Sprintf("cannot resolve dependencies: %v", err))
+			return fmt.Errorf("cannot mirror: %w", err)
+		}
+		return nil
+	}
+	if err := resolveClosure(); err != nil {
+		return err
+	}
+
+	for _, dist := range d.config.Dists {
+		indices, ok := fetched[dist]
+		if !ok {
+			continue
+		}
+		if ctx.Err() != nil {
+			d.logger.Error(fmt.Sprintf("Context cancelled: %v", ctx.Err()))
+			return fmt.Errorf("cannot mirror: %w", ctx.Err())
+		}
+		if err := d.mirrorDistributionPool(ctx, dist, indices); err != nil {
+			d.logger.Error(fmt.Sprintf("cannot mirror distribution %s: %v", dist, err))
+			errs = append(errs, fmt.Errorf("cannot mirror distribution %s: %w", dist, err))
 		}
 	}
 	mirrorErr := len(errs) > 0
@@ -226,6 +557,12 @@ func (d *dittoRepo) doMirror(ctx context.Context) error {
 		if err := d.cleanupOrphanedPackages(); err != nil {
 			d.logger.Warn(fmt.Sprintf("cannot clean up: %v\n", err))
 		}
+		if err := d.cleanupOrphanedInstallerImages(); err != nil {
+			d.logger.Warn(fmt.Sprintf("cannot clean up installer images: %v\n", err))
+		}
+		if err := d.cleanupPartialDownloads(); err != nil {
+			d.logger.Warn(fmt.Sprintf("cannot clean up partial downloads: %v\n", err))
+		}
 	} else if mirrorErr {
 		d.logger.Warn("Skipping cleanup: one or more distributions failed to sync")
 	}
@@ -252,11 +589,30 @@ func (d *dittoRepo) doMirror(ctx context.Context) error {
 		}
 		if len(staleDists) > 0 {
 			d.logger.Warn(fmt.Sprintf("Re-syncing %d stale distribution(s)...", len(staleDists)))
+			var resynced []string
 			for _, dist := range staleDists {
 				if ctx.Err() != nil {
 					break
 				}
-				if err := d.mirrorDistribution(ctx, dist); err != nil {
+				indices, err := d.fetchDistributionIndices(ctx, dist)
+				if err != nil {
+					d.logger.Error(fmt.Sprintf("cannot re-sync distribution %s: %v", dist, err))
+					errs = append(errs, fmt.Errorf("cannot re-sync distribution %s: %w", dist, err))
+					continue
+				}
+				fetched[dist] = indices
+				resynced = append(resynced, dist)
+			}
+			if len(resynced) > 0 {
+				if err := resolveClosure(); err != nil {
+					return err
+				}
+			}
+			for _, dist := range resynced {
+				if ctx.Err() != nil {
+					break
+				}
+				if err := d.mirrorDistributionPool(ctx, dist, fetched[dist]); err != nil {
 					d.logger.Error(fmt.Sprintf("cannot re-sync distribution %s: %v", dist, err))
 					errs = append(errs, fmt.Errorf("cannot re-sync distribution %s: %w", dist, err))
 				}
@@ -271,10 +627,27 @@ func (d *dittoRepo) doMirror(ctx context.Context) error {
 	return errors.Join(errs...)
 }
 
+// mirrorDistribution mirrors a single distribution: its metadata and indices, then every
+// pool file they reference.
 func (d *dittoRepo) mirrorDistribution(ctx context.Context, dist string) error {
+	indices, err := d.fetchDistributionIndices(ctx, dist)
+	if err != nil {
+		return err
+	}
+	return d.mirrorDistributionPool(ctx, dist, indices)
+}
+
+// fetchDistributionIndices downloads the metadata of dist (InRelease, Release and
+// Release.gpg), verifies it, and downloads every desired index the Release file lists. It
+// returns the local paths of the downloaded indices.
+func (d *dittoRepo) fetchDistributionIndices(ctx context.Context, dist string) ([]string, error) {
 	// Check context before starting
 	if ctx.Err() != nil {
-		return ctx.Err()
+		return nil, ctx.Err()
+	}
+
+	if distDir := d.distDir(dist); distDir == ".." || strings.HasPrefix(distDir, "../") {
+		return nil, fmt.Errorf("invalid flat distribution path %q", dist)
 	}
 
 	// 1. Fetch Repository Metadata (Signatures & Release file)
@@ -283,153 +656,321 @@ func (d *dittoRepo) mirrorDistribution(ctx context.Context, dist string) error {
 	for _, meta := range metadataFiles {
 		// Check context
 		if ctx.Err() != nil {
-			return ctx.Err()
+			return nil, ctx.Err()
 		}
-		relPath := fmt.Sprintf("dists/%s/%s", dist, meta)
-		dest := path.Join(d.config.DownloadPath, "dists", dist, meta)
+		relPath := path.Join(d.distDir(dist), meta)
+		dest := path.Join(d.config.DownloadPath, relPath)
 
 		d.logger.Info(fmt.Sprintf("Fetching Metadata: %s... ", meta))
 		// We pass "" as checksum because we don't know it yet (it's the source of truth)
-		if _, err := d.downloadWithFailover(relPath, dest, ""); err != nil {
+		hash, err := d.downloadWithFailover(ctx, relPath, dest, "")
+		if err != nil {
 			// InRelease is optional if Release.gpg exists, but usually good to have.
 			// Release and Release.gpg are critical.
 			d.logger.Warn(fmt.Sprintf("%v\n", err))
-		} else {
-			d.logger.Info("OK")
+			if (d.config.RegenerateIndices || len(d.config.Keyrings) > 0) && meta != "Release" {
+				// A signature left by a previous run must not be mistaken for the current
+				// upstream one: it would be verified against stale data. With
+				// RegenerateIndices, our own is written again once the indices are
+				// regenerated.
+				_ = d.fs.Remove(dest)
+			}
+			continue
+		}
+		d.logger.Info("OK")
+		if meta == "Release" {
+			d.mu.Lock()
+			if d.upstreamReleaseHashes == nil {
+				d.upstreamReleaseHashes = make(map[string]string)
+			}
+			d.upstreamReleaseHashes[dist] = hash
+			d.mu.Unlock()
 		}
 	}
 
-	// 2. Read the local 'Release' file to parse package indices
+	// 2. Verify the upstream signature before trusting anything the Release file lists.
+	if len(d.config.Keyrings) > 0 {
+		if err := d.verifyReleaseSignature(dist); err != nil {
+			return nil, fmt.Errorf("cannot verify Release signature: %w", err)
+		}
+		d.logger.Info(fmt.Sprintf("Release signature for %s verified.", dist))
+	}
+
+	// 3. Read the local 'Release' file to parse package indices
 	// We read from disk instead of fetching again to ensure consistency.
-	releasePath := path.Join(d.config.DownloadPath, "dists", dist, "Release")
+	releasePath := path.Join(d.config.DownloadPath, d.distDir(dist), "Release")
 	releaseBytes, err := d.fs.ReadFile(releasePath)
 	if err != nil {
-		return fmt.Errorf("cannot read local Release file: %v", err)
+		return nil, fmt.Errorf("cannot read local Release file: %v", err)
 	}
 
-	indices := d.parseReleaseFile(string(releaseBytes))
+	indices, err := d.parseReleaseFile(string(releaseBytes))
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse Release file: %w", err)
+	}
+	byHash := releaseAcquiresByHash(string(releaseBytes))
 
-	// 3. Download all index files first (Packages, Translations, cnf, etc.)
+	// 4. Download all index files first (Packages, Translations, cnf, etc.)
 	// Track which local paths were successfully downloaded for the next phase.
+	// Each index is verified against the SHA256 and size the Release file lists for it, so a
+	// corrupted or tampered copy fails over to the next mirror instead of being trusted.
+	// When upstream publishes by-hash paths, indices are fetched through them (see
+	// downloadIndex), so they cannot be newer than the Release file fetched above.
 	downloadedIndices := make([]string, 0, len(indices))
-	for _, idxPath := range indices {
+	for _, idx := range indices {
 		if ctx.Err() != nil {
-			return ctx.Err()
+			return nil, ctx.Err()
 		}
 
-		d.logger.Info(fmt.Sprintf("Fetching Index: %s\n", idxPath))
+		d.logger.Info(fmt.Sprintf("Fetching Index: %s\n", idx.Path))
 
-		indexRelPath := fmt.Sprintf("dists/%s/%s", dist, idxPath)
-		localIndexPath := path.Join(d.config.DownloadPath, "dists", dist, idxPath)
+		indexRelPath := path.Join(d.distDir(dist), idx.Path)
+		localIndexPath := path.Join(d.config.DownloadPath, indexRelPath)
 
-		calculatedHash, err := d.downloadWithFailover(indexRelPath, localIndexPath, "")
+		calculatedHash, err := d.downloadIndex(ctx, indexRelPath, localIndexPath, idx, byHash)
 		if err != nil {
 			if d.config.AllowMissingIndices {
-				d.logger.Warn(fmt.Sprintf("cannot download index %s: %v (skipping)", idxPath, err))
+				d.logger.Warn(fmt.Sprintf("cannot download index %s: %v (skipping)", idx.Path, err))
 				continue
 			}
-			return fmt.Errorf("cannot download index %s: %w", idxPath, err)
+			return nil, fmt.Errorf("cannot download index %s: %w", idx.Path, err)
 		}
 
-		// We have the file and its hash. Create the alias so modern clients are happy.
-		if err := d.createByHashLink(localIndexPath, calculatedHash); err != nil {
-			d.logger.Warn(fmt.Sprintf("  cannot create by-hash link: %v\n", err))
+		// We have the file and its hash. Create the alias so modern clients are happy. The
+		// SHA256SUMS of an installer image tree is never fetched by hash, and anything else
+		// in the tree would be removed by cleanupOrphanedInstallerImages.
+		if !isInstallerTreeSums(indexRelPath) {
+			if err := d.createByHashLink(localIndexPath, calculatedHash); err != nil {
+				d.logger.Warn(fmt.Sprintf("  cannot create by-hash link: %v\n", err))
+			}
 		}
 
 		downloadedIndices = append(downloadedIndices, localIndexPath)
 	}
 
-	// 4. Parse all Packages indices to build a complete, unified package list.
-	var allDebs []packageMeta
-	seen := make(map[string]bool)
-	parsedStems := make(map[string]bool) // tracks base paths already parsed (without compression ext)
-	for _, localIndexPath := range downloadedIndices {
-		if ctx.Err() != nil {
-			return ctx.Err()
-		}
+	return downloadedIndices, nil
+}
 
-		if !strings.Contains(localIndexPath, "Packages") {
-			continue
+// downloadIndex downloads the index idx, found at indexRelPath, to localPath, verifying
+// its SHA256 and size against those listed in the Release file; a file of the wrong size
+// is removed. An index already at localPath with the listed SHA256 and size is kept as it
+// is, so that a sync finding nothing changed only fetches the Release files. When byHash is set (the Release file says "Acquire-By-Hash: yes") and apt
+// would fetch the index by hash (see acquiredByHash), it is first fetched from
+// "by-hash/SHA256/<sha256>" in its directory: that path is immutable, so unlike the plain
+// name it cannot be replaced by a newer publication of the archive in the meantime. Each
+// mirror is tried once for it, without retries, and on any failure the plain name is
+// fetched instead, as from mirrors without by-hash paths.
+func (d *dittoRepo) downloadIndex(ctx context.Context, indexRelPath, localPath string, idx releaseEntry, byHash bool) (string, error) {
+	if info, err := d.fs.Stat(localPath); err == nil && info.Size() == idx.Size {
+		if match, err := d.verifyFile(localPath, idx.SHA256); err == nil && match {
+			d.logger.Debug(fmt.Sprintf("%s is up to date", indexRelPath))
+			return idx.SHA256, nil
 		}
+	}
 
-		// Derive the stem by stripping the compression extension.
-		stem := localIndexPath
-		for _, ext := range []string{".gz", ".xz", ".bz2"} {
-			if strings.HasSuffix(stem, ext) {
-				stem = strings.TrimSuffix(stem, ext)
-				break
-			}
+	var hash string
+	var err error
+	byHashRelPath := path.Join(path.Dir(indexRelPath), "by-hash", "SHA256", idx.SHA256)
+	bases := d.candidateURLs(byHashRelPath)
+	byHash = byHash && acquiredByHash(idx.Path) && len(bases) > 0
+	if byHash {
+		var base string
+		hash, base, err = d.downloadFromMirrorsRetrying(ctx, bases, byHashRelPath, localPath, idx.SHA256, 0, downloadOptions{})
+		switch {
+		case err == nil:
+			d.learnArchURL(byHashRelPath, base)
+		case ctx.Err() != nil:
+			return "", ctx.Err()
+		default:
+			d.logger.Debug(fmt.Sprintf("cannot download %s by hash (%v), trying its name", indexRelPath, err))
 		}
-		if parsedStems[stem] {
-			d.logger.Info(fmt.Sprintf("Skipping Index (stem already parsed): %s\n", localIndexPath))
-			continue
+	}
+	if !byHash || err != nil {
+		hash, err = d.downloadWithFailover(ctx, indexRelPath, localPath, idx.SHA256)
+		if err != nil {
+			return "", err
 		}
+	}
 
-		d.logger.Info(fmt.Sprintf("Parsing Index: %s\n", localIndexPath))
-		debs, err := d.extractDebsFromIndex(localIndexPath)
-		if err != nil {
-			d.logger.Warn(fmt.Sprintf("  cannot parse index %s: %v\n", localIndexPath, err))
+	info, err := d.fs.Stat(localPath)
+	if err != nil {
+		return "", fmt.Errorf("cannot stat %s: %w", localPath, err)
+	}
+	if info.Size() != idx.Size {
+		_ = d.fs.Remove(localPath)
+		return "", fmt.Errorf("size mismatch for %s: expected %d, got %d", idx.Path, idx.Size, info.Size())
+	}
+	return hash, nil
+}
+
+// mirrorDistributionPool downloads every pool file (and installer image) referenced by the
+// local indices fetched for dist, then regenerates its indices when RegenerateIndices is set.
+func (d *dittoRepo) mirrorDistributionPool(ctx context.Context, dist string, downloadedIndices []string) error {
+	// 5. Parse all Packages (and Sources) indices to build a complete, unified file list.
+	allDebs, err := d.extractPoolFilesFromIndices(ctx, downloadedIndices)
+	if err != nil {
+		return err
+	}
+
+	// Installer images are downloaded alongside the pool, each verified against the
+	// SHA256SUMS of its tree (itself verified against the Release file above).
+	for _, localIndexPath := range downloadedIndices {
+		if path.Base(localIndexPath) != "SHA256SUMS" {
 			continue
 		}
-		parsedStems[stem] = true
-		d.logger.Info(fmt.Sprintf("  -> Found %d packages.\n", len(debs)))
-
-		for _, pkg := range debs {
-			if !seen[pkg.Path] {
-				seen[pkg.Path] = true
-				allDebs = append(allDebs, pkg)
-			}
+		images, err := d.extractInstallerImages(localIndexPath)
+		if err != nil {
+			return fmt.Errorf("cannot parse %s: %w", localIndexPath, err)
 		}
+		d.logger.Info(fmt.Sprintf("  -> Found %d installer files in %s\n", len(images), localIndexPath))
+		allDebs = append(allDebs, images...)
 	}
 
-	// 5. Now download the complete package set in one pass.
+	// 6. Now download the complete package set in one pass.
 	if len(allDebs) > 0 {
 		d.downloadPackages(ctx, allDebs)
 	}
 
+	// 7. Publish indices that only list what was mirrored, signed with our own key.
+	if d.config.RegenerateIndices {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := d.publishDistribution(ctx, dist, downloadedIndices); err != nil {
+			return fmt.Errorf("cannot regenerate indices: %w", err)
+		}
+	}
+
 	return nil
 }
 
+// distDir returns the repository-relative directory holding the Release file and indices of
+// dist: "dists/<dist>" normally, or the cleaned dist path itself for flat repositories, where
+// "./" and "/" both resolve to the repository root (".").
+func (d *dittoRepo) distDir(dist string) string {
+	if d.config.Flat {
+		return path.Clean("./" + dist)
+	}
+	return path.Join("dists", dist)
+}
+
 // downloadWithFailover downloads a repository-relative path by trying each configured
 // mirror in turn until one succeeds. The mirror returned by preferredBaseForPath (if any)
 // is attempted first, followed by the remaining RepoURLs in order. It returns the
 // calculated SHA256 from the first successful download, or the last error if all mirrors
 // fail. The full URL for a single mirror is "<base>/<relPath>", identical to the legacy
 // single-URL behavior.
-func (d *dittoRepo) downloadWithFailover(relPath, dest, expectedSHA256 string) (string, error) {
+func (d *dittoRepo) downloadWithFailover(ctx context.Context, relPath, dest, expectedSHA256 string) (string, error) {
 	bases := d.candidateURLs(relPath)
 	if len(bases) == 0 {
 		return "", fmt.Errorf("cannot download: no repository URL configured for %s", relPath)
 	}
 
+	hash, base, err := d.downloadFromMirrors(ctx, bases, relPath, dest, expectedSHA256)
+	if err != nil {
+		return "", err
+	}
+	// Remember which mirror served this arch-specific file so future files for the same
+	// architecture try it first.
+	d.learnArchURL(relPath, base)
+	return hash, nil
+}
+
+// downloadFromMirrors downloads relPath from the first of bases that serves it, returning
+// the calculated SHA256 and the base it came from. When every mirror has failed, those
+// that failed with a transient error are tried again, in the same order, after a backoff
+// (see retryDelay and backoff), up to MaxRetries times. Mirrors on a host without a free
+// connection (see MaxConnectionsPerHost) are tried after the others.
+func (d *dittoRepo) downloadFromMirrors(ctx context.Context, bases []string, relPath, dest, expectedSHA256 string) (string, string, error) {
+	return d.downloadFromMirrorsRetrying(ctx, bases, relPath, dest, expectedSHA256, d.config.MaxRetries, downloadOptions{})
+}
+
+// downloadScratch downloads relPath from the first of bases that serves it to dest, a
+// file the caller removes once it has read it (see downloadOptions).
+func (d *dittoRepo) downloadScratch(ctx context.Context, bases []string, relPath, dest string) (string, error) {
+	if len(bases) == 0 {
+		return "", fmt.Errorf("cannot download: no repository URL configured for %s", relPath)
+	}
+	hash, _, err := d.downloadFromMirrorsRetrying(ctx, bases, relPath, dest, "", d.config.MaxRetries, downloadOptions{scratch: true})
+	return hash, err
+}
+
+// downloadFromMirrorsRetrying is downloadFromMirrors with up to maxRetries retries instead
+// of MaxRetries; with zero, every mirror is tried once.
+func (d *dittoRepo) downloadFromMirrorsRetrying(ctx context.Context, bases []string, relPath, dest, expectedSHA256 string, maxRetries int, opts downloadOptions) (string, string, error) {
 	var lastErr error
-	for _, base := range bases {
-		url := fmt.Sprintf("%s/%s", base, relPath)
-		hash, err := d.downloader.DownloadFile(url, dest, expectedSHA256)
-		if err == nil {
-			// Remember which mirror served this arch-specific file so future files for
-			// the same architecture try it first.
-			d.learnArchURL(relPath, base)
-			return hash, nil
+	for attempt := 0; ; attempt++ {
+		var retryable []string
+		var retryAfter time.Duration
+		// Mirrors whose host is saturated are moved to the end of the queue, where their
+		// turn waits for a free connection.
+		queue := slices.Clone(bases)
+		for i := 0; i < len(queue); i++ {
+			base := queue[i]
+			var release func()
+			if i < len(bases) {
+				var ok bool
+				if release, ok = d.hostConns.tryAcquire(base); !ok {
+					queue = append(queue, base)
+					continue
+				}
+			} else {
+				var err error
+				if release, err = d.hostConns.acquire(ctx, base); err != nil {
+					return "", "", err
+				}
+			}
+			url := fmt.Sprintf("%s/%s", base, relPath)
+			// Time held back by rate limits says nothing about the mirror.
+			start := time.Now()
+			hash, throttled, err := downloadFileThrottled(ctx, d.downloader, url, dest, expectedSHA256, opts)
+			release()
+			if err == nil {
+				var size int64
+				if info, err := d.fs.Stat(dest); err == nil {
+					size = info.Size()
+				}
+				d.health.recordSuccess(base, size, time.Since(start)-throttled)
+				return hash, base, nil
+			}
+			lastErr = err
+			if len(bases) > 1 {
+				d.logger.Debug(fmt.Sprintf("mirror %s failed for %s: %v", base, relPath, err))
+			}
+			if isRetryableError(err) && d.health.recordFailure(base, err) {
+				d.logger.Warn(fmt.Sprintf("mirror %s keeps failing (%v), trying it last for %s", base, err, time.Duration(d.config.MirrorCooldown)))
+			}
+			if wait, ok := d.retryDelay(err); ok {
+				retryable = append(retryable, base)
+				retryAfter = max(retryAfter, wait)
+			}
 		}
-		lastErr = err
-		if len(bases) > 1 {
-			d.logger.Debug(fmt.Sprintf("mirror %s failed for %s: %v", base, relPath, err))
+
+		if len(retryable) == 0 || attempt >= maxRetries {
+			return "", "", lastErr
 		}
+		delay := d.backoff(attempt, retryAfter)
+		d.logger.Warn(fmt.Sprintf("cannot download %s (%v), retrying in %s (%d/%d)", relPath, lastErr, delay.Round(time.Millisecond), attempt+1, maxRetries))
+		if err := sleepContext(ctx, delay); err != nil {
+			return "", "", err
+		}
+		bases = retryable
 	}
-	return "", lastErr
 }
 
 // candidateURLs returns the ordered list of mirror base URLs to try for a given
 // repository-relative path. When an architecture-specific preference applies, that base
-// is placed first. The remaining RepoURLs follow in their configured order. Duplicates
-// are removed while preserving order.
+// is placed first. The remaining RepoURLs follow in their configured order, or ranked by
+// their health with AdaptiveMirrorOrder. Mirrors whose circuit breaker is open come last
+// (see mirrorHealth). Duplicates are removed while preserving order.
 func (d *dittoRepo) candidateURLs(relPath string) []string {
-	ordered := make([]string, 0, len(d.config.RepoURLs)+1)
-	if preferred := d.preferredBaseForPath(relPath); preferred != "" {
+	repoURLs, _ := d.mirrors()
+	ordered := make([]string, 0, len(repoURLs)+1)
+	preferred := d.preferredBaseForPath(relPath)
+	if preferred != "" {
 		ordered = append(ordered, preferred)
 	}
-	ordered = append(ordered, d.config.RepoURLs...)
+	ordered = append(ordered, repoURLs...)
 
 	seen := make(map[string]bool, len(ordered))
 	deduped := ordered[:0]
@@ -440,7 +981,21 @@ func (d *dittoRepo) candidateURLs(relPath string) []string {
 		seen[base] = true
 		deduped = append(deduped, base)
 	}
-	return deduped
+	return d.health.order(deduped, preferred != "", d.config.AdaptiveMirrorOrder)
+}
+
+// mirrors returns the mirrors in use: the RepoURLs and ArchURLs resolved for the current
+// run. The caller must not modify them.
+func (d *dittoRepo) mirrors() ([]string, map[string]string) {
+	d.mirrorsMu.RLock()
+	defer d.mirrorsMu.RUnlock()
+	return d.repoURLs, d.archURLs
+}
+
+// MirrorStats returns the health of every mirror in use (see allMirrorURLs), as observed
+// by the downloads made so far.
+func (d *dittoRepo) MirrorStats() []MirrorStats {
+	return d.health.snapshot(d.allMirrorURLs())
 }
 
 // preferredBaseForPath returns the mirror base URL that should be tried first for the
@@ -454,7 +1009,8 @@ func (d *dittoRepo) preferredBaseForPath(relPath string) string {
 	}
 
 	// Explicit user-provided mapping takes precedence over anything learned.
-	if base := d.config.ArchURLs[arch]; base != "" {
+	_, archURLs := d.mirrors()
+	if base := archURLs[arch]; base != "" {
 		return base
 	}
 
@@ -467,23 +1023,29 @@ func (d *dittoRepo) preferredBaseForPath(relPath string) string {
 // archForPath returns the architecture a repository-relative path belongs to, or "" if it
 // is not architecture-specific. It matches against binary index directories
 // ("binary-<arch>/"), command-not-found files ("Commands-<arch>."), DEP-11 metadata
-// ("Components-<arch>."), and package filenames ("_<arch>.deb"). Candidate architectures
+// ("Components-<arch>."), Contents indices ("Contents-<arch>."), installer image trees
+// ("installer-<arch>/current/", "grub2-<arch>/current/"), and package filenames
+// ("_<arch>.deb", "_<arch>.udeb"). Candidate architectures
 // are those being mirrored (Archs) plus any
-// explicitly mapped in ArchURLs. Matching is delimited so that, for example, "amd64" does
+// mapped in ArchURLs. Matching is delimited so that, for example, "amd64" does
 // not match an "amd64v3" path.
 func (d *dittoRepo) archForPath(relPath string) string {
 	matches := func(arch string) bool {
 		return arch != "" && (strings.Contains(relPath, "binary-"+arch+"/") ||
 			strings.Contains(relPath, "Commands-"+arch+".") ||
 			strings.Contains(relPath, "Components-"+arch+".") ||
-			strings.HasSuffix(relPath, "_"+arch+".deb"))
+			strings.Contains(relPath, "Contents-"+arch+".") ||
+			strings.Contains(relPath, "-"+arch+"/current/") ||
+			strings.HasSuffix(relPath, "_"+arch+".deb") ||
+			strings.HasSuffix(relPath, "_"+arch+".udeb"))
 	}
 	for _, arch := range d.config.Archs {
 		if matches(arch) {
 			return arch
 		}
 	}
-	for arch := range d.config.ArchURLs {
+	_, archURLs := d.mirrors()
+	for arch := range archURLs {
 		if matches(arch) {
 			return arch
 		}
@@ -504,7 +1066,8 @@ func (d *dittoRepo) learnArchURL(relPath, base string) {
 		return
 	}
 	// Respect explicit user configuration; nothing to learn there.
-	if _, ok := d.config.ArchURLs[arch]; ok {
+	_, archURLs := d.mirrors()
+	if _, ok := archURLs[arch]; ok {
 		return
 	}
 
@@ -533,9 +1096,10 @@ func (d *dittoRepo) learnArchURL(relPath, base string) {
 // RepoURLs and the values of ArchURLs. RepoURLs keep their configured order and appear
 // first; arch-specific URLs not already present are appended.
 func (d *dittoRepo) allMirrorURLs() []string {
-	urls := make([]string, 0, len(d.config.RepoURLs)+len(d.config.ArchURLs))
-	urls = append(urls, d.config.RepoURLs...)
-	for _, base := range d.config.ArchURLs {
+	repoURLs, archURLs := d.mirrors()
+	urls := make([]string, 0, len(repoURLs)+len(archURLs))
+	urls = append(urls, repoURLs...)
+	for _, base := range archURLs {
 		urls = append(urls, base)
 	}
 
@@ -570,8 +1134,8 @@ func (d *dittoRepo) validateMirrorConsistency(ctx context.Context) error {
 			return ctx.Err()
 		}
 
-		relPath := fmt.Sprintf("dists/%s/Release", dist)
-		tmpPath := path.Join(d.config.DownloadPath, "dists", dist, "Release.validate")
+		relPath := path.Join(d.distDir(dist), "Release")
+		tmpPath := path.Join(d.config.DownloadPath, d.distDir(dist), "Release.validate")
 
 		var refHash, refURL string
 		for i, base := range urls {
@@ -579,8 +1143,7 @@ func (d *dittoRepo) validateMirrorConsistency(ctx context.Context) error {
 				return ctx.Err()
 			}
 
-			url := fmt.Sprintf("%s/%s", base, relPath)
-			hash, err := d.downloader.DownloadFile(url, tmpPath, "")
+			hash, err := d.downloadScratch(ctx, []string{base}, relPath, tmpPath)
 			// We only need the hash, not the file itself.
 			_ = d.fs.Remove(tmpPath)
 			if err != nil {
@@ -635,7 +1198,13 @@ func (d *dittoRepo) downloadPackages(ctx context.Context, debs []packageMeta) {
 					var ok bool
 					switch d.config.VerifyMode {
 					case VerifySize:
-						ok = info.Size() == job.pkg.Size
+						// Files without a known size (installer images) fall through
+						// to a checksum check.
+						if job.pkg.Size >= 0 {
+							ok = info.Size() == job.pkg.Size
+							break
+						}
+						fallthrough
 					default: // VerifyChecksum
 						var err error
 						ok, err = d.verifyFile(job.localPath, job.pkg.SHA256)
@@ -714,7 +1283,7 @@ func (d *dittoRepo) downloadPackages(ctx context.Context, debs []packageMeta) {
 				}
 
 				filename := path.Base(job.Dest)
-				_, err := d.downloadWithFailover(job.RelPath, job.Dest, job.Checksum)
+				_, err := d.downloadWithFailover(ctx, job.RelPath, job.Dest, job.Checksum)
 				if err != nil {
 					d.logger.Warn(fmt.Sprintf("[Worker %d] cannot download %s: %v", workerID, filename, err))
 				} else {
@@ -781,17 +1350,28 @@ func (d *dittoRepo) isDistributionFresh(ctx context.Context, dist string) (bool,
 		return false, ctx.Err()
 	}
 
-	localReleasePath := path.Join(d.config.DownloadPath, "dists", dist, "Release")
-	releaseRelPath := fmt.Sprintf("dists/%s/Release", dist)
+	releaseRelPath := path.Join(d.distDir(dist), "Release")
+	localReleasePath := path.Join(d.config.DownloadPath, releaseRelPath)
 	tmpPath := localReleasePath + ".check"
 	defer func() { _ = d.fs.Remove(tmpPath) }()
 
 	// Download the current upstream Release to a temp file and capture its hash.
-	upstreamHash, err := d.downloadWithFailover(releaseRelPath, tmpPath, "")
+	upstreamHash, err := d.downloadScratch(ctx, d.candidateURLs(releaseRelPath), releaseRelPath, tmpPath)
 	if err != nil {
 		return false, fmt.Errorf("cannot fetch upstream Release: %w", err)
 	}
 
+	// With RegenerateIndices the local Release file is our own, so compare against the
+	// upstream one fetched at the start of the sync instead.
+	if d.config.RegenerateIndices {
+		d.mu.Lock()
+		fetchedHash, ok := d.upstreamReleaseHashes[dist]
+		d.mu.Unlock()
+		if ok {
+			return fetchedHash == upstreamHash, nil
+		}
+	}
+
 	// Check whether our local copy matches.
 	match, err := d.verifyFile(localReleasePath, upstreamHash)
 	if err != nil {
@@ -801,75 +1381,136 @@ func (d *dittoRepo) isDistributionFresh(ctx context.Context, dist string) (bool,
 	return match, nil
 }
 
-// parseReleaseFile extracts paths to Packages.gz that match our Arch/Component filter
-// Also suports Translation files (bz2, usually)
-func (d *dittoRepo) parseReleaseFile(content string) []string {
-	var relevantFiles []string
-	scanner := bufio.NewScanner(strings.NewReader(content))
-	inSha256Block := false
+// releaseEntry is a single file listed in the SHA256 block of a Release file.
+type releaseEntry struct {
+	Path   string
+	Size   int64
+	SHA256 string
+}
+
+// parseReleaseFile extracts the index files (Packages, Translations, cnf, dep11) that match
+// our Arch/Component filter, along with the size and SHA256 the Release file lists for each.
+// Every compression variant is kept (gz, xz, bz2, zst, lz4) so clients can pick the one
+// they prefer; uncompressed files are kept only when no compressed variant is listed.
+func (d *dittoRepo) parseReleaseFile(content string) ([]releaseEntry, error) {
+	stanza, err := d.newDeb822Reader(strings.NewReader(content), "Release").Next()
+	if errors.Is(err, io.EOF) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
 
-	for scanner.Scan() {
-		line := scanner.Text()
+	// A malformed entry is skipped rather than failing the whole distribution; indices
+	// it would have listed are simply not mirrored.
+	sums, err := deb822.ParseChecksums(stanza.Get("SHA256"))
+	if err != nil {
+		d.logger.Warn(fmt.Sprintf("skipping invalid SHA256 entries in Release: %v", err))
+	}
 
-		// The Release file format has "SHA256:" followed by indented lines of files
-		if strings.HasPrefix(line, "SHA256:") {
-			inSha256Block = true
-			continue
-		}
-		// If we hit another key (no indentation), we exited the block
-		if inSha256Block && len(line) > 0 && line[0] != ' ' {
-			inSha256Block = false
+	var relevantFiles []releaseEntry
+	for _, sum := range sums {
+		// Filter: Check if this file belongs to our desired Components/Archs
+		// Path looks like: main/binary-amd64/Packages.gz
+		if d.isDesired(sum.Name) {
+			relevantFiles = append(relevantFiles, releaseEntry{Path: sum.Name, Size: sum.Size, SHA256: sum.Hash})
 		}
+	}
+	return dropListedUncompressed(relevantFiles), nil
+}
 
-		if inSha256Block {
-			parts := strings.Fields(line)
-			if len(parts) < 3 {
-				continue
-			}
-			filePath := parts[2] // Format: checksum size filename
+// acquiredByHash reports whether apt fetches the index at relPath, relative to the
+// distribution directory, through its by-hash path: the indices of the components
+// (Packages, Sources, Translation, Contents, ...), but not the files at the top of the
+// distribution or the SHA256SUMS of installer image trees.
+func acquiredByHash(relPath string) bool {
+	return strings.Contains(relPath, "/") && !isInstallerTreeSums(relPath)
+}
 
-			validExt := strings.HasSuffix(filePath, ".gz") ||
-				strings.HasSuffix(filePath, ".xz") ||
-				strings.HasSuffix(filePath, ".bz2")
+// releaseAcquiresByHash reports whether a Release file advertises "Acquire-By-Hash: yes",
+// meaning that its indices can also be fetched by their SHA256.
+func releaseAcquiresByHash(content string) bool {
+	dr := deb822.NewReader(strings.NewReader(content))
+	dr.OnInvalidLine = func(error) {} // already reported by parseReleaseFile
+	stanza, err := dr.Next()
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(strings.TrimSpace(stanza.Get("Acquire-By-Hash")), "yes")
+}
 
-			// Filter: We only want "Packages.gz" or "Packages.xz"
-			if !validExt {
-				continue
-			}
+// dropListedUncompressed removes uncompressed entries that also have a compressed variant
+// in the list. Archives such as Ubuntu list the uncompressed Packages file in Release (so
+// clients can verify what they decompress) without actually serving it; it is only
+// fetched when it is the sole variant published.
+func dropListedUncompressed(entries []releaseEntry) []releaseEntry {
+	compressedStems := make(map[string]bool)
+	for _, e := range entries {
+		if stem, ext := splitCompressionExt(e.Path); ext != "" {
+			compressedStems[stem] = true
+		}
+	}
 
-			// Filter: Check if this file belongs to our desired Components/Archs
-			// Path looks like: main/binary-amd64/Packages.gz
-			if d.isDesired(filePath) {
-				relevantFiles = append(relevantFiles, filePath)
-			}
+	kept := entries[:0]
+	for _, e := range entries {
+		if _, ext := splitCompressionExt(e.Path); ext == "" && compressedStems[e.Path] {
+			continue
 		}
+		kept = append(kept, e)
 	}
-	return relevantFiles
+	return kept
 }
 
 // isDesired checks if a file path string matches our Component/Arch config
 func (d *dittoRepo) isDesired(filePath string) bool {
+	// Contents indices may sit at the top of the distribution, outside any component.
+	if d.isDesiredContents(filePath) {
+		return true
+	}
+
+	// Installer image trees are listed only through their SHA256SUMS files.
+	if d.isInstallerImageSums(filePath) {
+		return true
+	}
+
+	// Flat repositories have no components or architectures.
+	if d.config.Flat {
+		return d.isDesiredFlat(filePath)
+	}
+
 	// Check Component
-	matchedComponent := false
+	component := ""
 	for _, c := range d.config.Components {
 		if strings.HasPrefix(filePath, c+"/") {
-			matchedComponent = true
+			component = c
 			break
 		}
 	}
-	if !matchedComponent {
+	if component == "" {
 		return false
 	}
 
 	// Check Type: Architecture Binary OR Translation
 	isBinary := false
 	for _, a := range d.config.Archs {
-		if strings.Contains(filePath, "binary-"+a+"/") && strings.Contains(filePath, "Packages") {
+		if strings.HasPrefix(filePath, component+"/binary-"+a+"/") && strings.Contains(filePath, "Packages") {
 			isBinary = true
 			break
 		}
 	}
 
+	// Check debian-installer udeb indices (<component>/debian-installer/binary-<arch>/),
+	// only mirrored on request.
+	isInstaller := false
+	if d.config.DebianInstaller {
+		for _, a := range d.config.Archs {
+			if strings.HasPrefix(filePath, component+"/debian-installer/binary-"+a+"/") && strings.Contains(filePath, "Packages") {
+				isInstaller = true
+				break
+			}
+		}
+	}
+
 	isTranslation := false
 	if strings.Contains(filePath, "i18n/Translation-") {
 		for _, lang := range d.config.Languages {
@@ -893,6 +1534,9 @@ func (d *dittoRepo) isDesired(filePath string) bool {
 		}
 	}
 
+	// Check source indices (<component>/source/Sources.*), only mirrored on request.
+	isSource := d.config.Sources && strings.Contains(filePath, "/source/Sources")
+
 	// Check DEP-11 (AppStream metadata) files. These live under <component>/dep11/
 	// and are listed directly in the Release file, so they only need copying.
 	isDep11 := false
@@ -911,97 +1555,293 @@ func (d *dittoRepo) isDesired(filePath string) bool {
 		}
 	}
 
-	return isBinary || isTranslation || isCnf || isDep11
+	return isBinary || isInstaller || isTranslation || isCnf || isDep11 || isSource
 }
 
-// extractDebsFromIndex parses a local Packages.gz file
-// returning a list of packageMeta objects with filenames and checksums.
-func (d *dittoRepo) extractDebsFromIndex(localPath string) ([]packageMeta, error) {
-	f, err := d.fs.Open(localPath)
-	if err != nil {
-		return nil, err
+// isDesiredFlat checks if a file listed in the Release file of a flat repository should be
+// mirrored: the Packages index, the Sources index when Sources is enabled, and translations
+// for the configured languages.
+func (d *dittoRepo) isDesiredFlat(filePath string) bool {
+	stem, _ := splitCompressionExt(path.Base(filePath))
+	switch {
+	case stem == "Packages":
+		return true
+	case stem == "Sources":
+		return d.config.Sources
+	case strings.HasPrefix(stem, "Translation-"):
+		return slices.Contains(d.config.Languages, strings.TrimPrefix(stem, "Translation-"))
+	default:
+		return false
 	}
-	defer f.Close()
+}
 
-	// Handle GZIP automatically
-	var reader io.Reader = f
-	if strings.HasSuffix(localPath, ".gz") {
-		gzReader, err := gzip.NewReader(f)
-		if err != nil {
-			return nil, err
-		}
-		defer gzReader.Close()
-		reader = gzReader
-	} else if strings.HasSuffix(localPath, ".xz") {
-		// Note: Standard Go library doesn't support XZ.
-		// We would need "github.com/ulikunitz/xz" or simply avoid .xz indices if possible.
-		return nil, fmt.Errorf("xz compression not implemented")
+// poolIndexParser returns the function that lists the pool files referenced by the index
+// at p, or nil if p is not an index that references pool files (Packages or Sources).
+func (d *dittoRepo) poolIndexParser(p string) func(string) ([]packageMeta, error) {
+	stem, _ := splitCompressionExt(path.Base(p))
+	switch stem {
+	case "Packages":
+		return d.extractDebsFromIndex
+	case "Sources":
+		return d.extractSourcesFromIndex
+	default:
+		return nil
 	}
+}
 
-	var packages []packageMeta
-	scanner := bufio.NewScanner(reader)
+// isDesiredContents reports whether filePath is a Contents-<arch> index (for apt-file) that
+// should be mirrored. These are only selected when Contents is enabled and may live either
+// at the top of the distribution (Contents-amd64.gz) or inside a configured component
+// (main/Contents-amd64.gz). Contents-source and Contents-udeb-<arch> are included when
+// Sources and DebianInstaller, respectively, are enabled as well.
+func (d *dittoRepo) isDesiredContents(filePath string) bool {
+	if !d.config.Contents {
+		return false
+	}
 
-	// Increase buffer size to handle ver long lines (Debian Description fields can be huge)
-	buf := make([]byte, 0, 1024*1024)
-	scanner.Buffer(buf, 5*1024*1024)
+	dir, base := path.Split(filePath)
+	if dir != "" && !slices.Contains(d.config.Components, strings.TrimSuffix(dir, "/")) {
+		return false
+	}
 
-	// State variables for the current block
-	var currentPkg packageMeta
-	inBlock := false
+	stem, _ := splitCompressionExt(base)
+	for _, a := range d.config.Archs {
+		if stem == "Contents-"+a || (d.config.DebianInstaller && stem == "Contents-udeb-"+a) {
+			return true
+		}
+	}
+	return d.config.Sources && stem == "Contents-source"
+}
+
+// extractPoolFilesFromIndices parses the given local Packages and Sources indices into a
+// single list of unique pool files. Other index types in the list are ignored.
+func (d *dittoRepo) extractPoolFilesFromIndices(ctx context.Context, indexPaths []string) ([]packageMeta, error) {
+	poolIndices := slices.DeleteFunc(slices.Clone(indexPaths), func(p string) bool {
+		return d.poolIndexParser(p) == nil
+	})
 
-	for scanner.Scan() {
-		line := scanner.Text()
+	var allDebs []packageMeta
+	seen := make(map[string]bool)
+	err := d.forEachIndex(ctx, poolIndices, func(localIndexPath string) error {
+		debs, err := d.poolIndexParser(localIndexPath)(localIndexPath)
+		if err != nil {
+			return err
+		}
+		d.logger.Info(fmt.Sprintf("  -> Found %d files.\n", len(debs)))
 
-		// A blank line indicates the end of a package stanza
-		if strings.TrimSpace(line) == "" {
-			if inBlock && currentPkg.Path != "" && currentPkg.SHA256 != "" {
-				packages = append(packages, currentPkg)
+		for _, pkg := range debs {
+			if !seen[pkg.Path] {
+				seen[pkg.Path] = true
+				allDebs = append(allDebs, pkg)
 			}
-			// Reset for next block
-			currentPkg = packageMeta{}
-			inBlock = false
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return allDebs, nil
+}
+
+// forEachIndex calls parse for one compression variant of each index in indexPaths. Variants
+// are tried in compressionRank order, and a variant that parse fails on falls back to the
+// next variant of the same index.
+func (d *dittoRepo) forEachIndex(ctx context.Context, indexPaths []string, parse func(localIndexPath string) error) error {
+	ordered := slices.Clone(indexPaths)
+	slices.SortStableFunc(ordered, func(a, b string) int {
+		return compressionRank(a) - compressionRank(b)
+	})
+
+	parsedStems := make(map[string]bool) // tracks base paths already parsed (without compression ext)
+	for _, localIndexPath := range ordered {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		stem, _ := splitCompressionExt(localIndexPath)
+		if parsedStems[stem] {
+			d.logger.Info(fmt.Sprintf("Skipping Index (stem already parsed): %s\n", localIndexPath))
 			continue
 		}
 
-		inBlock = true
+		d.logger.Info(fmt.Sprintf("Parsing Index: %s\n", localIndexPath))
+		if err := parse(localIndexPath); err != nil {
+			d.logger.Warn(fmt.Sprintf("  cannot parse index %s: %v\n", localIndexPath, err))
+			continue
+		}
+		parsedStems[stem] = true
+	}
+	return nil
+}
 
-		// Simple prefix parsing.
-		// Note: A robust parser usually handles multiline values (lines starting with space).
-		// but Filename and SHA256 are always single lines in standard Debian repos.
-		if strings.HasPrefix(line, "Filename: ") {
-			currentPkg.Path = strings.TrimPrefix(line, "Filename: ")
-		} else if strings.HasPrefix(line, "SHA256: ") {
-			currentPkg.SHA256 = strings.TrimPrefix(line, "SHA256: ")
-		} else if strings.HasPrefix(line, "Size: ") {
-			if n, err := strconv.ParseInt(strings.TrimPrefix(line, "Size: "), 10, 64); err == nil {
-				currentPkg.Size = n
+// extractDebsFromIndex parses a local Packages index (uncompressed or compressed with any
+// of indexCompressionExts)
+// returning a list of packageMeta objects with filenames and checksums.
+func (d *dittoRepo) extractDebsFromIndex(localPath string) ([]packageMeta, error) {
+	var packages []packageMeta
+	err := d.forEachMirroredPackage(localPath, func(stanza deb822.Stanza) error {
+		pkg := packageMeta{SHA256: stanza.Get("SHA256")}
+		if filename := stanza.Get("Filename"); filename != "" {
+			// Flat repositories commonly list "./name.deb"; clean it so it compares
+			// equal to the on-disk path during cleanup.
+			pkg.Path = path.Clean(filename)
+		}
+		if n, err := strconv.ParseInt(stanza.Get("Size"), 10, 64); err == nil {
+			pkg.Size = n
+		}
+		if pkg.Path != "" && pkg.SHA256 != "" {
+			packages = append(packages, pkg)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return packages, nil
+}
+
+// forEachMirroredPackage calls fn for every stanza of the local Packages index at localPath
+// that describes a package to mirror. Packages excluded by the configured filters, outside
+// the dependency closure of SeedPackages or beyond the KeepVersions newest versions are
+// skipped, so they are neither downloaded nor kept by cleanup. These settings only apply
+// to the configured Dists: the indices of other distributions left on disk are read in
+// full, so that cleanup preserves all of their packages.
+func (d *dittoRepo) forEachMirroredPackage(localPath string, fn func(deb822.Stanza) error) error {
+	if !d.inConfiguredDist(localPath) {
+		return d.forEachStanza(localPath, fn)
+	}
+	selected := func(stanza deb822.Stanza) bool {
+		return d.packageFilter.matches(stanza) && d.inDependencyClosure(stanza)
+	}
+	if d.config.KeepVersions <= 0 {
+		return d.forEachStanza(localPath, func(stanza deb822.Stanza) error {
+			if !selected(stanza) {
+				return nil
 			}
+			return fn(stanza)
+		})
+	}
+
+	// Retention needs every version of a package before any can be dropped.
+	var stanzas []deb822.Stanza
+	err := d.forEachStanza(localPath, func(stanza deb822.Stanza) error {
+		if selected(stanza) {
+			stanzas = append(stanzas, stanza)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, stanza := range retainNewestVersions(stanzas, d.config.KeepVersions) {
+		if err := fn(stanza); err != nil {
+			return err
 		}
 	}
+	return nil
+}
+
+// inConfiguredDist reports whether localPath lies in the directory of one of the
+// configured Dists.
+func (d *dittoRepo) inConfiguredDist(localPath string) bool {
+	for _, dist := range d.config.Dists {
+		dir := path.Join(d.config.DownloadPath, d.distDir(dist))
+		if localPath == dir || strings.HasPrefix(localPath, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// forEachStanza calls fn for every stanza of the local index at localPath, decompressing it
+// according to its extension. It stops at the first error returned by fn.
+func (d *dittoRepo) forEachStanza(localPath string, fn func(deb822.Stanza) error) error {
+	f, err := d.fs.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Handle compressed indices automatically
+	reader, err := decompressReader(f, localPath)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	dr := d.newDeb822Reader(reader, localPath)
+	for {
+		stanza, err := dr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(stanza); err != nil {
+			return err
+		}
+	}
+}
 
-	// Handle the very last block if the file doesn't end with a newline
-	if inBlock && currentPkg.Path != "" && currentPkg.SHA256 != "" {
-		packages = append(packages, currentPkg)
+// newDeb822Reader returns a reader of the upstream metadata read from r (name is used in
+// log messages). Malformed lines are logged and skipped, as they were before indices were
+// parsed as deb822: a single bad line must not fail a whole distribution.
+func (d *dittoRepo) newDeb822Reader(r io.Reader, name string) *deb822.Reader {
+	dr := deb822.NewReader(r)
+	dr.OnInvalidLine = func(err error) {
+		d.logger.Warn(fmt.Sprintf("skipping invalid line in %s: %v", name, err))
 	}
+	return dr
+}
 
-	return packages, scanner.Err()
+// extractSourcesFromIndex parses a local Sources index, returning every file of every
+// source package (.dsc, tarballs, diffs) with the path, size and SHA256 listed for it. Each
+// file's pool path is the stanza's Directory joined with the name from Checksums-Sha256.
+func (d *dittoRepo) extractSourcesFromIndex(localPath string) ([]packageMeta, error) {
+	var files []packageMeta
+	err := d.forEachStanza(localPath, func(stanza deb822.Stanza) error {
+		directory := stanza.Get("Directory")
+		if directory == "" {
+			return nil
+		}
+		sums, err := deb822.ParseChecksums(stanza.Get("Checksums-Sha256"))
+		if err != nil {
+			d.logger.Warn(fmt.Sprintf("skipping invalid Checksums-Sha256 entries of %s in %s: %v", stanza.Get("Package"), localPath, err))
+		}
+		for _, sum := range sums {
+			files = append(files, packageMeta{Path: path.Join(directory, sum.Name), SHA256: sum.Hash, Size: sum.Size})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
 }
 
 // verifyFile is a helper method to check a downloaded file against the expected checksum
 func (d *dittoRepo) verifyFile(filepath string, expectedSHA256 string) (bool, error) {
-	f, err := d.fs.Open(filepath)
+	calculated, err := d.fileSHA256(filepath)
 	if err != nil {
 		return false, err
 	}
+	return calculated == expectedSHA256, nil
+}
+
+// fileSHA256 returns the SHA256 of the file at p.
+func (d *dittoRepo) fileSHA256(p string) (string, error) {
+	f, err := d.fs.Open(p)
+	if err != nil {
+		return "", err
+	}
 	defer f.Close()
 
 	hasher := sha256.New()
 	if _, err := io.Copy(hasher, f); err != nil {
-		return false, err
+		return "", err
 	}
-
-	calculated := hex.EncodeToString(hasher.Sum(nil))
-	return calculated == expectedSHA256, nil
+	return hex.EncodeToString(hasher.Sum(nil)), nil
 }
 
 // createByHashLink creates a hardlink (or copy) in the by-hash/SHA256/ directory
@@ -1040,11 +1880,18 @@ func (d *dittoRepo) createByHashLink(originalPath string, hash string) error {
 	return nil
 }
 
-// cleanupOrphanedPackages removes .deb files from the pool that are no longer referenced
-// by any on-disk Packages index. It scans all indices under the dists/ tree so that
-// packages belonging to distributions not in the current config are preserved.
+// cleanupOrphanedPackages removes .deb and .udeb files (and, when Sources is enabled, source
+// package files) from the pool that are no longer referenced by any on-disk Packages or Sources index. It scans all indices under the dists/ tree so that
+// packages belonging to distributions not in the current config are preserved. Flat
+// repositories have neither a dists/ tree nor a pool, so in Flat mode the whole download
+// path is scanned for both.
 func (d *dittoRepo) cleanupOrphanedPackages() error {
 	poolPath := filepath.Join(d.config.DownloadPath, "pool")
+	distsPath := filepath.Join(d.config.DownloadPath, "dists")
+	if d.config.Flat {
+		poolPath = d.config.DownloadPath
+		distsPath = d.config.DownloadPath
+	}
 
 	// Check if pool directory exists
 	if _, err := d.fs.Stat(poolPath); err != nil {
@@ -1052,52 +1899,31 @@ func (d *dittoRepo) cleanupOrphanedPackages() error {
 		return nil
 	}
 
-	// Build valid set from every Packages index present on disk.
-	distsPath := filepath.Join(d.config.DownloadPath, "dists")
+	// Build valid set from every Packages and Sources index present on disk.
 	validOnDisk := make(map[string]bool)
-	parsedStems := make(map[string]bool)
 
 	if _, err := d.fs.Stat(distsPath); err == nil {
+		var indexPaths []string
 		walkErr := d.fs.WalkDir(distsPath, func(p string, de fs.DirEntry, err error) error {
 			if err != nil {
 				return err
 			}
-			if de.IsDir() {
-				return nil
-			}
-			base := filepath.Base(p)
-			if !strings.HasPrefix(base, "Packages") {
-				return nil
-			}
-			if !strings.HasSuffix(p, ".gz") && !strings.HasSuffix(p, ".xz") && !strings.HasSuffix(p, ".bz2") {
-				return nil
-			}
-			// Deduplicate by stem so we don't parse the same index twice
-			stem := p
-			for _, ext := range []string{".gz", ".xz", ".bz2"} {
-				if strings.HasSuffix(stem, ext) {
-					stem = strings.TrimSuffix(stem, ext)
-					break
-				}
-			}
-			if parsedStems[stem] {
-				return nil
-			}
-			parsedStems[stem] = true
-
-			debs, err := d.extractDebsFromIndex(p)
-			if err != nil {
-				d.logger.Warn(fmt.Sprintf("cleanup: cannot parse index %s: %v", p, err))
-				return nil
-			}
-			for _, pkg := range debs {
-				validOnDisk[pkg.Path] = true
+			if !de.IsDir() && d.poolIndexParser(p) != nil {
+				indexPaths = append(indexPaths, p)
 			}
 			return nil
 		})
 		if walkErr != nil {
 			return fmt.Errorf("cannot scan dists directory: %v", walkErr)
 		}
+
+		debs, err := d.extractPoolFilesFromIndices(context.Background(), indexPaths)
+		if err != nil {
+			return fmt.Errorf("cannot parse indices: %v", err)
+		}
+		for _, pkg := range debs {
+			validOnDisk[pkg.Path] = true
+		}
 	}
 
 	d.logger.Info("Scanning for orphaned packages...")
@@ -1113,8 +1939,8 @@ func (d *dittoRepo) cleanupOrphanedPackages() error {
 			return nil
 		}
 
-		// Only consider .deb files
-		if !strings.HasSuffix(path, ".deb") {
+		// Only consider .deb and .udeb files, plus source package files when mirroring sources
+		if !isBinaryPackageFile(path) && !(d.config.Sources && isSourceFile(path)) {
 			return nil
 		}
 
@@ -1154,3 +1980,60 @@ func (d *dittoRepo) cleanupOrphanedPackages() error {
 	d.logger.Info("Cleanup complete.")
 	return nil
 }
+
+// cleanupPartialDownloads removes the partial downloads ("<file>.tmp") and resume
+// validators ("<file>.tmp.validator") left in the pool and dists trees by interrupted
+// downloads. It only runs after a successful sync, when nothing is left to resume, so
+// that they are not published alongside the mirrored files.
+func (d *dittoRepo) cleanupPartialDownloads() error {
+	roots := []string{filepath.Join(d.config.DownloadPath, "pool"), filepath.Join(d.config.DownloadPath, "dists")}
+	if d.config.Flat {
+		roots = []string{d.config.DownloadPath}
+	}
+
+	var toRemove []string
+	for _, root := range roots {
+		if _, err := d.fs.Stat(root); err != nil {
+			continue
+		}
+		err := d.fs.WalkDir(root, func(path string, de fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !de.IsDir() && (strings.HasSuffix(path, ".tmp") || strings.HasSuffix(path, ".tmp.validator")) {
+				toRemove = append(toRemove, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("cannot walk %s: %v", root, err)
+		}
+	}
+
+	if len(toRemove) > 0 {
+		d.logger.Info(fmt.Sprintf("Removing %d partial downloads...", len(toRemove)))
+	}
+	for _, path := range toRemove {
+		relPath, _ := filepath.Rel(d.config.DownloadPath, path)
+		d.logger.Debug(fmt.Sprintf("Removing: %s", relPath))
+		if err := d.fs.Remove(path); err != nil {
+			d.logger.Warn(fmt.Sprintf("cannot remove %s: %v", relPath, err))
+		}
+	}
+	return nil
+}
+
+// isBinaryPackageFile reports whether name is a binary package: a .deb or an installer .udeb.
+func isBinaryPackageFile(name string) bool {
+	return strings.HasSuffix(name, ".deb") || strings.HasSuffix(name, ".udeb")
+}
+
+// isSourceFile reports whether name looks like part of a source package: the .dsc
+// description, an upstream or Debian tarball (or its detached signature), or a legacy
+// .diff.gz.
+func isSourceFile(name string) bool {
+	base := path.Base(name)
+	return strings.HasSuffix(base, ".dsc") ||
+		strings.HasSuffix(base, ".diff.gz") ||
+		strings.Contains(base, ".tar.")
+}
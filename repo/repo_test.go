@@ -8,10 +8,15 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
 	"slices"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/ulikunitz/xz"
 )
 
 // mockLogger is a simple logger for testing that captures log messages.
@@ -39,18 +44,21 @@ func (l *mockLogger) Warn(msg string, _ ...any) {
 }
 
 // mockDownloader is a simple downloader for testing that doesn't actually download.
-// By default every call records the requested URL and returns a fixed fake hash.
+// By default every call records the requested URL (and the expected checksum it was given)
+// and returns a fixed fake hash.
 // For finer control, hashByURL maps specific URLs to the hash they should return and
 // errByURL maps specific URLs to an error; err forces the same error for every call.
 type mockDownloader struct {
 	downloads []string
+	checksums []string // expected SHA256 passed with each call, parallel to downloads
 	err       error
 	hashByURL map[string]string
 	errByURL  map[string]error
 }
 
-func (d *mockDownloader) DownloadFile(urlStr string, _ string, _ string) (string, error) {
+func (d *mockDownloader) DownloadFile(urlStr string, _ string, expectedSHA256 string) (string, error) {
 	d.downloads = append(d.downloads, urlStr)
+	d.checksums = append(d.checksums, expectedSHA256)
 	if d.err != nil {
 		return "", d.err
 	}
@@ -198,6 +206,34 @@ func TestNewDittoRepo(t *testing.T) {
 			t.Errorf("expected ['http://mirror-a/ubuntu', 'http://mirror-b/ubuntu'], got %v", repo.config.RepoURLs)
 		}
 	})
+	t.Run("validator cache defaults outside the download path", func(t *testing.T) {
+		t.Setenv("XDG_CACHE_HOME", "/cache")
+		t.Setenv("HOME", "/home/ditto")
+		cacheDir, err := os.UserCacheDir()
+		if err != nil {
+			t.Skipf("no user cache directory: %v", err)
+		}
+		config := DittoConfig{
+			DownloadPath: "/mirror",
+			Logger:       logger,
+			FileSystem:   NewOsFileSystem(),
+			Downloader:   downloader,
+		}
+		repo := NewDittoRepo(config).(*dittoRepo)
+		cache := repo.config.HTTP.ValidatorCache
+		if !strings.HasPrefix(cache, filepath.Join(cacheDir, "ditto-repo")+string(filepath.Separator)) {
+			t.Errorf("validator cache %q is not in %s", cache, cacheDir)
+		}
+		config.DownloadPath = "/other-mirror"
+		if other := NewDittoRepo(config).(*dittoRepo).config.HTTP.ValidatorCache; other == cache {
+			t.Errorf("mirrors at different paths share the validator cache %q", cache)
+		}
+		// A host path means nothing to another FileSystem.
+		config.FileSystem = fs
+		if other := NewDittoRepo(config).(*dittoRepo).config.HTTP.ValidatorCache; other != "" {
+			t.Errorf("validator cache defaults to %q with a custom FileSystem", other)
+		}
+	})
 }
 
 func TestParseReleaseFile(t *testing.T) {
@@ -242,30 +278,27 @@ SHA256:
 	}
 
 	repo := NewDittoRepo(config).(*dittoRepo)
-	indices := repo.parseReleaseFile(releaseContent)
-
-	expected := []string{
-		"main/binary-amd64/Packages.gz",
-		"main/binary-arm64/Packages.gz",
-		"universe/binary-amd64/Packages.xz",
-		"main/i18n/Translation-en.gz",
-		"main/i18n/Translation-es.bz2",
-		"main/cnf/Commands-amd64.xz",
-		"main/cnf/Commands-arm64.xz",
-		"universe/cnf/Commands-amd64.xz",
-		"main/dep11/Components-amd64.yml.gz",
-		"main/dep11/Components-arm64.yml.xz",
-		"main/dep11/icons-64x64.tar.gz",
-	}
-
-	if len(indices) != len(expected) {
-		t.Errorf("expected %d indices, got %d", len(expected), len(indices))
-	}
-
-	for i, idx := range indices {
-		if idx != expected[i] {
-			t.Errorf("index %d: expected %s, got %s", i, expected[i], idx)
-		}
+	indices, err := repo.parseReleaseFile(releaseContent)
+	if err != nil {
+		t.Fatalf("parseReleaseFile failed: %v", err)
+	}
+
+	// Size and SHA256 are carried alongside each path.
+	expected := []releaseEntry{
+		{Path: "main/binary-amd64/Packages.gz", Size: 0, SHA256: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		{Path: "main/binary-arm64/Packages.gz", Size: 12345, SHA256: "abc1234567890abcdef1234567890abcdef1234567890abcdef1234567890abc"},
+		{Path: "universe/binary-amd64/Packages.xz", Size: 5678, SHA256: "def9876543210fedcba9876543210fedcba9876543210fedcba9876543210fed"},
+		{Path: "main/i18n/Translation-en.gz", Size: 1000, SHA256: "123abc456def789012abc456def789012abc456def789012abc456def789012a"},
+		{Path: "main/i18n/Translation-es.bz2", Size: 2000, SHA256: "456def789abc012345def789abc012345def789abc012345def789abc012345d"},
+		{Path: "main/cnf/Commands-amd64.xz", Size: 4000, SHA256: "aaa111bbb222ccc333ddd444eee555fff666aaa111bbb222ccc333ddd444eee5"},
+		{Path: "main/cnf/Commands-arm64.xz", Size: 5000, SHA256: "bbb222ccc333ddd444eee555fff666aaa111bbb222ccc333ddd444eee555fff6"},
+		{Path: "universe/cnf/Commands-amd64.xz", Size: 6000, SHA256: "ccc333ddd444eee555fff666aaa111bbb222ccc333ddd444eee555fff666aaa1"},
+		{Path: "main/dep11/Components-amd64.yml.gz", Size: 7000, SHA256: "ddd444eee555fff666aaa111bbb222ccc333ddd444eee555fff666aaa111bbb2"},
+		{Path: "main/dep11/Components-arm64.yml.xz", Size: 8000, SHA256: "eee555fff666aaa111bbb222ccc333ddd444eee555fff666aaa111bbb222ccc3"},
+		{Path: "main/dep11/icons-64x64.tar.gz", Size: 10000, SHA256: "111222333444555666777888999000111222333444555666777888999000111"},
+	}
+	if !slices.Equal(indices, expected) {
+		t.Errorf("parseReleaseFile returned\n%+v\nwant\n%+v", indices, expected)
 	}
 }
 
@@ -645,13 +678,62 @@ func TestParseReleaseFile_EmptyContent(t *testing.T) {
 	}
 
 	repo := NewDittoRepo(config).(*dittoRepo)
-	indices := repo.parseReleaseFile("")
+	indices, err := repo.parseReleaseFile("")
+	if err != nil {
+		t.Fatalf("parseReleaseFile failed: %v", err)
+	}
 
 	if len(indices) != 0 {
 		t.Errorf("expected 0 indices from empty content, got %d", len(indices))
 	}
 }
 
+func TestParseReleaseFile_InRelease(t *testing.T) {
+	repo := newTestRepo(t, DittoConfig{
+		Components: []string{"main"},
+		Archs:      []string{"amd64"},
+	}, &mockDownloader{})
+
+	inRelease := `-----BEGIN PGP SIGNED MESSAGE-----
+Hash: SHA512
+
+Origin: Ubuntu
+Description: Ubuntu Noble
+ with a continuation line
+SHA256:
+ e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855        0 main/binary-amd64/Packages.gz
+-----BEGIN PGP SIGNATURE-----
+
+iQIzBAEBCgAdFiEE
+-----END PGP SIGNATURE-----
+`
+	indices, err := repo.parseReleaseFile(inRelease)
+	if err != nil {
+		t.Fatalf("parseReleaseFile failed: %v", err)
+	}
+	if len(indices) != 1 || indices[0].Path != "main/binary-amd64/Packages.gz" {
+		t.Errorf("parseReleaseFile = %+v, want only main/binary-amd64/Packages.gz", indices)
+	}
+
+	// Malformed lines are logged and skipped; the rest of the Release file is still used.
+	indices, err = repo.parseReleaseFile(`Origin: Ubuntu
+not a field line
+SHA256:
+ not-a-checksum-line
+ e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855  invalid main/binary-amd64/Packages.xz
+ e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855        0 main/binary-amd64/Packages.gz
+`)
+	if err != nil {
+		t.Fatalf("parseReleaseFile failed on malformed lines: %v", err)
+	}
+	if len(indices) != 1 || indices[0].Path != "main/binary-amd64/Packages.gz" {
+		t.Errorf("parseReleaseFile = %+v, want only main/binary-amd64/Packages.gz", indices)
+	}
+	if warnings := repo.logger.(*mockLogger).warnMsgs; len(warnings) != 2 {
+		t.Errorf("warnings = %q, want one for the field line and one for the SHA256 entries", warnings)
+	}
+}
+
 func TestParseReleaseFile_NoSHA256Block(t *testing.T) {
 	fs := NewMemFileSystem()
 	logger := &mockLogger{}
@@ -672,7 +754,10 @@ MD5Sum:
 	}
 
 	repo := NewDittoRepo(config).(*dittoRepo)
-	indices := repo.parseReleaseFile(releaseContent)
+	indices, err := repo.parseReleaseFile(releaseContent)
+	if err != nil {
+		t.Fatalf("parseReleaseFile failed: %v", err)
+	}
 
 	if len(indices) != 0 {
 		t.Errorf("expected 0 indices without SHA256 block, got %d", len(indices))
@@ -867,12 +952,18 @@ SHA256:
 	fs.mu.Unlock()
 
 	// Test that parseReleaseFile works for both
-	indicesFocal := repo.parseReleaseFile(releaseContentFocal)
+	indicesFocal, err := repo.parseReleaseFile(releaseContentFocal)
+	if err != nil {
+		t.Fatalf("parseReleaseFile failed: %v", err)
+	}
 	if len(indicesFocal) != 1 {
 		t.Errorf("expected 1 index for focal, got %d", len(indicesFocal))
 	}
 
-	indicesJammy := repo.parseReleaseFile(releaseContentJammy)
+	indicesJammy, err := repo.parseReleaseFile(releaseContentJammy)
+	if err != nil {
+		t.Fatalf("parseReleaseFile failed: %v", err)
+	}
 	if len(indicesJammy) != 1 {
 		t.Errorf("expected 1 index for jammy, got %d", len(indicesJammy))
 	}
@@ -1000,6 +1091,191 @@ SHA256: def456abc123def456abc123def456abc123def456abc123def456abc123def4
 	}
 }
 
+func TestExtractDebsFromIndex_Xz(t *testing.T) {
+	memFS := NewMemFileSystem().(*MemFileSystem)
+
+	packagesContent := `Package: foo
+Version: 1.0
+Filename: pool/main/f/foo/foo_1.0_amd64.deb
+Size: 98765
+SHA256: abc123def456abc123def456abc123def456abc123def456abc123def456abc1
+
+`
+	var buf bytes.Buffer
+	xzWriter, err := xz.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = xzWriter.Write([]byte(packagesContent))
+	xzWriter.Close()
+
+	testPath := "/test/Packages.xz"
+	memFS.mu.Lock()
+	memFS.files["/test"] = &memFile{isDir: true, mode: 0o755, modTime: time.Now()}
+	memFS.files[testPath] = &memFile{data: buf.Bytes(), mode: 0o644, modTime: time.Now()}
+	memFS.mu.Unlock()
+
+	repo := NewDittoRepo(DittoConfig{Logger: &mockLogger{}, FileSystem: memFS, Downloader: &mockDownloader{}}).(*dittoRepo)
+
+	packages, err := repo.extractDebsFromIndex(testPath)
+	if err != nil {
+		t.Fatalf("extractDebsFromIndex failed: %v", err)
+	}
+	if len(packages) != 1 {
+		t.Fatalf("expected 1 package, got %d", len(packages))
+	}
+	if packages[0].Path != "pool/main/f/foo/foo_1.0_amd64.deb" || packages[0].Size != 98765 {
+		t.Errorf("unexpected package: %+v", packages[0])
+	}
+}
+
+func TestExtractSourcesFromIndex(t *testing.T) {
+	memFS := NewMemFileSystem().(*MemFileSystem)
+
+	sourcesContent := `Package: hello
+Binary: hello
+Version: 2.10-3
+Maintainer: Santiago Vila <sanvila@debian.org>
+Build-Depends: debhelper-compat (= 13),
+ help2man,
+ texinfo
+Format: 3.0 (quilt)
+Files:
+ 0d1a5cb0cc9d0fe1ba4d0b4e3a4f4b4b 1847 hello_2.10-3.dsc
+Checksums-Sha256:
+ aaaa000000000000000000000000000000000000000000000000000000000001 1847 hello_2.10-3.dsc
+ aaaa000000000000000000000000000000000000000000000000000000000002 725946 hello_2.10.orig.tar.gz
+ aaaa000000000000000000000000000000000000000000000000000000000003 12688 hello_2.10-3.debian.tar.xz
+Directory: pool/main/h/hello
+Priority: optional
+Section: devel
+
+Package: nodir
+Checksums-Sha256:
+ bbbb000000000000000000000000000000000000000000000000000000000001 10 nodir_1.0.dsc
+`
+	var buf bytes.Buffer
+	gzWriter := gzip.NewWriter(&buf)
+	_, _ = gzWriter.Write([]byte(sourcesContent))
+	gzWriter.Close()
+
+	testPath := "/test/Sources.gz"
+	memFS.mu.Lock()
+	memFS.files["/test"] = &memFile{isDir: true, mode: 0o755, modTime: time.Now()}
+	memFS.files[testPath] = &memFile{data: buf.Bytes(), mode: 0o644, modTime: time.Now()}
+	memFS.mu.Unlock()
+
+	repo := NewDittoRepo(DittoConfig{Logger: &mockLogger{}, FileSystem: memFS, Downloader: &mockDownloader{}}).(*dittoRepo)
+
+	files, err := repo.extractSourcesFromIndex(testPath)
+	if err != nil {
+		t.Fatalf("extractSourcesFromIndex failed: %v", err)
+	}
+
+	// The stanza without a Directory cannot be placed in the pool and is skipped.
+	want := []packageMeta{
+		{Path: "pool/main/h/hello/hello_2.10-3.dsc", SHA256: "aaaa000000000000000000000000000000000000000000000000000000000001", Size: 1847},
+		{Path: "pool/main/h/hello/hello_2.10.orig.tar.gz", SHA256: "aaaa000000000000000000000000000000000000000000000000000000000002", Size: 725946},
+		{Path: "pool/main/h/hello/hello_2.10-3.debian.tar.xz", SHA256: "aaaa000000000000000000000000000000000000000000000000000000000003", Size: 12688},
+	}
+	if len(files) != len(want) {
+		t.Fatalf("expected %d files, got %d: %+v", len(want), len(files), files)
+	}
+	for i := range want {
+		if files[i] != want[i] {
+			t.Errorf("file %d: expected %+v, got %+v", i, want[i], files[i])
+		}
+	}
+}
+
+func TestIsDesired_Sources(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		repo := newTestRepo(t, DittoConfig{
+			Components: []string{"main"},
+			Archs:      []string{"amd64"},
+			Sources:    enabled,
+		}, &mockDownloader{})
+
+		if got := repo.isDesired("main/source/Sources.xz"); got != enabled {
+			t.Errorf("Sources=%v: isDesired(main/source/Sources.xz) = %v", enabled, got)
+		}
+		if repo.isDesired("contrib/source/Sources.xz") {
+			t.Errorf("Sources=%v: Sources index of an unselected component is desired", enabled)
+		}
+		if repo.isDesired("main/source/Release") {
+			t.Errorf("Sources=%v: component source Release is desired", enabled)
+		}
+	}
+}
+
+func TestIsDesired_Contents(t *testing.T) {
+	config := DittoConfig{
+		Components: []string{"main", "universe"},
+		Archs:      []string{"amd64", "arm64"},
+		Contents:   true,
+	}
+	repo := newTestRepo(t, config, &mockDownloader{})
+
+	tests := []struct {
+		filePath string
+		want     bool
+	}{
+		{"Contents-amd64.gz", true},
+		{"Contents-arm64", true},
+		{"main/Contents-amd64.gz", true},
+		{"universe/Contents-arm64.xz", true},
+		{"Contents-i386.gz", false},
+		{"main/Contents-amd64v3.gz", false},
+		{"contrib/Contents-amd64.gz", false},
+		{"main/Contents-source.gz", false},
+	}
+	for _, tt := range tests {
+		if got := repo.isDesired(tt.filePath); got != tt.want {
+			t.Errorf("isDesired(%s) = %v, want %v", tt.filePath, got, tt.want)
+		}
+	}
+
+	// Contents-source follows the Sources option.
+	config.Sources = true
+	repo = newTestRepo(t, config, &mockDownloader{})
+	if !repo.isDesired("main/Contents-source.gz") {
+		t.Error("Contents-source should be desired when Sources is enabled")
+	}
+
+	// Contents are opt-in.
+	config.Contents = false
+	repo = newTestRepo(t, config, &mockDownloader{})
+	if repo.isDesired("main/Contents-amd64.gz") || repo.isDesired("Contents-amd64.gz") {
+		t.Error("Contents should not be desired unless enabled")
+	}
+}
+
+func TestIsDesired_DebianInstaller(t *testing.T) {
+	config := DittoConfig{
+		Components: []string{"main"},
+		Archs:      []string{"amd64"},
+		Contents:   true,
+	}
+
+	for _, enabled := range []bool{false, true} {
+		config.DebianInstaller = enabled
+		repo := newTestRepo(t, config, &mockDownloader{})
+
+		if got := repo.isDesired("main/debian-installer/binary-amd64/Packages.xz"); got != enabled {
+			t.Errorf("DebianInstaller=%v: isDesired(udeb index) = %v", enabled, got)
+		}
+		if got := repo.isDesired("main/Contents-udeb-amd64.gz"); got != enabled {
+			t.Errorf("DebianInstaller=%v: isDesired(Contents-udeb) = %v", enabled, got)
+		}
+		if repo.isDesired("main/debian-installer/binary-i386/Packages.xz") {
+			t.Errorf("DebianInstaller=%v: udeb index for an unselected arch is desired", enabled)
+		}
+		if !repo.isDesired("main/binary-amd64/Packages.xz") {
+			t.Errorf("DebianInstaller=%v: regular binary index is not desired", enabled)
+		}
+	}
+}
+
 // indexFailingDownloader succeeds for all requests except those whose URL
 // contains "Packages", which it returns a configurable error for.
 type indexFailingDownloader struct {
@@ -1079,6 +1355,214 @@ SHA256:
 	})
 }
 
+func TestMirrorDistribution_VerifiesIndexChecksums(t *testing.T) {
+	const indexHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	releaseContent := `Origin: Ubuntu
+Suite: focal
+SHA256:
+ ` + indexHash + `        0 main/binary-amd64/Packages.gz
+`
+	memFS := NewMemFileSystem().(*MemFileSystem)
+	_ = memFS.MkdirAll("/mirror/dists/focal", 0o755)
+	memFS.mu.Lock()
+	memFS.files["/mirror/dists/focal/Release"] = &memFile{data: []byte(releaseContent), mode: 0o644, modTime: time.Now()}
+	memFS.mu.Unlock()
+
+	md := &mockDownloader{}
+	repo := NewDittoRepo(DittoConfig{
+		RepoURL:             "http://example.com/ubuntu",
+		Dists:               []string{"focal"},
+		Components:          []string{"main"},
+		Archs:               []string{"amd64"},
+		DownloadPath:        "/mirror",
+		AllowMissingIndices: true,
+		Logger:              &mockLogger{},
+		FileSystem:          memFS,
+		Downloader:          md,
+	}).(*dittoRepo)
+	repo.progressChan = make(chan ProgressUpdate, 100)
+
+	if err := repo.mirrorDistribution(context.Background(), "focal"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	found := false
+	for i, url := range md.downloads {
+		if strings.HasSuffix(url, "/main/binary-amd64/Packages.gz") {
+			found = true
+			if md.checksums[i] != indexHash {
+				t.Errorf("index downloaded with expected checksum %q, want %q", md.checksums[i], indexHash)
+			}
+		}
+	}
+	if !found {
+		t.Fatal("Packages.gz index was not downloaded")
+	}
+}
+
+func TestMirrorDistribution_VerifiesIndexSize(t *testing.T) {
+	releaseContent := `Origin: Ubuntu
+Suite: focal
+SHA256:
+ e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855       42 main/binary-amd64/Packages.gz
+`
+	memFS := NewMemFileSystem().(*MemFileSystem)
+	_ = memFS.MkdirAll("/mirror/dists/focal/main/binary-amd64", 0o755)
+	memFS.mu.Lock()
+	memFS.files["/mirror/dists/focal/Release"] = &memFile{data: []byte(releaseContent), mode: 0o644, modTime: time.Now()}
+	// The mock downloader does not write files: the "downloaded" index is empty.
+	memFS.files["/mirror/dists/focal/main/binary-amd64/Packages.gz"] = &memFile{mode: 0o644, modTime: time.Now()}
+	memFS.mu.Unlock()
+
+	repo := NewDittoRepo(DittoConfig{
+		RepoURL:      "http://example.com/ubuntu",
+		Components:   []string{"main"},
+		Archs:        []string{"amd64"},
+		DownloadPath: "/mirror",
+		Logger:       &mockLogger{},
+		FileSystem:   memFS,
+		Downloader:   &mockDownloader{},
+	}).(*dittoRepo)
+
+	_, err := repo.fetchDistributionIndices(context.Background(), "focal")
+	if err == nil || !strings.Contains(err.Error(), "size mismatch") {
+		t.Fatalf("fetchDistributionIndices = %v, want a size mismatch", err)
+	}
+	if _, err := memFS.Stat("/mirror/dists/focal/main/binary-amd64/Packages.gz"); err == nil {
+		t.Error("the index of the wrong size was kept")
+	}
+}
+
+func TestMirrorDistribution_ByHash(t *testing.T) {
+	// Neither hash is that of the (empty) pre-seeded indices, so both are fetched.
+	const packagesHash = "1111111111111111111111111111111111111111111111111111111111111111"
+	const translationHash = "5f70bf18a086007016e948b04aed3b82103a36bea41755b6cddfaf10ace3c6ef"
+	const base = "http://example.com/ubuntu/dists/focal/"
+	release := `Origin: Ubuntu
+Suite: focal
+SHA256:
+ ` + packagesHash + `        0 main/binary-amd64/Packages.gz
+ ` + translationHash + `        0 main/i18n/Translation-en.gz
+`
+	for _, tc := range []struct {
+		name    string
+		release string
+		want    []string
+	}{
+		{
+			// The by-hash failure is transient, but it falls back at once instead of
+			// being retried.
+			name:    "by hash, falling back to the name",
+			release: "Acquire-By-Hash: yes\n" + release,
+			want: []string{
+				base + "main/binary-amd64/by-hash/SHA256/" + packagesHash,
+				base + "main/i18n/by-hash/SHA256/" + translationHash,
+				base + "main/i18n/Translation-en.gz",
+			},
+		},
+		{
+			name:    "by name without Acquire-By-Hash",
+			release: release,
+			want:    []string{base + "main/binary-amd64/Packages.gz", base + "main/i18n/Translation-en.gz"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			memFS := NewMemFileSystem().(*MemFileSystem)
+			_ = memFS.MkdirAll("/mirror/dists/focal", 0o755)
+			memFS.mu.Lock()
+			memFS.files["/mirror/dists/focal/Release"] = &memFile{data: []byte(tc.release), mode: 0o644, modTime: time.Now()}
+			// The mock downloader does not write files, so the (empty) indices are pre-seeded.
+			memFS.files["/mirror/dists/focal/main/binary-amd64/Packages.gz"] = &memFile{mode: 0o644, modTime: time.Now()}
+			memFS.files["/mirror/dists/focal/main/i18n/Translation-en.gz"] = &memFile{mode: 0o644, modTime: time.Now()}
+			memFS.mu.Unlock()
+
+			md := &mockDownloader{errByURL: map[string]error{
+				base + "main/i18n/by-hash/SHA256/" + translationHash: &HTTPStatusError{StatusCode: http.StatusServiceUnavailable},
+			}}
+			repo := NewDittoRepo(DittoConfig{
+				RepoURLs:     []string{"http://example.com/ubuntu"},
+				Components:   []string{"main"},
+				Archs:        []string{"amd64"},
+				Languages:    []string{"en"},
+				DownloadPath: "/mirror",
+				MaxRetries:   3,
+				RetryBackoff: Duration(time.Millisecond),
+				Logger:       &mockLogger{},
+				FileSystem:   memFS,
+				Downloader:   md,
+			}).(*dittoRepo)
+
+			if _, err := repo.fetchDistributionIndices(context.Background(), "focal"); err != nil {
+				t.Fatalf("fetchDistributionIndices failed: %v", err)
+			}
+			var got []string
+			for i, url := range md.downloads {
+				if strings.Contains(url, "/main/") {
+					got = append(got, url)
+					if md.checksums[i] == "" {
+						t.Errorf("%s downloaded without its checksum", url)
+					}
+				}
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("index downloads = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDownloadIndex_SkipsUpToDate(t *testing.T) {
+	content := []byte("Package: foo\n")
+	memFS := NewMemFileSystem().(*MemFileSystem)
+	_ = memFS.MkdirAll("/mirror/dists/focal/main/binary-amd64", 0o755)
+	writeMemFile(t, memFS, "/mirror/dists/focal/main/binary-amd64/Packages", content)
+	md := &mockDownloader{}
+	repo := NewDittoRepo(DittoConfig{
+		RepoURLs:     []string{"http://example.com/ubuntu"},
+		DownloadPath: "/mirror",
+		MaxRetries:   -1,
+		Logger:       &mockLogger{},
+		FileSystem:   memFS,
+		Downloader:   md,
+	}).(*dittoRepo)
+
+	idx := releaseEntry{Path: "main/binary-amd64/Packages", Size: int64(len(content)), SHA256: sha256Hex(content)}
+	hash, err := repo.downloadIndex(context.Background(), "dists/focal/main/binary-amd64/Packages", "/mirror/dists/focal/main/binary-amd64/Packages", idx, true)
+	if err != nil {
+		t.Fatalf("downloadIndex failed: %v", err)
+	}
+	if hash != idx.SHA256 {
+		t.Errorf("hash = %s, want %s", hash, idx.SHA256)
+	}
+	if len(md.downloads) != 0 {
+		t.Errorf("up-to-date index downloaded again: %v", md.downloads)
+	}
+
+	// A changed upstream index is fetched again.
+	idx.SHA256 = strings.Repeat("2", 64)
+	_, _ = repo.downloadIndex(context.Background(), "dists/focal/main/binary-amd64/Packages", "/mirror/dists/focal/main/binary-amd64/Packages", idx, false)
+	if len(md.downloads) != 1 {
+		t.Errorf("changed index not downloaded: %v", md.downloads)
+	}
+}
+
+func TestAcquiredByHash(t *testing.T) {
+	for relPath, want := range map[string]bool{
+		"main/binary-amd64/Packages.gz":                  true,
+		"main/source/Sources.xz":                         true,
+		"main/i18n/Translation-en.bz2":                   true,
+		"main/Contents-amd64.gz":                         true,
+		"Contents-amd64.gz":                              false,
+		"main/installer-amd64/current/images/SHA256SUMS": false,
+		"main/uefi/grub2-amd64/current/SHA256SUMS":       false,
+		"main/signed/linux-amd64/current/SHA256SUMS":     false,
+	} {
+		if got := acquiredByHash(relPath); got != want {
+			t.Errorf("acquiredByHash(%q) = %v, want %v", relPath, got, want)
+		}
+	}
+}
+
 // trackingDownloader records which URLs were actually downloaded (i.e. not skipped).
 type trackingDownloader struct {
 	downloads []string
@@ -1213,6 +1697,7 @@ func TestPreferredBaseForPath(t *testing.T) {
 		{"binary index for arm64", "dists/stonking/main/binary-arm64/Packages.gz", ports},
 		{"cnf commands for armhf", "dists/stonking/main/cnf/Commands-armhf.xz", ports},
 		{"package filename for arm64", "pool/main/h/hello/hello_2.10_arm64.deb", ports},
+		{"udeb filename for arm64", "pool/main/d/di-utils/di-utils_1.0_arm64.udeb", ports},
 		{"binary index for amd64", "dists/stonking/main/binary-amd64/Packages.gz", amd64Mirror},
 		{"amd64 does not match amd64v3 index", "dists/stonking/main/binary-amd64v3/Packages.gz", ""},
 		{"amd64 does not match amd64v3 package", "pool/main/h/hello/hello_2.10_amd64v3.deb", ""},
@@ -1279,7 +1764,7 @@ func TestDownloadWithFailover(t *testing.T) {
 		md := &mockDownloader{}
 		repo := newTestRepo(t, DittoConfig{RepoURLs: []string{archive, ports}}, md)
 
-		hash, err := repo.downloadWithFailover(relPath, "/tmp/Release", "")
+		hash, err := repo.downloadWithFailover(context.Background(), relPath, "/tmp/Release", "")
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
@@ -1300,7 +1785,7 @@ func TestDownloadWithFailover(t *testing.T) {
 		}
 		repo := newTestRepo(t, DittoConfig{RepoURLs: []string{archive, ports}}, md)
 
-		hash, err := repo.downloadWithFailover(relPath, "/tmp/Release", "")
+		hash, err := repo.downloadWithFailover(context.Background(), relPath, "/tmp/Release", "")
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
@@ -1319,7 +1804,7 @@ func TestDownloadWithFailover(t *testing.T) {
 		md := &mockDownloader{err: errors.New("boom")}
 		repo := newTestRepo(t, DittoConfig{RepoURLs: []string{archive, ports}}, md)
 
-		if _, err := repo.downloadWithFailover(relPath, "/tmp/Release", ""); err == nil {
+		if _, err := repo.downloadWithFailover(context.Background(), relPath, "/tmp/Release", ""); err == nil {
 			t.Fatal("expected error when all mirrors fail, got nil")
 		}
 		if len(md.downloads) != 2 {
@@ -1335,7 +1820,7 @@ func TestDownloadWithFailover(t *testing.T) {
 		}, md)
 
 		archRelPath := "pool/main/h/hello/hello_2.10_arm64.deb"
-		if _, err := repo.downloadWithFailover(archRelPath, "/tmp/hello.deb", ""); err != nil {
+		if _, err := repo.downloadWithFailover(context.Background(), archRelPath, "/tmp/hello.deb", ""); err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
 		if md.downloads[0] != ports+"/"+archRelPath {
@@ -1345,7 +1830,7 @@ func TestDownloadWithFailover(t *testing.T) {
 
 	t.Run("no repo URLs configured returns an error", func(t *testing.T) {
 		repo := newTestRepo(t, DittoConfig{}, &mockDownloader{})
-		if _, err := repo.downloadWithFailover(relPath, "/tmp/Release", ""); err == nil {
+		if _, err := repo.downloadWithFailover(context.Background(), relPath, "/tmp/Release", ""); err == nil {
 			t.Fatal("expected error when no repo URLs are configured")
 		}
 	})
@@ -1372,7 +1857,7 @@ func TestLearnedArchURLs(t *testing.T) {
 			t.Fatalf("before learning: candidateURLs = %v, want [archive ports]", got)
 		}
 
-		if _, err := repo.downloadWithFailover(arm64Index, "/tmp/Packages.gz", ""); err != nil {
+		if _, err := repo.downloadWithFailover(context.Background(), arm64Index, "/tmp/Packages.gz", ""); err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
 
@@ -1386,7 +1871,7 @@ func TestLearnedArchURLs(t *testing.T) {
 
 		// A subsequent arm64 download should hit ports first (no wasted archive attempt).
 		before := len(md.downloads)
-		if _, err := repo.downloadWithFailover(arm64Deb, "/tmp/hello.deb", ""); err != nil {
+		if _, err := repo.downloadWithFailover(context.Background(), arm64Deb, "/tmp/hello.deb", ""); err != nil {
 			t.Fatalf("unexpected error on second download: %v", err)
 		}
 		if md.downloads[before] != ports+"/"+arm64Deb {
@@ -1407,7 +1892,7 @@ func TestLearnedArchURLs(t *testing.T) {
 
 		// Even though ports serves this file, the explicit mapping (archive) is honored
 		// and the learned cache is left untouched.
-		if _, err := repo.downloadWithFailover(arm64Index, "/tmp/Packages.gz", ""); err != nil {
+		if _, err := repo.downloadWithFailover(context.Background(), arm64Index, "/tmp/Packages.gz", ""); err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
 
@@ -1430,7 +1915,7 @@ func TestLearnedArchURLs(t *testing.T) {
 		}, md)
 
 		// archive serves the first arm64 file, so it is learned.
-		if _, err := repo.downloadWithFailover(arm64Index, "/tmp/Packages.gz", ""); err != nil {
+		if _, err := repo.downloadWithFailover(context.Background(), arm64Index, "/tmp/Packages.gz", ""); err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
 		// A later success from a different mirror must not overwrite the learned entry.
@@ -1451,7 +1936,7 @@ func TestLearnedArchURLs(t *testing.T) {
 			Archs:    []string{"arm64"},
 		}, md)
 
-		if _, err := repo.downloadWithFailover("dists/stonking/Release", "/tmp/Release", ""); err != nil {
+		if _, err := repo.downloadWithFailover(context.Background(), "dists/stonking/Release", "/tmp/Release", ""); err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
 		repo.archCacheMu.RLock()
@@ -1558,3 +2043,88 @@ func TestValidateMirrorConsistency(t *testing.T) {
 		}
 	})
 }
+
+func TestIsDesired_Flat(t *testing.T) {
+	repo := newTestRepo(t, DittoConfig{
+		Flat:      true,
+		Languages: []string{"en"},
+	}, &mockDownloader{})
+
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"Packages", true},
+		{"Packages.gz", true},
+		{"Packages.xz", true},
+		{"Translation-en.bz2", true},
+		{"i18n/Translation-en", true},
+		{"Translation-de", false},
+		{"Sources.gz", false},
+		{"Contents-amd64.gz", false},
+	}
+	for _, tt := range tests {
+		if got := repo.isDesired(tt.path); got != tt.want {
+			t.Errorf("isDesired(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestMirrorDistribution_Flat(t *testing.T) {
+	const indexHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	releaseContent := `Origin: Vendor
+SHA256:
+ ` + indexHash + `        0 Packages.gz
+`
+	tests := []struct {
+		dist       string
+		releaseDir string
+		wantIndex  string
+	}{
+		{"./", "/mirror", "http://example.com/repo/Packages.gz"},
+		{"/", "/mirror", "http://example.com/repo/Packages.gz"},
+		{"stable/", "/mirror/stable", "http://example.com/repo/stable/Packages.gz"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.dist, func(t *testing.T) {
+			memFS := NewMemFileSystem().(*MemFileSystem)
+			_ = memFS.MkdirAll(tt.releaseDir, 0o755)
+			memFS.mu.Lock()
+			memFS.files[tt.releaseDir+"/Release"] = &memFile{data: []byte(releaseContent), mode: 0o644, modTime: time.Now()}
+			memFS.mu.Unlock()
+
+			md := &mockDownloader{}
+			repo := NewDittoRepo(DittoConfig{
+				RepoURL:             "http://example.com/repo",
+				Dists:               []string{tt.dist},
+				DownloadPath:        "/mirror",
+				Flat:                true,
+				AllowMissingIndices: true,
+				Logger:              &mockLogger{},
+				FileSystem:          memFS,
+				Downloader:          md,
+			}).(*dittoRepo)
+			repo.progressChan = make(chan ProgressUpdate, 100)
+
+			if err := repo.mirrorDistribution(context.Background(), tt.dist); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !slices.Contains(md.downloads, tt.wantIndex) {
+				t.Errorf("expected %s to be downloaded; downloads: %v", tt.wantIndex, md.downloads)
+			}
+			for _, url := range md.downloads {
+				if strings.Contains(url, "/dists/") {
+					t.Errorf("flat mirror requested %s", url)
+				}
+			}
+		})
+	}
+
+	t.Run("rejects paths outside the repository", func(t *testing.T) {
+		repo := newTestRepo(t, DittoConfig{RepoURL: "http://example.com/repo", Flat: true}, &mockDownloader{})
+		if err := repo.mirrorDistribution(context.Background(), "../other"); err == nil {
+			t.Error("expected an error for a dist outside the repository")
+		}
+	})
+}
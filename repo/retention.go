@@ -0,0 +1,35 @@
+package repo
+
+import (
+	"slices"
+
+	"github.com/canonical/ditto-repo/deb822"
+	"github.com/canonical/ditto-repo/debversion"
+)
+
+// retainNewestVersions returns the stanzas of the newest keep versions of each package and
+// architecture, in their original order. Versions are ordered as dpkg orders them; stanzas
+// sharing a version (e.g. the same package listed twice) are kept or dropped together.
+func retainNewestVersions(stanzas []deb822.Stanza, keep int) []deb822.Stanza {
+	type packageArch struct{ name, arch string }
+
+	versions := make(map[packageArch][]string)
+	for _, stanza := range stanzas {
+		key := packageArch{stanza.Get("Package"), stanza.Get("Architecture")}
+		if v := stanza.Get("Version"); !slices.Contains(versions[key], v) {
+			versions[key] = append(versions[key], v)
+		}
+	}
+
+	kept := make(map[packageArch][]string, len(versions))
+	for key, vs := range versions {
+		// Newest first.
+		slices.SortFunc(vs, func(a, b string) int { return debversion.Compare(b, a) })
+		kept[key] = vs[:min(keep, len(vs))]
+	}
+
+	return slices.DeleteFunc(slices.Clone(stanzas), func(stanza deb822.Stanza) bool {
+		key := packageArch{stanza.Get("Package"), stanza.Get("Architecture")}
+		return !slices.Contains(kept[key], stanza.Get("Version"))
+	})
+}
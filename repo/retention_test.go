@@ -0,0 +1,95 @@
+package repo
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/canonical/ditto-repo/deb822"
+)
+
+func TestRetainNewestVersions(t *testing.T) {
+	stanza := func(pkg, arch, version string) deb822.Stanza {
+		return deb822.Stanza{Fields: []deb822.Field{
+			{Name: "Package", Value: pkg},
+			{Name: "Architecture", Value: arch},
+			{Name: "Version", Value: version},
+		}}
+	}
+	stanzas := []deb822.Stanza{
+		stanza("hello", "amd64", "2.10-1"),
+		stanza("hello", "amd64", "2.10-10"),
+		stanza("hello", "amd64", "2.10-2"),
+		stanza("hello", "amd64", "1:1.0"),
+		stanza("hello", "arm64", "2.10-1"),
+		stanza("hello-doc", "all", "2.10~rc1"),
+		stanza("hello-doc", "all", "2.10"),
+	}
+
+	var got []string
+	for _, s := range retainNewestVersions(stanzas, 2) {
+		got = append(got, s.Get("Package")+"/"+s.Get("Architecture")+"="+s.Get("Version"))
+	}
+	want := []string{
+		"hello/amd64=2.10-10",
+		"hello/amd64=1:1.0",
+		"hello/arm64=2.10-1",
+		"hello-doc/all=2.10~rc1",
+		"hello-doc/all=2.10",
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("retainNewestVersions = %v, want %v", got, want)
+	}
+}
+
+func TestExtractDebsFromIndex_KeepVersions(t *testing.T) {
+	const index = "/mirror/dists/internal/main/binary-amd64/Packages"
+	packages := strings.Join([]string{
+		"Package: tool\nArchitecture: amd64\nVersion: 1.9-1\nFilename: pool/main/t/tool/tool_1.9-1_amd64.deb\nSHA256: aaaa\nSize: 1\n",
+		"Package: tool\nArchitecture: amd64\nVersion: 1.10-1\nFilename: pool/main/t/tool/tool_1.10-1_amd64.deb\nSHA256: bbbb\nSize: 1\n",
+		"Package: tool\nArchitecture: amd64\nVersion: 1.10~beta1-1\nFilename: pool/main/t/tool/tool_1.10~beta1-1_amd64.deb\nSHA256: cccc\nSize: 1\n",
+	}, "\n")
+
+	memFS := NewMemFileSystem().(*MemFileSystem)
+	_ = memFS.MkdirAll("/mirror/dists/internal/main/binary-amd64", 0o755)
+	_ = memFS.MkdirAll("/mirror/pool/main/t/tool", 0o755)
+	memFS.mu.Lock()
+	memFS.files[index] = &memFile{data: []byte(packages), mode: 0o644, modTime: time.Now()}
+	for _, name := range []string{"tool_1.9-1_amd64.deb", "tool_1.10-1_amd64.deb", "tool_1.10~beta1-1_amd64.deb"} {
+		memFS.files["/mirror/pool/main/t/tool/"+name] = &memFile{data: []byte("x"), mode: 0o644, modTime: time.Now()}
+	}
+	memFS.mu.Unlock()
+
+	repo := NewDittoRepo(DittoConfig{
+		Dists:        []string{"internal"},
+		DownloadPath: "/mirror",
+		KeepVersions: 2,
+		Logger:       &mockLogger{},
+		FileSystem:   memFS,
+		Downloader:   &mockDownloader{},
+	}).(*dittoRepo)
+
+	debs, err := repo.extractDebsFromIndex(index)
+	if err != nil {
+		t.Fatalf("extractDebsFromIndex failed: %v", err)
+	}
+	var paths []string
+	for _, deb := range debs {
+		paths = append(paths, deb.Path)
+	}
+	want := []string{"pool/main/t/tool/tool_1.10-1_amd64.deb", "pool/main/t/tool/tool_1.10~beta1-1_amd64.deb"}
+	if strings.Join(paths, " ") != strings.Join(want, " ") {
+		t.Errorf("extractDebsFromIndex = %v, want %v", paths, want)
+	}
+
+	// The oldest version, mirrored before retention was configured, is cleaned up.
+	if err := repo.cleanupOrphanedPackages(); err != nil {
+		t.Fatalf("cleanupOrphanedPackages failed: %v", err)
+	}
+	if _, err := memFS.Stat("/mirror/pool/main/t/tool/tool_1.9-1_amd64.deb"); err == nil {
+		t.Error("version beyond keep-versions was not removed by cleanup")
+	}
+	if _, err := memFS.Stat("/mirror/pool/main/t/tool/tool_1.10-1_amd64.deb"); err != nil {
+		t.Error("retained version was removed by cleanup")
+	}
+}
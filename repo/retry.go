@@ -0,0 +1,92 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// isRetryableError reports whether a download that failed with err may succeed if
+// attempted again: server errors, rate limiting, request timeouts and dropped connections.
+// Anything else (404, a checksum mismatch, a local I/O error) is permanent for that mirror.
+func isRetryableError(err error) bool {
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500 ||
+			statusErr.StatusCode == http.StatusTooManyRequests ||
+			statusErr.StatusCode == http.StatusRequestTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// retryDelay reports whether a download that failed with err should be retried on the same
+// mirror and, if so, the minimum delay the server asked for with Retry-After (zero when
+// it did not). A mirror asking for a longer wait than MaxRetryBackoff is not retried, so
+// the download fails over to the other mirrors instead of stalling.
+func (d *dittoRepo) retryDelay(err error) (time.Duration, bool) {
+	if !isRetryableError(err) {
+		return 0, false
+	}
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) && statusErr.RetryAfter > 0 {
+		if statusErr.RetryAfter > time.Duration(d.config.MaxRetryBackoff) {
+			return 0, false
+		}
+		return statusErr.RetryAfter, true
+	}
+	return 0, true
+}
+
+// backoff returns the delay before retry number attempt+1: RetryBackoff doubled for every
+// previous attempt and capped at MaxRetryBackoff, with the upper half randomised so that
+// workers failing together do not retry in lockstep. It is never shorter than minDelay.
+func (d *dittoRepo) backoff(attempt int, minDelay time.Duration) time.Duration {
+	delay := time.Duration(d.config.RetryBackoff)
+	for i := 0; i < attempt && delay < time.Duration(d.config.MaxRetryBackoff); i++ {
+		delay *= 2
+	}
+	delay = min(delay, time.Duration(d.config.MaxRetryBackoff))
+	delay = delay/2 + rand.N(delay/2+1)
+	return max(delay, minDelay)
+}
+
+// parseRetryAfter parses the value of a Retry-After header, either a number of seconds or
+// an HTTP date, into a delay from now. It returns zero for a missing or invalid value.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
+
+// sleepContext waits for delay, returning early with ctx's error if it is cancelled.
+func sleepContext(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,204 @@
+package repo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// flakyDownloader fails each URL with the errors queued for it, in order, and succeeds once
+// they are used up.
+type flakyDownloader struct {
+	mu       sync.Mutex
+	errs     map[string][]error
+	attempts map[string]int
+}
+
+func (d *flakyDownloader) DownloadFile(urlStr string, _ string, _ string) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.attempts == nil {
+		d.attempts = make(map[string]int)
+	}
+	d.attempts[urlStr]++
+	if queued := d.errs[urlStr]; len(queued) > 0 {
+		d.errs[urlStr] = queued[1:]
+		return "", queued[0]
+	}
+	return "fakehash123", nil
+}
+
+func TestIsRetryableError(t *testing.T) {
+	reset := &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"503", &HTTPStatusError{StatusCode: http.StatusServiceUnavailable}, true},
+		{"502 wrapped", fmt.Errorf("mirror: %w", &HTTPStatusError{StatusCode: http.StatusBadGateway}), true},
+		{"429", &HTTPStatusError{StatusCode: http.StatusTooManyRequests}, true},
+		{"404", &HTTPStatusError{StatusCode: http.StatusNotFound}, false},
+		{"403", &HTTPStatusError{StatusCode: http.StatusForbidden}, false},
+		{"timeout", fmt.Errorf("http error: %w", &net.DNSError{Err: "i/o timeout", IsTimeout: true}), true},
+		{"connection reset", fmt.Errorf("copy failed: %w", reset), true},
+		{"truncated body", fmt.Errorf("copy failed: %w", io.ErrUnexpectedEOF), true},
+		{"checksum mismatch", errors.New("checksum mismatch!"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRetryableError(tt.err); got != tt.want {
+				t.Errorf("isRetryableError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if got := parseRetryAfter("120"); got != 120*time.Second {
+		t.Errorf("parseRetryAfter(120) = %v", got)
+	}
+	date := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	if got := parseRetryAfter(date); got < 59*time.Minute || got > time.Hour {
+		t.Errorf("parseRetryAfter(%q) = %v, want about an hour", date, got)
+	}
+	for _, value := range []string{"", "soon", "-5"} {
+		if got := parseRetryAfter(value); got != 0 {
+			t.Errorf("parseRetryAfter(%q) = %v, want 0", value, got)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	repo := newTestRepo(t, DittoConfig{
+		RetryBackoff:    Duration(time.Second),
+		MaxRetryBackoff: Duration(10 * time.Second),
+	}, &mockDownloader{})
+
+	for attempt, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+		for range 20 {
+			got := repo.backoff(attempt, 0)
+			if got < want/2 || got > want {
+				t.Fatalf("backoff(%d) = %v, want within [%v, %v]", attempt, got, want/2, want)
+			}
+		}
+	}
+	if got := repo.backoff(0, 5*time.Second); got != 5*time.Second {
+		t.Errorf("backoff with Retry-After = %v, want 5s", got)
+	}
+}
+
+func TestDownloadWithFailover_Retry(t *testing.T) {
+	unavailable := &HTTPStatusError{StatusCode: http.StatusServiceUnavailable}
+	notFound := &HTTPStatusError{StatusCode: http.StatusNotFound}
+	const relPath = "dists/focal/Release"
+
+	newRepo := func(t *testing.T, fd *flakyDownloader, maxRetries int) *dittoRepo {
+		return newTestRepo(t, DittoConfig{
+			RepoURLs:     []string{"http://a.example", "http://b.example"},
+			MaxRetries:   maxRetries,
+			RetryBackoff: Duration(time.Millisecond),
+		}, fd)
+	}
+
+	t.Run("retries transient failures only", func(t *testing.T) {
+		fd := &flakyDownloader{errs: map[string][]error{
+			"http://a.example/" + relPath: {unavailable, unavailable},
+			"http://b.example/" + relPath: {notFound, notFound, notFound},
+		}}
+		repo := newRepo(t, fd, 3)
+		if _, err := repo.downloadWithFailover(context.Background(), relPath, "/tmp/Release", ""); err != nil {
+			t.Fatalf("expected success after retries, got %v", err)
+		}
+		if got := fd.attempts["http://a.example/"+relPath]; got != 3 {
+			t.Errorf("transiently failing mirror tried %d times, want 3", got)
+		}
+		if got := fd.attempts["http://b.example/"+relPath]; got != 1 {
+			t.Errorf("mirror answering 404 tried %d times, want 1", got)
+		}
+	})
+
+	t.Run("gives up after MaxRetries", func(t *testing.T) {
+		fd := &flakyDownloader{errs: map[string][]error{
+			"http://a.example/" + relPath: {unavailable, unavailable, unavailable, unavailable},
+			"http://b.example/" + relPath: {unavailable, unavailable, unavailable, unavailable},
+		}}
+		repo := newRepo(t, fd, 2)
+		_, err := repo.downloadWithFailover(context.Background(), relPath, "/tmp/Release", "")
+		var statusErr *HTTPStatusError
+		if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("expected the last 503, got %v", err)
+		}
+		if got := fd.attempts["http://a.example/"+relPath]; got != 3 {
+			t.Errorf("mirror tried %d times, want 3", got)
+		}
+	})
+
+	t.Run("negative MaxRetries disables retries", func(t *testing.T) {
+		fd := &flakyDownloader{errs: map[string][]error{
+			"http://a.example/" + relPath: {unavailable},
+			"http://b.example/" + relPath: {unavailable},
+		}}
+		repo := newRepo(t, fd, -1)
+		if _, err := repo.downloadWithFailover(context.Background(), relPath, "/tmp/Release", ""); err == nil {
+			t.Fatal("expected an error without retries")
+		}
+	})
+
+	t.Run("long Retry-After fails over instead", func(t *testing.T) {
+		fd := &flakyDownloader{errs: map[string][]error{
+			"http://a.example/" + relPath: {&HTTPStatusError{StatusCode: http.StatusTooManyRequests, RetryAfter: time.Hour}},
+			"http://b.example/" + relPath: {notFound},
+		}}
+		repo := newRepo(t, fd, 3)
+		start := time.Now()
+		if _, err := repo.downloadWithFailover(context.Background(), relPath, "/tmp/Release", ""); err == nil {
+			t.Fatal("expected an error")
+		}
+		if time.Since(start) > time.Second {
+			t.Error("waited for a Retry-After beyond MaxRetryBackoff")
+		}
+	})
+
+	t.Run("cancellation interrupts the backoff", func(t *testing.T) {
+		fd := &flakyDownloader{errs: map[string][]error{
+			"http://a.example/" + relPath: {unavailable},
+			"http://b.example/" + relPath: {unavailable},
+		}}
+		repo := newTestRepo(t, DittoConfig{
+			RepoURLs:     []string{"http://a.example", "http://b.example"},
+			RetryBackoff: Duration(time.Hour),
+		}, fd)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if _, err := repo.downloadWithFailover(ctx, relPath, "/tmp/Release", ""); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected the context error, got %v", err)
+		}
+	})
+}
+
+func TestDuration_JSON(t *testing.T) {
+	var config DittoConfig
+	if err := json.Unmarshal([]byte(`{"retry-backoff": "1.5s", "max-retry-backoff": "2m"}`), &config); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if config.RetryBackoff != Duration(1500*time.Millisecond) || config.MaxRetryBackoff != Duration(2*time.Minute) {
+		t.Errorf("got %v / %v", time.Duration(config.RetryBackoff), time.Duration(config.MaxRetryBackoff))
+	}
+	if err := json.Unmarshal([]byte(`{"retry-backoff": 5}`), &config); err == nil {
+		t.Error("expected an error for a bare number")
+	}
+	out, _ := json.Marshal(Duration(90 * time.Second))
+	if string(out) != `"1m30s"` {
+		t.Errorf("Marshal = %s", out)
+	}
+}
@@ -0,0 +1,272 @@
+package repo
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+)
+
+// errSignatureMissing is returned when a distribution has neither a usable InRelease nor a
+// Release.gpg to verify.
+var errSignatureMissing = errors.New("no InRelease or Release.gpg signature found")
+
+// loadKeyring reads every configured keyring file and merges their keys into a single
+// entity list. Each file may be ASCII-armored or a binary (gpg --export) keyring.
+func (d *dittoRepo) loadKeyring() (openpgp.EntityList, error) {
+	var keyring openpgp.EntityList
+	for _, keyringPath := range d.config.Keyrings {
+		data, err := d.fs.ReadFile(keyringPath)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read keyring %s: %w", keyringPath, err)
+		}
+
+		var entities openpgp.EntityList
+		if isArmored(data) {
+			entities, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+		} else {
+			entities, err = openpgp.ReadKeyRing(bytes.NewReader(data))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse keyring %s: %w", keyringPath, err)
+		}
+		keyring = append(keyring, entities...)
+	}
+	if len(keyring) == 0 {
+		return nil, errors.New("configured keyrings contain no keys")
+	}
+	return keyring, nil
+}
+
+// verifyReleaseSignature checks the InRelease and Release.gpg files already downloaded for
+// dist against the configured keyring. Every signature present must be valid and, when
+// KeyFingerprints is set, made by one of the pinned keys. The local Release file must be
+// covered by at least one of them: either directly by Release.gpg, or by an InRelease whose
+// signed text is identical to it. This runs before any index is parsed so that nothing an
+// unauthenticated Release file lists is ever trusted.
+func (d *dittoRepo) verifyReleaseSignature(dist string) error {
+	keyring, err := d.loadKeyring()
+	if err != nil {
+		return err
+	}
+
+	distDir := path.Join(d.config.DownloadPath, d.distDir(dist))
+	release, err := d.fs.ReadFile(path.Join(distDir, "Release"))
+	if err != nil {
+		return fmt.Errorf("cannot read local Release file: %w", err)
+	}
+
+	covered := false
+
+	inRelease, err := d.readOptional(path.Join(distDir, "InRelease"))
+	if err != nil {
+		return err
+	}
+	if inRelease != nil {
+		block, _ := clearsign.Decode(inRelease)
+		if block == nil {
+			return errors.New("cannot decode InRelease: not a clearsigned message")
+		}
+		if err := d.checkSignature(keyring, bytes.NewReader(block.Bytes), block.ArmoredSignature.Body); err != nil {
+			return fmt.Errorf("invalid InRelease signature: %w", err)
+		}
+		if !bytes.Equal(canonicalSignedText(release), canonicalSignedText(block.Plaintext)) {
+			return errors.New("InRelease content does not match Release")
+		}
+		covered = true
+	}
+
+	releaseGPG, err := d.readOptional(path.Join(distDir, "Release.gpg"))
+	if err != nil {
+		return err
+	}
+	if releaseGPG != nil {
+		var sig io.Reader = bytes.NewReader(releaseGPG)
+		if isArmored(releaseGPG) {
+			block, err := armor.Decode(sig)
+			if err != nil {
+				return fmt.Errorf("cannot decode Release.gpg: %w", err)
+			}
+			sig = block.Body
+		}
+		if err := d.checkSignature(keyring, bytes.NewReader(release), sig); err != nil {
+			return fmt.Errorf("invalid Release.gpg signature: %w", err)
+		}
+		covered = true
+	}
+
+	if !covered {
+		return errSignatureMissing
+	}
+	return nil
+}
+
+// checkSignature verifies a detached signature over signed and, if KeyFingerprints is
+// configured, ensures the signing key (or its primary key) is one of the pinned ones.
+func (d *dittoRepo) checkSignature(keyring openpgp.EntityList, signed, signature io.Reader) error {
+	sig, signer, err := openpgp.VerifyDetachedSignature(keyring, signed, signature, nil)
+	if err != nil {
+		return err
+	}
+	if len(d.config.KeyFingerprints) == 0 {
+		return nil
+	}
+
+	signerFingerprints := []string{fmt.Sprintf("%X", signer.PrimaryKey.Fingerprint)}
+	for _, sub := range signer.Subkeys {
+		if sig.IssuerKeyId != nil && sub.PublicKey.KeyId == *sig.IssuerKeyId {
+			signerFingerprints = append(signerFingerprints, fmt.Sprintf("%X", sub.PublicKey.Fingerprint))
+		}
+	}
+	for _, want := range d.config.KeyFingerprints {
+		want = normalizeFingerprint(want)
+		for _, got := range signerFingerprints {
+			if got == want {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("signed by unexpected key %s", signerFingerprints[0])
+}
+
+// readOptional reads a file that may legitimately be absent, returning nil data and no
+// error in that case.
+func (d *dittoRepo) readOptional(filePath string) ([]byte, error) {
+	data, err := d.fs.ReadFile(filePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %w", path.Base(filePath), err)
+	}
+	return data, nil
+}
+
+// canonicalSignedText normalises signed text the way the clearsign decoder does (no
+// carriage returns or trailing whitespace) and drops trailing newlines, whose handling
+// differs between signing tools, so a Release file and the text of an InRelease file can
+// be compared byte for byte.
+func canonicalSignedText(data []byte) []byte {
+	lines := strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t")
+	}
+	return []byte(strings.TrimRight(strings.Join(lines, "\n"), "\n"))
+}
+
+// normalizeFingerprint upper-cases a fingerprint and strips spaces and any "0x" prefix,
+// so that values copied from gpg output compare equal.
+func normalizeFingerprint(fp string) string {
+	fp = strings.ToUpper(strings.ReplaceAll(fp, " ", ""))
+	return strings.TrimPrefix(fp, "0X")
+}
+
+// isArmored reports whether data looks like ASCII-armored OpenPGP data.
+func isArmored(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN PGP"))
+}
+
+// loadSigningKey reads the private key configured in SigningKey (ASCII-armored or binary)
+// and decrypts it with SigningKeyPassphrase (or SigningKeyPassphraseFile) when its primary
+// key or any of its subkeys is protected.
+func (d *dittoRepo) loadSigningKey() (*openpgp.Entity, error) {
+	data, err := d.fs.ReadFile(d.config.SigningKey)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read signing key %s: %w", d.config.SigningKey, err)
+	}
+
+	var entities openpgp.EntityList
+	if isArmored(data) {
+		entities, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	} else {
+		entities, err = openpgp.ReadKeyRing(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse signing key %s: %w", d.config.SigningKey, err)
+	}
+
+	for _, e := range entities {
+		if e.PrivateKey == nil {
+			continue
+		}
+		if hasEncryptedKeys(e) {
+			passphrase, err := d.signingKeyPassphrase()
+			if err != nil {
+				return nil, err
+			}
+			if err := e.DecryptPrivateKeys(passphrase); err != nil {
+				return nil, fmt.Errorf("cannot decrypt signing key %s: %w", d.config.SigningKey, err)
+			}
+		}
+		return e, nil
+	}
+	return nil, fmt.Errorf("signing key %s contains no private key", d.config.SigningKey)
+}
+
+// hasEncryptedKeys reports whether the private primary key of e, or the private key of
+// any of its subkeys, is still encrypted. The primary key of a key exported with only its
+// signing subkeys may be unprotected while the subkeys are not.
+func hasEncryptedKeys(e *openpgp.Entity) bool {
+	if e.PrivateKey != nil && e.PrivateKey.Encrypted {
+		return true
+	}
+	for _, sub := range e.Subkeys {
+		if sub.PrivateKey != nil && sub.PrivateKey.Encrypted {
+			return true
+		}
+	}
+	return false
+}
+
+// signingKeyPassphrase returns the passphrase of SigningKey, read from
+// SigningKeyPassphraseFile when it is set.
+func (d *dittoRepo) signingKeyPassphrase() ([]byte, error) {
+	if d.config.SigningKeyPassphraseFile == "" {
+		return []byte(d.config.SigningKeyPassphrase), nil
+	}
+	data, err := d.fs.ReadFile(d.config.SigningKeyPassphraseFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read signing key passphrase %s: %w", d.config.SigningKeyPassphraseFile, err)
+	}
+	data = bytes.TrimSuffix(data, []byte("\n"))
+	return bytes.TrimSuffix(data, []byte("\r")), nil
+}
+
+// signRelease signs a Release file with the configured SigningKey, returning the
+// clearsigned InRelease and the armored detached Release.gpg signature.
+func (d *dittoRepo) signRelease(release []byte) (inRelease, releaseGPG []byte, err error) {
+	signer, err := d.loadSigningKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	key, ok := signer.SigningKey(time.Now())
+	if !ok {
+		return nil, nil, fmt.Errorf("signing key %s has no valid signing (sub)key", d.config.SigningKey)
+	}
+
+	var clear bytes.Buffer
+	w, err := clearsign.Encode(&clear, key.PrivateKey, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := w.Write(release); err != nil {
+		return nil, nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	var detached bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&detached, signer, bytes.NewReader(release), nil); err != nil {
+		return nil, nil, err
+	}
+	return clear.Bytes(), detached.Bytes(), nil
+}
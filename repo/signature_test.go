@@ -0,0 +1,258 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+const signedReleaseContent = `Origin: Ubuntu
+Label: Ubuntu
+Suite: focal
+SHA256:
+ e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855        0 main/binary-amd64/Packages.gz
+`
+
+// newTestEntity generates a fast (EdDSA) OpenPGP key pair for signing test fixtures.
+func newTestEntity(t *testing.T, name string) *openpgp.Entity {
+	t.Helper()
+	e, err := openpgp.NewEntity(name, "", name+"@example.com", &packet.Config{Algorithm: packet.PubKeyAlgoEdDSA})
+	if err != nil {
+		t.Fatalf("cannot generate key: %v", err)
+	}
+	return e
+}
+
+// armoredPublicKey serialises the public part of e as an armored keyring.
+func armoredPublicKey(t *testing.T, e *openpgp.Entity) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	return buf.Bytes()
+}
+
+// detachSign returns an armored detached signature over content.
+func detachSign(t *testing.T, e *openpgp.Entity, content string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&buf, e, strings.NewReader(content), nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// clearSign returns content wrapped in a clearsigned InRelease message.
+func clearSign(t *testing.T, e *openpgp.Entity, content string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := clearsign.Encode(&buf, e.PrivateKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = w.Write([]byte(content))
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestVerifyReleaseSignature(t *testing.T) {
+	signer := newTestEntity(t, "archive")
+	other := newTestEntity(t, "intruder")
+	signerFP := fmt.Sprintf("%X", signer.PrimaryKey.Fingerprint)
+
+	setup := func(t *testing.T, files map[string][]byte, fingerprints []string) *dittoRepo {
+		t.Helper()
+		memFS := NewMemFileSystem().(*MemFileSystem)
+		_ = memFS.MkdirAll("/mirror/dists/focal", 0o755)
+		_ = memFS.MkdirAll("/keys", 0o755)
+		memFS.mu.Lock()
+		memFS.files["/keys/archive.asc"] = &memFile{data: armoredPublicKey(t, signer), mode: 0o644, modTime: time.Now()}
+		for name, data := range files {
+			memFS.files["/mirror/dists/focal/"+name] = &memFile{data: data, mode: 0o644, modTime: time.Now()}
+		}
+		memFS.mu.Unlock()
+
+		return NewDittoRepo(DittoConfig{
+			DownloadPath:    "/mirror",
+			Keyrings:        []string{"/keys/archive.asc"},
+			KeyFingerprints: fingerprints,
+			Logger:          &mockLogger{},
+			FileSystem:      memFS,
+			Downloader:      &mockDownloader{},
+		}).(*dittoRepo)
+	}
+
+	tests := []struct {
+		name         string
+		files        map[string][]byte
+		fingerprints []string
+		wantErr      bool
+	}{
+		{
+			name: "valid Release.gpg",
+			files: map[string][]byte{
+				"Release":     []byte(signedReleaseContent),
+				"Release.gpg": detachSign(t, signer, signedReleaseContent),
+			},
+		},
+		{
+			name: "valid InRelease only",
+			files: map[string][]byte{
+				"Release":   []byte(signedReleaseContent),
+				"InRelease": clearSign(t, signer, signedReleaseContent),
+			},
+		},
+		{
+			name: "valid InRelease and Release.gpg with pinned fingerprint",
+			files: map[string][]byte{
+				"Release":     []byte(signedReleaseContent),
+				"InRelease":   clearSign(t, signer, signedReleaseContent),
+				"Release.gpg": detachSign(t, signer, signedReleaseContent),
+			},
+			fingerprints: []string{strings.ToLower(signerFP)},
+		},
+		{
+			name: "tampered Release",
+			files: map[string][]byte{
+				"Release":     []byte(signedReleaseContent + "Extra: field\n"),
+				"Release.gpg": detachSign(t, signer, signedReleaseContent),
+			},
+			wantErr: true,
+		},
+		{
+			name: "InRelease does not match Release",
+			files: map[string][]byte{
+				"Release":   []byte(signedReleaseContent + "Extra: field\n"),
+				"InRelease": clearSign(t, signer, signedReleaseContent),
+			},
+			wantErr: true,
+		},
+		{
+			name: "signed by unknown key",
+			files: map[string][]byte{
+				"Release":     []byte(signedReleaseContent),
+				"Release.gpg": detachSign(t, other, signedReleaseContent),
+			},
+			wantErr: true,
+		},
+		{
+			name: "fingerprint pin mismatch",
+			files: map[string][]byte{
+				"Release":     []byte(signedReleaseContent),
+				"Release.gpg": detachSign(t, signer, signedReleaseContent),
+			},
+			fingerprints: []string{fmt.Sprintf("%X", other.PrimaryKey.Fingerprint)},
+			wantErr:      true,
+		},
+		{
+			name:    "no signature at all",
+			files:   map[string][]byte{"Release": []byte(signedReleaseContent)},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := setup(t, tt.files, tt.fingerprints)
+			err := repo.verifyReleaseSignature("focal")
+			if tt.wantErr && err == nil {
+				t.Error("expected verification to fail, got nil")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("expected verification to pass, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestMirrorDistribution_AbortsOnBadSignature(t *testing.T) {
+	signer := newTestEntity(t, "archive")
+
+	memFS := NewMemFileSystem().(*MemFileSystem)
+	_ = memFS.MkdirAll("/mirror/dists/focal", 0o755)
+	_ = memFS.MkdirAll("/keys", 0o755)
+	memFS.mu.Lock()
+	memFS.files["/keys/archive.asc"] = &memFile{data: armoredPublicKey(t, signer), mode: 0o644, modTime: time.Now()}
+	memFS.files["/mirror/dists/focal/Release"] = &memFile{data: []byte(signedReleaseContent), mode: 0o644, modTime: time.Now()}
+	memFS.mu.Unlock()
+
+	md := &mockDownloader{}
+	repo := NewDittoRepo(DittoConfig{
+		RepoURL:      "http://example.com/ubuntu",
+		Dists:        []string{"focal"},
+		Components:   []string{"main"},
+		Archs:        []string{"amd64"},
+		DownloadPath: "/mirror",
+		Keyrings:     []string{"/keys/archive.asc"},
+		Logger:       &mockLogger{},
+		FileSystem:   memFS,
+		Downloader:   md,
+	}).(*dittoRepo)
+	repo.progressChan = make(chan ProgressUpdate, 100)
+
+	if err := repo.mirrorDistribution(context.Background(), "focal"); err == nil {
+		t.Fatal("expected mirrorDistribution to fail without a valid signature")
+	}
+	for _, url := range md.downloads {
+		if strings.Contains(url, "Packages") {
+			t.Errorf("index %s was fetched despite the failed signature check", url)
+		}
+	}
+}
+
+func TestMirrorDistribution_DropsStaleSignatures(t *testing.T) {
+	signer := newTestEntity(t, "archive")
+
+	// The previous run left a Release file and its valid signatures behind.
+	memFS := NewMemFileSystem().(*MemFileSystem)
+	_ = memFS.MkdirAll("/mirror/dists/focal", 0o755)
+	_ = memFS.MkdirAll("/keys", 0o755)
+	memFS.mu.Lock()
+	memFS.files["/keys/archive.asc"] = &memFile{data: armoredPublicKey(t, signer), mode: 0o644, modTime: time.Now()}
+	memFS.files["/mirror/dists/focal/Release"] = &memFile{data: []byte(signedReleaseContent), mode: 0o644, modTime: time.Now()}
+	memFS.files["/mirror/dists/focal/InRelease"] = &memFile{data: clearSign(t, signer, signedReleaseContent), mode: 0o644, modTime: time.Now()}
+	memFS.files["/mirror/dists/focal/Release.gpg"] = &memFile{data: detachSign(t, signer, signedReleaseContent), mode: 0o644, modTime: time.Now()}
+	memFS.mu.Unlock()
+
+	// This run cannot fetch the signatures.
+	notFound := fmt.Errorf("status 404")
+	md := &mockDownloader{errByURL: map[string]error{
+		"http://example.com/ubuntu/dists/focal/InRelease":   notFound,
+		"http://example.com/ubuntu/dists/focal/Release.gpg": notFound,
+	}}
+	repo := NewDittoRepo(DittoConfig{
+		RepoURL:      "http://example.com/ubuntu",
+		Dists:        []string{"focal"},
+		Components:   []string{"main"},
+		Archs:        []string{"amd64"},
+		DownloadPath: "/mirror",
+		Keyrings:     []string{"/keys/archive.asc"},
+		Logger:       &mockLogger{},
+		FileSystem:   memFS,
+		Downloader:   md,
+	}).(*dittoRepo)
+	repo.progressChan = make(chan ProgressUpdate, 100)
+
+	if err := repo.mirrorDistribution(context.Background(), "focal"); err == nil {
+		t.Fatal("expected mirrorDistribution to fail when the signatures cannot be fetched")
+	}
+	for _, stale := range []string{"/mirror/dists/focal/InRelease", "/mirror/dists/focal/Release.gpg"} {
+		if _, err := memFS.Stat(stale); err == nil {
+			t.Errorf("stale %s was kept", stale)
+		}
+	}
+}